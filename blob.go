@@ -0,0 +1,223 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl/fastnode"
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// The blob threshold of a database is recorded in the metadata under blobThresholdKey.
+// Databases without the entry store all values inline.
+const blobThresholdKey = "blob_threshold"
+
+var (
+	// Values of at least Options.BlobThreshold bytes are stored once under their SHA-256 hash,
+	// and leaf nodes and fast nodes only hold the hash.
+	blobKeyFormat = keyformat.NewKeyFormat('b', hashSize) // b<hash>
+
+	// Every leaf node referencing a blob is recorded under the blob hash and its node key, so
+	// that the blob can be deleted once the last of these nodes is pruned.
+	blobRefKeyFormat = keyformat.NewKeyFormat('c', hashSize, 0) // c<hash><node key>
+
+	// Likewise, every fast node referencing a blob is recorded under the blob hash and its key,
+	// so that the blob is kept while the fast node index references it, even if it is stale.
+	blobFastRefKeyFormat = keyformat.NewKeyFormat('d', hashSize, 0) // d<hash><key>
+)
+
+// When blobs are enabled, values on disk are prefixed with one of these tags.
+const (
+	inlineValueTag byte = iota // Followed by the value, compressed if enabled.
+	blobValueTag               // Followed by the hash of the value.
+)
+
+// isBlob returns true if the value is stored as a blob. The storage format must be decided.
+func (ndb *nodeDB) isBlob(value []byte) bool {
+	return ndb.blobThreshold > 0 && len(value) >= ndb.blobThreshold
+}
+
+// encodeValue returns the value as stored in leaf nodes and fast nodes on disk. Blobs must be
+// saved separately, see saveBlobToBatch.
+func (ndb *nodeDB) encodeValue(value []byte) ([]byte, error) {
+	if err := ndb.storageFormat(); err != nil {
+		return nil, err
+	}
+	if ndb.blobThreshold == 0 {
+		return ndb.compressValue(value)
+	}
+	if ndb.isBlob(value) {
+		hash := sha256.Sum256(value)
+		return append([]byte{blobValueTag}, hash[:]...), nil
+	}
+	compressed, err := ndb.compressValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{inlineValueTag}, compressed...), nil
+}
+
+// decodeValue returns the value stored as buf by encodeValue, reading it from its blob if needed.
+func (ndb *nodeDB) decodeValue(buf []byte) ([]byte, error) {
+	if err := ndb.storageFormat(); err != nil {
+		return nil, err
+	}
+	if ndb.blobThreshold == 0 {
+		return ndb.decompressValue(buf)
+	}
+	if len(buf) == 0 {
+		return nil, errors.New("missing value tag")
+	}
+	switch buf[0] {
+	case inlineValueTag:
+		return ndb.decompressValue(buf[1:])
+	case blobValueTag:
+		if len(buf) != 1+hashSize {
+			return nil, fmt.Errorf("invalid blob reference %X", buf[1:])
+		}
+		blob, err := ndb.db.Get(blobKeyFormat.Key(buf[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if blob == nil {
+			return nil, fmt.Errorf("blob %X not found", buf[1:])
+		}
+		ndb.opts.Metrics.AddBytesRead(len(blob))
+		return ndb.decompressValue(blob)
+	default:
+		return nil, fmt.Errorf("invalid value tag %d", buf[0])
+	}
+}
+
+// blobRefKey returns the key recording that the given leaf node references its blob, or nil
+// if its value is stored inline.
+func (ndb *nodeDB) blobRefKey(node *Node) []byte {
+	if !node.isLeaf() || !ndb.isBlob(node.value) {
+		return nil
+	}
+	hash := sha256.Sum256(node.value)
+	return blobRefKeyFormat.Key(hash[:], node.nodeKey)
+}
+
+// saveBlobToBatch saves the value of the given leaf node as a blob if it is large enough, and
+// records the node as referencing it. Blobs already on disk are not written again.
+func (ndb *nodeDB) saveBlobToBatch(batch dbm.Batch, node *Node) error {
+	refKey := ndb.blobRefKey(node)
+	if refKey == nil {
+		return nil
+	}
+	blobKey := blobKeyFormat.Key(refKey[1 : 1+hashSize])
+	found, err := ndb.db.Has(blobKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		compressed, err := ndb.compressValue(node.value)
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(blobKey, compressed); err != nil {
+			return err
+		}
+		ndb.opts.Metrics.AddBytesWritten(len(compressed))
+	}
+	return batch.Set(refKey, []byte{})
+}
+
+// deleteBlobRef deletes the reference of the given leaf node to its blob, if any. The blob
+// itself is deleted by collectBlobs once the deletion is committed, unless it is still
+// referenced.
+//
+// Contract: the caller should hold the ndb.mtx lock.
+func (ndb *nodeDB) deleteBlobRef(node *Node) error {
+	refKey := ndb.blobRefKey(node)
+	if refKey == nil {
+		return nil
+	}
+	if err := ndb.batch.Delete(refKey); err != nil {
+		return err
+	}
+	ndb.addBlobCandidate(refKey[1 : 1+hashSize])
+	return nil
+}
+
+// setFastNodeBlobRef records that the fast node with the given key references the blob with the
+// given hash, or none if nil, in place of the blob the fast node on disk references, if any.
+//
+// Contract: the caller should hold the ndb.mtx lock.
+func (ndb *nodeDB) setFastNodeBlobRef(key, hash []byte) error {
+	if err := ndb.storageFormat(); err != nil {
+		return err
+	}
+	if ndb.blobThreshold == 0 {
+		return nil
+	}
+
+	buf, err := ndb.db.Get(ndb.fastNodeKey(key))
+	if err != nil {
+		return err
+	}
+	if buf != nil {
+		stored, err := fastnode.DeserializeNode(key, buf)
+		if err != nil {
+			return err
+		}
+		value := stored.GetValue()
+		if len(value) == 1+hashSize && value[0] == blobValueTag && !bytes.Equal(value[1:], hash) {
+			if err := ndb.batch.Delete(blobFastRefKeyFormat.Key(value[1:], key)); err != nil {
+				return err
+			}
+			ndb.addBlobCandidate(value[1:])
+		}
+	}
+	if hash == nil {
+		return nil
+	}
+	return ndb.batch.Set(blobFastRefKeyFormat.Key(hash, key), []byte{})
+}
+
+// addBlobCandidate records that the blob with the given hash lost a reference, see collectBlobs.
+//
+// Contract: the caller should hold the ndb.mtx lock.
+func (ndb *nodeDB) addBlobCandidate(hash []byte) {
+	if ndb.blobCandidates == nil {
+		ndb.blobCandidates = make(map[string]struct{})
+	}
+	ndb.blobCandidates[string(hash)] = struct{}{}
+}
+
+// collectBlobs deletes the blobs which lost a reference in the last commit, and are no longer
+// referenced at all, by leaf nodes or fast nodes. Since versions are only pruned once no commit is pending, a blob can't be
+// referenced by a node which is not on disk yet. A crash before the blobs are deleted leaves
+// them on disk, without affecting the tree.
+//
+// Contract: the caller should hold the ndb.mtx lock.
+func (ndb *nodeDB) collectBlobs() error {
+	if len(ndb.blobCandidates) == 0 {
+		return nil
+	}
+	batch := ndb.newBatch()
+	for hash := range ndb.blobCandidates {
+		referenced, err := ndb.hasPrefix(blobRefKeyFormat.Key([]byte(hash)))
+		if err == nil && !referenced {
+			referenced, err = ndb.hasPrefix(blobFastRefKeyFormat.Key([]byte(hash)))
+		}
+		if err != nil {
+			batch.Close()
+			return err
+		}
+		if referenced {
+			continue
+		}
+		if err := batch.Delete(blobKeyFormat.Key([]byte(hash))); err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	ndb.blobCandidates = nil
+	return ndb.writeBatch(batch)
+}
@@ -0,0 +1,266 @@
+package iavl
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// applyRandomBlobVersion applies the same random changes to all trees, with a mix of small and
+// large values, and saves them.
+func applyRandomBlobVersion(t *testing.T, r *rand.Rand, trees ...*MutableTree) {
+	ops := make([][2]int, 50)
+	for i := range ops {
+		ops[i] = [2]int{r.Intn(100), r.Intn(8)}
+	}
+	for _, tree := range trees {
+		for _, op := range ops {
+			key := []byte(strconv.Itoa(op[0]))
+			var err error
+			switch {
+			case op[1] == 0:
+				_, _, err = tree.Remove(key)
+			case op[1] < 4:
+				_, err = tree.Set(key, []byte(strconv.Itoa(op[1])))
+			default:
+				_, err = tree.Set(key, bytes.Repeat([]byte{byte(op[1])}, 200))
+			}
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	for _, opts := range []Options{
+		{BlobThreshold: 100},
+		{BlobThreshold: 100, Compression: SnappyCompression},
+		{BlobThreshold: 100, VersionKeyedNodes: true},
+	} {
+		plainTree, err := NewMutableTree(db.NewMemDB(), 0, false)
+		require.NoError(t, err)
+		blobDB := db.NewMemDB()
+		blobTree, err := NewMutableTreeWithOpts(blobDB, 0, &opts, false)
+		require.NoError(t, err)
+
+		r := rand.New(rand.NewSource(5))
+		for v := 0; v < 20; v++ {
+			applyRandomBlobVersion(t, r, plainTree, blobTree)
+		}
+		requireSameVersions(t, plainTree, blobTree)
+		// There are only 4 distinct large values.
+		require.Equal(t, 4, countPrefix(t, blobDB, blobKeyFormat.Key()))
+
+		// The threshold is kept when reopening the database without the option.
+		blobTree, err = NewMutableTree(blobDB, 0, false)
+		require.NoError(t, err)
+		_, err = blobTree.Load()
+		require.NoError(t, err)
+		requireSameVersions(t, plainTree, blobTree)
+		value, err := blobTree.Get([]byte("1"))
+		require.NoError(t, err)
+		expected, err := plainTree.Get([]byte("1"))
+		require.NoError(t, err)
+		require.Equal(t, expected, value)
+
+		// Replacing the large values and pruning the old versions deletes the blobs.
+		for i := 0; i < 100; i++ {
+			_, err = plainTree.Set([]byte(strconv.Itoa(i)), []byte("small"))
+			require.NoError(t, err)
+			_, err = blobTree.Set([]byte(strconv.Itoa(i)), []byte("small"))
+			require.NoError(t, err)
+		}
+		_, _, err = plainTree.SaveVersion()
+		require.NoError(t, err)
+		_, version, err := blobTree.SaveVersion()
+		require.NoError(t, err)
+		require.NoError(t, plainTree.DeleteVersionsRange(1, version))
+		require.NoError(t, blobTree.DeleteVersionsRange(1, version))
+		requireSameVersions(t, plainTree, blobTree)
+		require.Zero(t, countPrefix(t, blobDB, blobKeyFormat.Key()))
+		require.Zero(t, countPrefix(t, blobDB, blobRefKeyFormat.Key()))
+	}
+}
+
+func TestBlobsPruning(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{BlobThreshold: 100}, false)
+	require.NoError(t, err)
+	large := bytes.Repeat([]byte("a"), 100)
+
+	// A blob is kept as long as any node references it.
+	_, err = tree.Set([]byte("a"), large)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), large)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("small"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 1, countPrefix(t, memDB, blobKeyFormat.Key()))
+	require.Equal(t, 2, countPrefix(t, memDB, blobRefKeyFormat.Key()))
+
+	require.NoError(t, tree.DeleteVersion(1))
+	require.Equal(t, 1, countPrefix(t, memDB, blobKeyFormat.Key()))
+	require.Equal(t, 1, countPrefix(t, memDB, blobRefKeyFormat.Key()))
+
+	// Overwriting versions deletes the blobs of the newer versions.
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.LoadVersionForOverwriting(2)
+	require.NoError(t, err)
+	value, err := tree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, large, value)
+	_, err = tree.Set([]byte("c"), bytes.Repeat([]byte("c"), 100))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 2, countPrefix(t, memDB, blobKeyFormat.Key()))
+	_, err = tree.LoadVersionForOverwriting(2)
+	require.NoError(t, err)
+	require.Equal(t, 1, countPrefix(t, memDB, blobKeyFormat.Key()))
+	require.Equal(t, 1, countPrefix(t, memDB, blobRefKeyFormat.Key()))
+}
+
+func TestBlobsPruning_SaveVersionAsync(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{BlobThreshold: 100}, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), bytes.Repeat([]byte("a"), 100))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("small"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// The blob loses its last reference in the batch written by the async commit.
+	require.NoError(t, tree.ndb.DeleteVersionsRange(1, 2, nil))
+	handle, err := tree.SaveVersionAsync()
+	require.NoError(t, err)
+	require.NoError(t, handle.Wait())
+	require.Zero(t, countPrefix(t, memDB, blobRefKeyFormat.Key()))
+	require.Zero(t, countPrefix(t, memDB, blobKeyFormat.Key()))
+}
+
+func TestBlobsPruning_StaleFastNodes(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{BlobThreshold: 100}, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("small"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), bytes.Repeat([]byte("b"), 100))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 1, countPrefix(t, memDB, blobFastRefKeyFormat.Key()))
+
+	// Rolling back commits before the fast node index is rebuilt, so the blob is kept as long
+	// as the stale fast node references it.
+	require.NoError(t, tree.ndb.DeleteVersionsFrom(2))
+	require.NoError(t, tree.ndb.Commit())
+	require.Zero(t, countPrefix(t, memDB, blobRefKeyFormat.Key()))
+	require.Equal(t, 1, countPrefix(t, memDB, blobKeyFormat.Key()))
+
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, 1, countPrefix(t, memDB, fastKeyFormat.Key()))
+	require.Zero(t, countPrefix(t, memDB, blobFastRefKeyFormat.Key()))
+	require.Zero(t, countPrefix(t, memDB, blobKeyFormat.Key()))
+	requireTreeContents(t, tree, map[string]string{"a": "small"})
+}
+
+func TestBlobsMigrationAndImport(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{BlobThreshold: 100}, false)
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(3))
+	for v := 0; v < 10; v++ {
+		applyRandomBlobVersion(t, r, tree)
+	}
+	refs := countPrefix(t, memDB, blobRefKeyFormat.Key())
+
+	// Migrating to the version-keyed layout moves the references to the new node keys.
+	migrated, err := NewMutableTreeWithOpts(memDB, 0, &Options{VersionKeyedNodes: true}, false)
+	require.NoError(t, err)
+	_, err = migrated.Load()
+	require.NoError(t, err)
+	requireSameVersions(t, tree, migrated)
+	require.Equal(t, refs, countPrefix(t, memDB, blobRefKeyFormat.Key()))
+	itr, err := db.IteratePrefix(memDB, blobRefKeyFormat.Key())
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		require.True(t, isVersionedNodeKey(itr.Key()[1+hashSize:]))
+	}
+	require.NoError(t, itr.Close())
+
+	// Imported nodes reference their blobs as well.
+	exporter, err := migrated.ImmutableTree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	importDB := db.NewMemDB()
+	imported, err := NewMutableTreeWithOpts(importDB, 0, &Options{BlobThreshold: 100}, false)
+	require.NoError(t, err)
+	importer, err := imported.Import(migrated.Version())
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		item, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(item))
+	}
+	require.NoError(t, importer.Commit())
+	_, err = imported.Load()
+	require.NoError(t, err)
+
+	expectedHash, err := migrated.Hash()
+	require.NoError(t, err)
+	hash, err := imported.Hash()
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, hash)
+	require.NotZero(t, countPrefix(t, importDB, blobKeyFormat.Key()))
+	value, err := imported.Get([]byte("1"))
+	require.NoError(t, err)
+	expected, err := migrated.Get([]byte("1"))
+	require.NoError(t, err)
+	require.Equal(t, expected, value)
+}
+
+func TestBlobThresholdMismatch(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{BlobThreshold: 100}, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{BlobThreshold: 200}, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.Error(t, err)
+
+	// Nor can the compression change.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{BlobThreshold: 100, Compression: ZstdCompression}, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.Error(t, err)
+}
@@ -0,0 +1,101 @@
+package iavl
+
+import (
+	"errors"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// ErrBranchConflict is returned when merging a branch into a tree which was modified since the
+// branch was created.
+var ErrBranchConflict = errors.New("tree was modified since the branch was created")
+
+// Branch returns an independent working tree starting from the working tree, e.g. to execute
+// transactions speculatively. The branch can be modified and hashed without affecting the tree,
+// and is then either discarded, or merged back with Merge. It can't be saved, and returns
+// ErrBranchWrite when writing to the database.
+//
+// The branch shares the nodes of the tree, persisted or not. Nodes are never modified in place,
+// so only the paths to modified keys are copied. The working hash is computed before branching,
+// so the branch and the tree can be modified and hashed from different goroutines. However,
+// saving the tree updates the shared nodes in place, and loading a version may delete persisted
+// ones, so the tree must not be saved or loaded while any of its branches is in use.
+func (tree *MutableTree) Branch() (*MutableTree, error) {
+	if err := tree.waitPendingCommit(); err != nil {
+		return nil, err
+	}
+	if _, err := tree.WorkingHash(); err != nil {
+		return nil, err
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	versions := make(map[int64]bool, len(tree.versions))
+	for version, exists := range tree.versions {
+		versions[version] = exists
+	}
+	additions := make(map[string]*fastnode.Node, len(tree.unsavedFastNodeAdditions))
+	for key, node := range tree.unsavedFastNodeAdditions {
+		additions[key] = node
+	}
+	removals := make(map[string]interface{}, len(tree.unsavedFastNodeRemovals))
+	for key, removal := range tree.unsavedFastNodeRemovals {
+		removals[key] = removal
+	}
+
+	return &MutableTree{
+		ImmutableTree:            tree.ImmutableTree.clone(),
+		lastSaved:                tree.lastSaved,
+		versions:                 versions,
+		allRootLoaded:            tree.allRootLoaded,
+		unsavedFastNodeAdditions: additions,
+		unsavedFastNodeRemovals:  removals,
+		ndb:                      tree.ndb,
+		skipFastStorageUpgrade:   tree.skipFastStorageUpgrade,
+		branchOf:                 tree,
+		branchRoot:               tree.root,
+	}, nil
+}
+
+// Merge replaces the working tree with the given branch of it, created by Branch. It returns
+// ErrBranchConflict if the working tree was modified, saved or rolled back since, in which case
+// the branch must be discarded. The savepoints of the tree stay valid, and rolling back to one
+// also reverts the merge.
+func (tree *MutableTree) Merge(branch *MutableTree) error {
+	if branch.branchOf != tree {
+		return errors.New("not a branch of the tree")
+	}
+	if tree.root != branch.branchRoot || tree.version != branch.version {
+		return ErrBranchConflict
+	}
+
+	// Every fast node changed by the branch is in its unsaved fast nodes, and every fast node it
+	// reverted is in those of the tree.
+	for key := range tree.unsavedFastNodeAdditions {
+		tree.journalFastNode(key)
+	}
+	for key := range tree.unsavedFastNodeRemovals {
+		tree.journalFastNode(key)
+	}
+	for key := range branch.unsavedFastNodeAdditions {
+		tree.journalFastNode(key)
+	}
+	for key := range branch.unsavedFastNodeRemovals {
+		tree.journalFastNode(key)
+	}
+
+	working := tree.ImmutableTree.clone()
+	working.root = branch.root
+	tree.ImmutableTree = working
+	// The branch keeps the maps, so the tree takes copies.
+	tree.unsavedFastNodeAdditions = make(map[string]*fastnode.Node, len(branch.unsavedFastNodeAdditions))
+	for key, node := range branch.unsavedFastNodeAdditions {
+		tree.unsavedFastNodeAdditions[key] = node
+	}
+	tree.unsavedFastNodeRemovals = make(map[string]interface{}, len(branch.unsavedFastNodeRemovals))
+	for key, removal := range branch.unsavedFastNodeRemovals {
+		tree.unsavedFastNodeRemovals[key] = removal
+	}
+	return nil
+}
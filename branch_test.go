@@ -0,0 +1,154 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutableTree_Branch(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("saved"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key-00"), []byte("unsaved"))
+	require.NoError(t, err)
+	hash, err := tree.WorkingHash()
+	require.NoError(t, err)
+
+	branch, err := tree.Branch()
+	require.NoError(t, err)
+	_, err = branch.Set([]byte("key-01"), []byte("branch"))
+	require.NoError(t, err)
+	_, _, err = branch.Remove([]byte("key-02"))
+	require.NoError(t, err)
+	_, _, err = branch.SaveVersion()
+	require.ErrorIs(t, err, ErrBranchWrite)
+	require.ErrorIs(t, branch.DeleteVersion(1), ErrBranchWrite)
+
+	// The tree is unaffected by the branch.
+	treeHash, err := tree.WorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, treeHash)
+	value, err := tree.Get([]byte("key-01"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("saved"), value)
+
+	expected := map[string]string{}
+	for i := 3; i < 20; i++ {
+		expected[fmt.Sprintf("key-%02d", i)] = "saved"
+	}
+	expected["key-00"], expected["key-01"] = "unsaved", "branch"
+	requireTreeContents(t, branch, expected)
+	branchHash, err := branch.WorkingHash()
+	require.NoError(t, err)
+
+	sp := tree.Savepoint()
+	require.NoError(t, tree.Merge(branch))
+	requireTreeContents(t, tree, expected)
+	treeHash, err = tree.WorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, branchHash, treeHash)
+
+	// Rolling back to a savepoint reverts the merge.
+	require.NoError(t, tree.RollbackTo(sp))
+	treeHash, err = tree.WorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, treeHash)
+	require.NoError(t, tree.Merge(branch))
+
+	// The merged tree saves the changes of the branch.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	loaded, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	requireTreeContents(t, loaded, expected)
+
+	// The branch no longer merges once the tree is saved.
+	require.ErrorIs(t, tree.Merge(branch), ErrBranchConflict)
+	other, err := loaded.Branch()
+	require.NoError(t, err)
+	require.Error(t, tree.Merge(other))
+}
+
+func TestMutableTree_Branch_Conflict(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+
+	branch, err := tree.Branch()
+	require.NoError(t, err)
+	_, err = branch.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+	require.ErrorIs(t, tree.Merge(branch), ErrBranchConflict)
+	requireTreeContents(t, tree, map[string]string{"a": "1", "c": "3"})
+}
+
+func TestMutableTree_Branch_Concurrent(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("saved"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 100; i += 2 {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("unsaved"))
+		require.NoError(t, err)
+	}
+
+	setKeys := func(tr *MutableTree, i int) ([]byte, error) {
+		for j := i; j < 100; j += 3 {
+			if _, err := tr.Set([]byte(fmt.Sprintf("key-%03d", j)), []byte{byte(i)}); err != nil {
+				return nil, err
+			}
+		}
+		return tr.WorkingHash()
+	}
+
+	// The expected hashes come from making the changes on branches one after the other.
+	expected := make([][]byte, 5)
+	for i := range expected {
+		branch, err := tree.Branch()
+		require.NoError(t, err)
+		expected[i], err = setKeys(branch, i)
+		require.NoError(t, err)
+	}
+
+	// Branches are modified and hashed concurrently with each other and with the tree.
+	trees := []*MutableTree{tree}
+	for i := 1; i < len(expected); i++ {
+		branch, err := tree.Branch()
+		require.NoError(t, err)
+		trees = append(trees, branch)
+	}
+	hashes := make([][]byte, len(trees))
+	errs := make([]error, len(trees))
+	var wg sync.WaitGroup
+	for i, tr := range trees {
+		wg.Add(1)
+		go func(i int, tr *MutableTree) {
+			defer wg.Done()
+			hashes[i], errs[i] = setKeys(tr, i)
+		}(i, tr)
+	}
+	wg.Wait()
+	for i := range trees {
+		require.NoError(t, errs[i])
+		require.Equal(t, expected[i], hashes[i], "tree %d", i)
+	}
+}
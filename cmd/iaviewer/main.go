@@ -126,7 +126,7 @@ func ReadTree(dir string, version int, prefix []byte) (*iavl.MutableTree, error)
 		db = dbm.NewPrefixDB(db, prefix)
 	}
 
-	tree, err := iavl.NewMutableTree(db, DefaultCacheSize, false)
+	tree, err := iavl.NewMutableTreeWithOpts(db, DefaultCacheSize, &iavl.Options{ReadOnly: true}, false)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,111 @@
+package iavl
+
+import (
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// CommitHandle tracks a version saved by MutableTree.SaveVersionAsync() whose nodes are still
+// being written to disk in the background.
+//
+// The version becomes durable once Wait() returns nil. Until then, the MutableTree keeps serving
+// the version from memory, and waits for the handle itself before any operation that needs the
+// version on disk, such as saving the next version or deleting versions.
+type CommitHandle struct {
+	version int64
+	hash    []byte
+	done    chan struct{}
+	err     error
+
+	// Nodes written by the commit, whose child pointers are cleared once they are durable.
+	savedNodes []*Node
+	// Fast node changes of the version, which are not visible on disk until the commit is done.
+	fastNodeAdditions map[string]*fastnode.Node
+	fastNodeRemovals  map[string]interface{}
+}
+
+// newCommitHandle returns a handle for a version that has been fully written to disk already.
+func newCommitHandle(version int64, hash []byte) *CommitHandle {
+	h := &CommitHandle{
+		version: version,
+		hash:    hash,
+		done:    make(chan struct{}),
+	}
+	close(h.done)
+	return h
+}
+
+// Version returns the version being committed.
+func (h *CommitHandle) Version() int64 {
+	return h.version
+}
+
+// Hash returns the root hash of the version being committed. It is available immediately.
+func (h *CommitHandle) Hash() []byte {
+	return h.hash
+}
+
+// Done returns a channel which is closed once the background write has finished, successfully
+// or not.
+func (h *CommitHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the version has been written to disk, and returns the write error if any.
+// It is safe to call multiple times and from multiple goroutines.
+func (h *CommitHandle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// isDone returns true if the background write has finished.
+func (h *CommitHandle) isDone() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// write writes the detached batch and signals completion. It is run on its own goroutine.
+func (h *CommitHandle) write(ndb *nodeDB, batch dbm.Batch) {
+	defer close(h.done)
+	h.err = ndb.writeBatch(batch)
+	if h.err != nil {
+		ndb.opts.Logger.Error("failed to write saved version", "version", h.version, "err", h.err)
+		return
+	}
+
+	// Pruning waits for the commit, so the blob candidates all lost a reference in the batch. The
+	// version is durable regardless, and the candidates are kept for the next commit on failure.
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if err := ndb.collectBlobs(); err != nil {
+		ndb.opts.Logger.Error("failed to collect blobs", "version", h.version, "err", err)
+	}
+}
+
+// discard drops the state the failed commit left in the nodeDB: the saved nodes and fast nodes,
+// which are cached although they are not on disk, and the latest version and the version of the
+// fast node index, which are reloaded from disk.
+func (h *CommitHandle) discard(ndb *nodeDB) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for _, node := range h.savedNodes {
+		ndb.nodeCache.Remove(node.GetKey())
+	}
+	for key := range h.fastNodeAdditions {
+		ndb.fastNodeCache.Remove([]byte(key))
+	}
+	ndb.resetLatestVersion(0)
+
+	fastStorageVersion, upgraded, err := ndb.getMigration(fastStorageMigrationID)
+	if err != nil || !upgraded {
+		// Without a readable record, the fast node index is rebuilt when the tree is loaded.
+		fastStorageVersion = -1
+	}
+	ndb.fastStorageVersion = fastStorageVersion
+}
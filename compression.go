@@ -0,0 +1,96 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm compressing the values of leaf nodes and fast nodes on disk.
+type Compression string
+
+const (
+	// NoCompression stores values as they are.
+	NoCompression Compression = ""
+	// SnappyCompression compresses values with snappy, which is fast but compresses less.
+	SnappyCompression Compression = "snappy"
+	// ZstdCompression compresses values with zstd, which compresses more at a higher CPU cost.
+	ZstdCompression Compression = "zstd"
+)
+
+// The compression of a database is recorded in the metadata under compressionKey. Databases
+// without the entry store values uncompressed.
+const compressionKey = "compression"
+
+// compressor compresses the values stored on disk. It must be safe for concurrent use.
+type compressor interface {
+	compress(value []byte) []byte
+	decompress(buf []byte) ([]byte, error)
+}
+
+// newCompressor returns the compressor of the given compression, or nil without compression.
+func newCompressor(compression Compression) (compressor, error) {
+	switch compression {
+	case NoCompression:
+		return nil, nil
+	case SnappyCompression:
+		return snappyCompressor{}, nil
+	case ZstdCompression:
+		return newZstdCompressor()
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) compress(value []byte) []byte {
+	return snappy.Encode(nil, value)
+}
+
+func (snappyCompressor) decompress(buf []byte) ([]byte, error) {
+	return snappy.Decode(nil, buf)
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// The zstd encoder and decoder are shared by all trees, since they hold on to goroutines and
+// buffers.
+var (
+	zstdOnce   sync.Once
+	zstdShared *zstdCompressor
+	zstdErr    error
+)
+
+func newZstdCompressor() (compressor, error) {
+	zstdOnce.Do(func() {
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			zstdErr = err
+			return
+		}
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			zstdErr = err
+			return
+		}
+		zstdShared = &zstdCompressor{encoder: encoder, decoder: decoder}
+	})
+	if zstdErr != nil {
+		return nil, zstdErr
+	}
+	return zstdShared, nil
+}
+
+func (c *zstdCompressor) compress(value []byte) []byte {
+	return c.encoder.EncodeAll(value, nil)
+}
+
+func (c *zstdCompressor) decompress(buf []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(buf, nil)
+}
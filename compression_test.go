@@ -0,0 +1,130 @@
+package iavl
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	for _, compression := range []Compression{SnappyCompression, ZstdCompression} {
+		for _, versionKeyed := range []bool{false, true} {
+			plainDB := db.NewMemDB()
+			plainTree, err := NewMutableTreeWithOpts(plainDB, 0, &Options{VersionKeyedNodes: versionKeyed}, false)
+			require.NoError(t, err)
+			compressedDB := db.NewMemDB()
+			opts := &Options{VersionKeyedNodes: versionKeyed, Compression: compression}
+			compressedTree, err := NewMutableTreeWithOpts(compressedDB, 0, opts, false)
+			require.NoError(t, err)
+
+			r := rand.New(rand.NewSource(11))
+			for v := 0; v < 10; v++ {
+				hashes := applyRandomVersion(t, r, plainTree, compressedTree)
+				require.Equal(t, hashes[0], hashes[1])
+			}
+			value, err := compressedDB.Get(metadataKeyFormat.Key([]byte(compressionKey)))
+			require.NoError(t, err)
+			require.Equal(t, compression, Compression(value))
+
+			// The compression is kept when reopening the database without the option, and
+			// proofs are computed from the uncompressed values.
+			compressedTree, err = NewMutableTree(compressedDB, 0, false)
+			require.NoError(t, err)
+			_, err = compressedTree.Load()
+			require.NoError(t, err)
+			requireSameVersions(t, plainTree, compressedTree)
+			for _, key := range [][]byte{[]byte("1"), []byte("500"), []byte("999")} {
+				expected, err := plainTree.ImmutableTree.GetProof(key)
+				require.NoError(t, err)
+				actual, err := compressedTree.ImmutableTree.GetProof(key)
+				require.NoError(t, err)
+				require.Equal(t, expected, actual)
+			}
+
+			// Fast nodes are compressed as well.
+			var plainPairs, compressedPairs [][]byte
+			_, err = plainTree.Iterate(func(key, value []byte) bool {
+				plainPairs = append(plainPairs, key, value)
+				return false
+			})
+			require.NoError(t, err)
+			_, err = compressedTree.Iterate(func(key, value []byte) bool {
+				compressedPairs = append(compressedPairs, key, value)
+				return false
+			})
+			require.NoError(t, err)
+			require.Equal(t, plainPairs, compressedPairs)
+			fastValue, err := compressedTree.Get([]byte("999"))
+			require.NoError(t, err)
+			plainValue, err := plainTree.Get([]byte("999"))
+			require.NoError(t, err)
+			require.Equal(t, plainValue, fastValue)
+		}
+	}
+}
+
+func TestCompressionStoresSmallerValues(t *testing.T) {
+	value := bytes.Repeat([]byte("compressible "), 1000)
+	sizes := make(map[Compression]int)
+	for _, compression := range []Compression{NoCompression, SnappyCompression, ZstdCompression} {
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Compression: compression}, false)
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("key"), value)
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		itr, err := memDB.Iterator(nil, nil)
+		require.NoError(t, err)
+		for ; itr.Valid(); itr.Next() {
+			sizes[compression] += len(itr.Value())
+		}
+		require.NoError(t, itr.Close())
+
+		got, err := tree.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+	require.Less(t, sizes[SnappyCompression], sizes[NoCompression]/10)
+	require.Less(t, sizes[ZstdCompression], sizes[NoCompression]/10)
+}
+
+func TestCompressionMismatch(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Compression: SnappyCompression}, false)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = tree.Set([]byte(key), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Compression: ZstdCompression}, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.Error(t, err)
+
+	// Compression can't be enabled for an existing uncompressed database.
+	memDB = db.NewMemDB()
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = tree.Set([]byte(key), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Compression: SnappyCompression}, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.Error(t, err)
+
+	_, err = newCompressor("lz4")
+	require.Error(t, err)
+}
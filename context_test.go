@@ -0,0 +1,169 @@
+package iavl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// cancelLogger is a Logger cancelling a context once a message is logged at info level.
+type cancelLogger struct {
+	NopLogger
+	msg    string
+	cancel context.CancelFunc
+}
+
+func (l cancelLogger) Info(msg string, _ ...interface{}) {
+	if msg == l.msg {
+		l.cancel()
+	}
+}
+
+// saveContextTestVersions saves the given number of versions, each setting 10 keys, and returns
+// the contents of the latest version.
+func saveContextTestVersions(t *testing.T, tree *MutableTree, versions int) map[string]string {
+	expected := map[string]string{}
+	for v := 0; v < versions; v++ {
+		for i := 0; i < 10; i++ {
+			key, value := fmt.Sprintf("key-%04d", v*5+i), fmt.Sprintf("value-%d", v)
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+			expected[key] = value
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return expected
+}
+
+func TestLoadVersionContext_FastStorageUpgrade(t *testing.T) {
+	tmpCommitGap := commitGap
+	commitGap = 5
+	t.Cleanup(func() {
+		commitGap = tmpCommitGap
+	})
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	expected := saveContextTestVersions(t, tree, 3)
+
+	// The fast node index was never built, so loading the tree upgrades it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{
+		Logger: cancelLogger{msg: "upgrading fast storage", cancel: cancel},
+	}, false)
+	require.NoError(t, err)
+	_, err = tree.LoadVersionContext(ctx, 0)
+	require.ErrorIs(t, err, context.Canceled)
+	_, done, err := tree.ndb.getMigration(fastStorageMigrationID)
+	require.NoError(t, err)
+	require.False(t, done)
+	require.False(t, tree.ndb.hasUpgradedToFastStorage())
+
+	// The upgrade runs again on the next load.
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.LoadVersionContext(context.Background(), 0)
+	require.NoError(t, err)
+	upgradeable, err := tree.IsUpgradeable()
+	require.NoError(t, err)
+	require.False(t, upgradeable)
+	requireTreeContents(t, tree, expected)
+}
+
+func TestDeleteVersionsRangeContext(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	expected := saveContextTestVersions(t, tree, 6)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tree.ndb.opts.Logger = cancelLogger{msg: "deleting versions", cancel: cancel}
+	err = tree.DeleteVersionsRangeContext(ctx, 1, 5)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, []int{2, 3, 4, 5, 6}, tree.AvailableVersions())
+	assertNoStrayNodes(t, tree)
+
+	tree.ndb.opts.Logger = NopLogger{}
+	require.Error(t, tree.DeleteVersionsRangeContext(context.Background(), 2, 7))
+	require.Equal(t, []int{2, 3, 4, 5, 6}, tree.AvailableVersions())
+	require.NoError(t, tree.DeleteVersionsRangeContext(context.Background(), 1, 5))
+	require.Equal(t, []int{5, 6}, tree.AvailableVersions())
+	assertNoStrayNodes(t, tree)
+	requireTreeContents(t, tree, expected)
+}
+
+func TestExportImportContext(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	expected := saveContextTestVersions(t, tree, 3)
+	immutable, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter, err := immutable.ExportContext(ctx)
+	require.NoError(t, err)
+	_, err = exporter.Next()
+	require.NoError(t, err)
+	cancel()
+	for err == nil {
+		_, err = exporter.Next()
+	}
+	require.ErrorIs(t, err, context.Canceled)
+	exporter.Close()
+	_, err = exporter.Next()
+	require.ErrorIs(t, err, context.Canceled)
+
+	exporter, err = immutable.Export()
+	require.NoError(t, err)
+	var nodes []*ExportNode
+	for {
+		node, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+	exporter.Close()
+
+	// A cancelled import leaves the tree empty, and can be retried.
+	memDB := db.NewMemDB()
+	imported, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	importer, err := imported.ImportContext(ctx, tree.Version())
+	require.NoError(t, err)
+	require.NoError(t, importer.Add(nodes[0]))
+	cancel()
+	for _, node := range nodes[1:] {
+		require.NoError(t, importer.Add(node))
+	}
+	require.ErrorIs(t, importer.Commit(), context.Canceled)
+	importer.Close()
+	require.True(t, imported.IsEmpty())
+
+	imported, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	version, err := imported.Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+	importer, err = imported.ImportContext(context.Background(), tree.Version())
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	requireTreeContents(t, imported, expected)
+
+	hash, err := tree.Hash()
+	require.NoError(t, err)
+	importedHash, err := imported.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hash, importedHash)
+}
@@ -0,0 +1,204 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// SeekableIterator is a dbm.Iterator which can be moved to any key of its domain, and whose
+// position can be saved as a Cursor, to resume iterating later. Iterator, FastIterator and
+// UnsavedFastIterator implement it.
+type SeekableIterator interface {
+	dbm.Iterator
+
+	// Seek moves the iterator to the first key of its domain at or after the given key, in the
+	// order of the iteration.
+	Seek(key []byte)
+
+	// Cursor returns the position of the iterator, which is at the end of the iteration if the
+	// iterator is not valid.
+	Cursor() *Cursor
+}
+
+var (
+	_ SeekableIterator = (*Iterator)(nil)
+	_ SeekableIterator = (*FastIterator)(nil)
+	_ SeekableIterator = (*UnsavedFastIterator)(nil)
+)
+
+// ErrCursorVersion is returned when resuming an iteration over a different version of a tree
+// than the one the cursor was taken at.
+var ErrCursorVersion = errors.New("cursor is at a different version")
+
+// Cursor is the position of an iterator over a version of a tree: its domain, its order, and
+// the next key it returns. It can be serialized with MarshalBinary, e.g. as a pagination token,
+// and iteration resumes from it with ResumeIterator on the tree at the same version.
+//
+// The version of an iterator over the working tree of a MutableTree is the version the working
+// tree is saved as.
+type Cursor struct {
+	version    int64
+	start, end []byte
+	ascending  bool
+	key        []byte // Next key, or nil at the end of the iteration.
+}
+
+// Cursor encodings start with a byte of flags.
+const (
+	cursorAscending byte = 1 << iota
+	cursorHasStart
+	cursorHasEnd
+	cursorHasKey
+)
+
+// newCursor returns the cursor of an iterator at the given key, or at the end of the iteration if
+// it is not valid.
+func newCursor(version int64, start, end []byte, ascending, valid bool, key []byte) *Cursor {
+	c := &Cursor{
+		version:   version,
+		start:     start,
+		end:       end,
+		ascending: ascending,
+	}
+	if valid {
+		c.key = append([]byte{}, key...)
+	}
+	return c
+}
+
+// Version returns the version of the tree the cursor was taken at.
+func (c *Cursor) Version() int64 {
+	return c.version
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (c *Cursor) MarshalBinary() ([]byte, error) {
+	var flags byte
+	if c.ascending {
+		flags |= cursorAscending
+	}
+	fields := [][]byte{}
+	for _, field := range []struct {
+		flag  byte
+		value []byte
+	}{{cursorHasStart, c.start}, {cursorHasEnd, c.end}, {cursorHasKey, c.key}} {
+		if field.value != nil {
+			flags |= field.flag
+			fields = append(fields, field.value)
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{flags})
+	if err := encoding.EncodeVarint(buf, c.version); err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if err := encoding.EncodeBytes(buf, field); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (c *Cursor) UnmarshalBinary(bz []byte) error {
+	if len(bz) == 0 {
+		return errors.New("empty cursor")
+	}
+	flags := bz[0]
+	if flags&^(cursorAscending|cursorHasStart|cursorHasEnd|cursorHasKey) != 0 {
+		return fmt.Errorf("invalid cursor flags %x", flags)
+	}
+	bz = bz[1:]
+
+	version, n, err := encoding.DecodeVarint(bz)
+	if err != nil {
+		return fmt.Errorf("decoding cursor version: %w", err)
+	}
+	bz = bz[n:]
+
+	*c = Cursor{version: version, ascending: flags&cursorAscending != 0}
+	for _, field := range []struct {
+		flag  byte
+		value *[]byte
+	}{{cursorHasStart, &c.start}, {cursorHasEnd, &c.end}, {cursorHasKey, &c.key}} {
+		if flags&field.flag == 0 {
+			continue
+		}
+		value, n, err := encoding.DecodeBytes(bz)
+		if err != nil {
+			return fmt.Errorf("decoding cursor: %w", err)
+		}
+		*field.value = append([]byte{}, value...)
+		bz = bz[n:]
+	}
+	if len(bz) > 0 {
+		return fmt.Errorf("cursor has %d trailing bytes", len(bz))
+	}
+	return nil
+}
+
+// ResumeIterator returns an iterator continuing the iteration at the given cursor, which must be
+// at the version of the tree. If the cursor is at the end of the iteration, the iterator is not
+// valid.
+func (t *ImmutableTree) ResumeIterator(cursor *Cursor) (SeekableIterator, error) {
+	if cursor.version != t.version {
+		return nil, fmt.Errorf("%w: cursor at version %d, tree at version %d", ErrCursorVersion, cursor.version, t.version)
+	}
+	return resumeIterator(cursor, t.Iterator)
+}
+
+// ResumeIterator returns an iterator over the working tree continuing the iteration at the given
+// cursor, which must be at the version the working tree is saved as.
+// CONTRACT: no updates are made to the tree while an iterator is active.
+func (tree *MutableTree) ResumeIterator(cursor *Cursor) (SeekableIterator, error) {
+	if version := tree.version + 1; cursor.version != version {
+		return nil, fmt.Errorf("%w: cursor at version %d, working tree at version %d", ErrCursorVersion, cursor.version, version)
+	}
+	return resumeIterator(cursor, tree.Iterator)
+}
+
+// resumeIterator returns an iterator at the given cursor, using the given function to create
+// the iterator over its domain.
+func resumeIterator(cursor *Cursor, iterator func(start, end []byte, ascending bool) (dbm.Iterator, error)) (SeekableIterator, error) {
+	itr, err := iterator(cursor.start, cursor.end, cursor.ascending)
+	if err != nil {
+		return nil, err
+	}
+	seekable, ok := itr.(SeekableIterator)
+	if !ok {
+		itr.Close() //nolint:errcheck
+		return nil, fmt.Errorf("iterator %T is not seekable", itr)
+	}
+	if cursor.key == nil {
+		// The iteration has ended.
+		if err := seekable.Close(); err != nil {
+			return nil, err
+		}
+		return seekable, nil
+	}
+	seekable.Seek(cursor.key)
+	return seekable, nil
+}
+
+// seekDomain returns the domain of an iterator over the given domain after seeking the given key.
+func seekDomain(start, end []byte, ascending bool, key []byte) ([]byte, []byte) {
+	if ascending {
+		if start == nil || bytes.Compare(key, start) > 0 {
+			start = key
+		}
+		return start, end
+	}
+	// The end of the domain is exclusive, and the smallest key above the key is the key with a
+	// zero byte appended.
+	above := append(append([]byte{}, key...), 0)
+	if end == nil || bytes.Compare(above, end) < 0 {
+		end = above
+	}
+	return start, end
+}
@@ -0,0 +1,196 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DeleteRange removes all keys in the range [start, end) from the working tree, where a nil
+// start or end leaves the range open on that side, and returns the number of removed keys.
+//
+// Rather than removing the keys one by one, it drops the subtrees within the range as a whole,
+// and joins the remaining subtrees along the two boundaries of the range, which updates
+// O(log² n) nodes. Only the fast nodes of the removed keys are visited, to remove them too.
+func (tree *MutableTree) DeleteRange(start, end []byte) (int64, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, fmt.Errorf("invalid range [%X, %X)", start, end)
+	}
+	if tree.root == nil {
+		return 0, nil
+	}
+
+	if !tree.skipFastStorageUpgrade {
+		// The keys are collected first, since the iterator reads the unsaved fast nodes.
+		var keys [][]byte
+		itr, err := tree.Iterator(start, end, true)
+		if err != nil {
+			return 0, err
+		}
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, append([]byte{}, itr.Key()...))
+		}
+		if err := itr.Close(); err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			tree.addUnsavedRemoval(key)
+		}
+	}
+
+	size := tree.root.size
+	orphans := tree.prepareOrphansSlice()
+	newRoot, err := tree.deleteRange(tree.root, nil, nil, start, end, &orphans)
+	if err != nil {
+		return 0, err
+	}
+	tree.root = newRoot
+	if newRoot == nil {
+		return size, nil
+	}
+	return size - newRoot.size, nil
+}
+
+// DeletePrefix removes all keys with the given prefix from the working tree, and returns the
+// number of removed keys. See DeleteRange.
+func (tree *MutableTree) DeletePrefix(prefix []byte) (int64, error) {
+	if len(prefix) == 0 {
+		return tree.DeleteRange(nil, nil)
+	}
+	return tree.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// deleteRange removes the keys in [start, end) from the subtree of the given node, whose keys are
+// within [lo, hi), and returns the new subtree, which is nil if it is empty.
+func (tree *MutableTree) deleteRange(node *Node, lo, hi, start, end []byte, orphans *[]*Node) (*Node, error) {
+	// The subtree is either outside of the range, or within it.
+	if (end != nil && lo != nil && bytes.Compare(lo, end) >= 0) ||
+		(start != nil && hi != nil && bytes.Compare(hi, start) <= 0) {
+		return node, nil
+	}
+	if (start == nil || (lo != nil && bytes.Compare(start, lo) <= 0)) &&
+		(end == nil || (hi != nil && bytes.Compare(hi, end) <= 0)) {
+		*orphans = append(*orphans, node)
+		return nil, nil
+	}
+
+	if node.isLeaf() {
+		if (start == nil || bytes.Compare(node.key, start) >= 0) && (end == nil || bytes.Compare(node.key, end) < 0) {
+			*orphans = append(*orphans, node)
+			return nil, nil
+		}
+		return node, nil
+	}
+
+	leftNode, err := node.getLeftNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, err
+	}
+	rightNode, err := node.getRightNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, err
+	}
+	newLeftNode, err := tree.deleteRange(leftNode, lo, node.key, start, end, orphans)
+	if err != nil {
+		return nil, err
+	}
+	newRightNode, err := tree.deleteRange(rightNode, node.key, hi, start, end, orphans)
+	if err != nil {
+		return nil, err
+	}
+	if newLeftNode == leftNode && newRightNode == rightNode {
+		return node, nil
+	}
+
+	*orphans = append(*orphans, node)
+	return tree.join(newLeftNode, newRightNode, orphans)
+}
+
+// join returns a balanced tree of the nodes of the given subtrees, where all keys of the left
+// subtree are below the keys of the right one. Either subtree may be nil.
+//
+// The lower subtree is attached along the nearest edge of the higher one, at the level of its
+// height, and the nodes on the way are rebalanced. This updates as many nodes as the difference
+// of the heights.
+func (tree *MutableTree) join(left, right *Node, orphans *[]*Node) (*Node, error) {
+	if left == nil {
+		return right, nil
+	}
+	if right == nil {
+		return left, nil
+	}
+	version := tree.version + 1
+
+	switch {
+	case left.subtreeHeight > right.subtreeHeight+1:
+		*orphans = append(*orphans, left)
+		node, err := left.clone(version)
+		if err != nil {
+			return nil, err
+		}
+		rightNode, err := node.getRightNode(tree.ImmutableTree)
+		if err != nil {
+			return nil, err
+		}
+		joined, err := tree.join(rightNode, right, orphans)
+		if err != nil {
+			return nil, err
+		}
+		node.rightHash, node.rightNodeKey, node.rightNode = joined.hash, joined.nodeKey, joined
+		if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+			return nil, err
+		}
+		return tree.balance(node, orphans)
+
+	case right.subtreeHeight > left.subtreeHeight+1:
+		*orphans = append(*orphans, right)
+		node, err := right.clone(version)
+		if err != nil {
+			return nil, err
+		}
+		leftNode, err := node.getLeftNode(tree.ImmutableTree)
+		if err != nil {
+			return nil, err
+		}
+		joined, err := tree.join(left, leftNode, orphans)
+		if err != nil {
+			return nil, err
+		}
+		node.leftHash, node.leftNodeKey, node.leftNode = joined.hash, joined.nodeKey, joined
+		if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+			return nil, err
+		}
+		return tree.balance(node, orphans)
+
+	default:
+		// The key of an inner node is the smallest key of its right subtree.
+		key, err := tree.smallestKey(right)
+		if err != nil {
+			return nil, err
+		}
+		node := &Node{
+			key:          key,
+			version:      version,
+			leftHash:     left.hash,
+			leftNodeKey:  left.nodeKey,
+			leftNode:     left,
+			rightHash:    right.hash,
+			rightNodeKey: right.nodeKey,
+			rightNode:    right,
+		}
+		if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+}
+
+// smallestKey returns the smallest key of the subtree of the given node.
+func (tree *MutableTree) smallestKey(node *Node) ([]byte, error) {
+	for !node.isLeaf() {
+		var err error
+		if node, err = node.getLeftNode(tree.ImmutableTree); err != nil {
+			return nil, err
+		}
+	}
+	return node.key, nil
+}
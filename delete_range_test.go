@@ -0,0 +1,122 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// assertBalanced checks the heights, sizes, balance and keys of the inner nodes of the subtree
+// of the given node, and returns its smallest key.
+func assertBalanced(t *testing.T, tree *ImmutableTree, node *Node) []byte {
+	t.Helper()
+	if node.isLeaf() {
+		require.EqualValues(t, 0, node.subtreeHeight)
+		require.EqualValues(t, 1, node.size)
+		return node.key
+	}
+	left, err := node.getLeftNode(tree)
+	require.NoError(t, err)
+	right, err := node.getRightNode(tree)
+	require.NoError(t, err)
+	smallest := assertBalanced(t, tree, left)
+	require.Equal(t, assertBalanced(t, tree, right), node.key, "key of inner node is not the smallest key of its right subtree")
+	require.Equal(t, maxInt8(left.subtreeHeight, right.subtreeHeight)+1, node.subtreeHeight)
+	require.Equal(t, left.size+right.size, node.size)
+	require.LessOrEqual(t, left.subtreeHeight-right.subtreeHeight, int8(1))
+	require.LessOrEqual(t, right.subtreeHeight-left.subtreeHeight, int8(1))
+	return smallest
+}
+
+func TestMutableTree_DeleteRange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	randomKey := func() []byte {
+		return []byte(fmt.Sprintf("%02x", r.Intn(256))[:1+r.Intn(2)])
+	}
+	mirror := map[string]string{}
+	for version := int64(1); version <= 30; version++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("%02x%d", r.Intn(256), r.Intn(10))
+			value := fmt.Sprintf("value-%d", r.Int())
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+			mirror[key] = value
+		}
+
+		var start, end []byte
+		var removed int64
+		if r.Intn(3) == 0 {
+			start = randomKey()
+			end = prefixEnd(start)
+			removed, err = tree.DeletePrefix(start)
+		} else {
+			if r.Intn(5) > 0 {
+				start = randomKey()
+			}
+			if r.Intn(5) > 0 {
+				end = randomKey()
+			}
+			if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+				start, end = end, start
+			}
+			if bytes.Equal(start, end) {
+				end = nil
+			}
+			removed, err = tree.DeleteRange(start, end)
+		}
+		require.NoError(t, err)
+
+		var expected int64
+		for key := range mirror {
+			if (start == nil || key >= string(start)) && (end == nil || key < string(end)) {
+				delete(mirror, key)
+				expected++
+			}
+		}
+		require.Equal(t, expected, removed, "range [%s, %s)", start, end)
+		if tree.root != nil {
+			assertBalanced(t, tree.ImmutableTree, tree.root)
+		}
+		requireTreeContents(t, tree, mirror)
+
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		assertMirror(t, tree, mirror, version)
+		if version > 5 {
+			require.NoError(t, tree.DeleteVersionsRange(version-5, version-4))
+		}
+	}
+	assertNoStrayNodes(t, tree)
+}
+
+func TestMutableTree_DeleteRange_All(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set(i2b(i), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.DeleteRange(i2b(10), i2b(5))
+	require.Error(t, err)
+	removed, err := tree.DeletePrefix(nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, removed)
+	require.Nil(t, tree.root)
+	removed, err = tree.DeleteRange(nil, nil)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	assertMirror(t, tree, map[string]string{}, 2)
+}
@@ -34,10 +34,13 @@ type Exporter struct {
 	tree   *ImmutableTree
 	ch     chan *ExportNode
 	cancel context.CancelFunc
+	span   Span
+	err    error // The error of the context the export stopped with, set before ch is closed.
 }
 
-// NewExporter creates a new Exporter. Callers must call Close() when done.
-func newExporter(tree *ImmutableTree) (*Exporter, error) {
+// NewExporter creates a new Exporter, which stops once the given context is done. Callers must
+// call Close() when done.
+func newExporter(ctx context.Context, tree *ImmutableTree) (*Exporter, error) {
 	if tree == nil {
 		return nil, fmt.Errorf("tree is nil: %w", ErrNotInitalizedTree)
 	}
@@ -46,21 +49,25 @@ func newExporter(tree *ImmutableTree) (*Exporter, error) {
 		return nil, fmt.Errorf("tree.ndb is nil: %w", ErrNotInitalizedTree)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// The span records the nodes loaded by the export, and ends when the exporter is closed.
+	tree, span := tree.traced(SpanExport, "version", tree.version)
+	exportCtx, cancel := context.WithCancel(ctx)
 	exporter := &Exporter{
 		tree:   tree,
 		ch:     make(chan *ExportNode, exportBufferSize),
 		cancel: cancel,
+		span:   span,
 	}
 
 	tree.ndb.incrVersionReaders(tree.version)
-	go exporter.export(ctx)
+	go exporter.export(ctx, exportCtx)
 
 	return exporter, nil
 }
 
-// export exports nodes
-func (e *Exporter) export(ctx context.Context) {
+// export exports nodes until exportCtx is done, either because the caller's ctx is done, or
+// because the exporter was closed.
+func (e *Exporter) export(ctx, exportCtx context.Context) {
 	e.tree.root.traversePost(e.tree, true, func(node *Node) bool {
 		exportNode := &ExportNode{
 			Key:     node.key,
@@ -72,18 +79,23 @@ func (e *Exporter) export(ctx context.Context) {
 		select {
 		case e.ch <- exportNode:
 			return false
-		case <-ctx.Done():
+		case <-exportCtx.Done():
+			e.err = ctx.Err()
 			return true
 		}
 	})
 	close(e.ch)
 }
 
-// Next fetches the next exported node, or returns ExportDone when done.
+// Next fetches the next exported node, or returns ExportDone when done. If the context of the
+// exporter is done before all nodes are exported, it returns the error of the context instead.
 func (e *Exporter) Next() (*ExportNode, error) {
 	if exportNode, ok := <-e.ch; ok {
 		return exportNode, nil
 	}
+	if e.err != nil {
+		return nil, e.err
+	}
 	return nil, ErrorExportDone
 }
 
@@ -94,6 +106,7 @@ func (e *Exporter) Close() {
 	}
 	if e.tree != nil {
 		e.tree.ndb.decrVersionReaders(e.tree.version)
+		e.span.End(e.err)
 	}
 	e.tree = nil
 }
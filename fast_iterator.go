@@ -24,6 +24,8 @@ type FastIterator struct {
 
 	ndb *nodeDB
 
+	version int64
+
 	nextFastNode *fastnode.Node
 
 	fastIterator dbm.Iterator
@@ -41,6 +43,10 @@ func NewFastIterator(start, end []byte, ascending bool, ndb *nodeDB) *FastIterat
 		nextFastNode: nil,
 		fastIterator: nil,
 	}
+	if ndb != nil {
+		// The fast nodes are those of the version the fast node index was last updated at.
+		iter.version = ndb.fastStorageVersion
+	}
 	// Move iterator before the first element
 	iter.Next()
 	return iter
@@ -93,6 +99,19 @@ func (iter *FastIterator) Value() []byte {
 	return nil
 }
 
+// KeyVersion implements MetadataIterator.
+func (iter *FastIterator) KeyVersion() int64 {
+	if iter.valid {
+		return iter.nextFastNode.GetVersionLastUpdatedAt()
+	}
+	return 0
+}
+
+// KeyIndex implements MetadataIterator. Fast nodes do not tell the index of their keys.
+func (iter *FastIterator) KeyIndex() (int64, bool) {
+	return 0, false
+}
+
 // Next implements dbm.Iterator
 func (iter *FastIterator) Next() {
 	if iter.ndb == nil {
@@ -102,19 +121,56 @@ func (iter *FastIterator) Next() {
 	}
 
 	if iter.fastIterator == nil {
-		iter.fastIterator, iter.err = iter.ndb.getFastIterator(iter.start, iter.end, iter.ascending)
-		iter.valid = true
-	} else {
-		iter.fastIterator.Next()
+		iter.open(iter.start, iter.end)
+		return
 	}
+	iter.fastIterator.Next()
+	iter.read()
+}
+
+// Seek implements SeekableIterator.
+func (iter *FastIterator) Seek(key []byte) {
+	if iter.ndb == nil {
+		return
+	}
+	if iter.fastIterator != nil {
+		if err := iter.fastIterator.Close(); err != nil {
+			iter.err = err
+			iter.valid = false
+			return
+		}
+	}
+	iter.open(seekDomain(iter.start, iter.end, iter.ascending, key))
+}
+
+// Cursor implements SeekableIterator.
+func (iter *FastIterator) Cursor() *Cursor {
+	return newCursor(iter.version, iter.start, iter.end, iter.ascending, iter.Valid(), iter.Key())
+}
+
+// open opens the underlying nodedb iterator over the given domain, and reads its first fast node.
+func (iter *FastIterator) open(start, end []byte) {
+	iter.fastIterator, iter.err = iter.ndb.getFastIterator(start, end, iter.ascending)
+	if iter.err != nil {
+		iter.fastIterator = nil
+		iter.valid = false
+		return
+	}
+	iter.valid = true
+	iter.read()
+}
 
+// read reads the fast node at the position of the underlying nodedb iterator.
+func (iter *FastIterator) read() {
 	if iter.err == nil {
 		iter.err = iter.fastIterator.Error()
 	}
 
 	iter.valid = iter.valid && iter.fastIterator.Valid()
 	if iter.valid {
-		iter.nextFastNode, iter.err = fastnode.DeserializeNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
+		value := iter.fastIterator.Value()
+		iter.ndb.opts.Metrics.AddBytesRead(len(value))
+		iter.nextFastNode, iter.err = iter.ndb.decodeFastNode(iter.fastIterator.Key()[1:], value)
 		iter.valid = iter.err == nil
 	}
 }
@@ -0,0 +1,101 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	ics23 "github.com/confio/ics23/go"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Hasher is the hash function of the nodes of a tree. All hashers produce hashes of hashSize
+// bytes.
+type Hasher string
+
+const (
+	// SHA256Hasher hashes nodes with SHA-256. It is the default.
+	SHA256Hasher Hasher = "sha256"
+	// SHA512_256Hasher hashes nodes with SHA-512/256, which is faster than SHA-256 on 64-bit
+	// platforms without SHA extensions.
+	SHA512_256Hasher Hasher = "sha512-256" //nolint:revive,stylecheck
+	// Blake2bHasher hashes nodes with BLAKE2b-256. ICS23 has no hash operation for it, so
+	// trees using it can't produce ICS23 proofs.
+	Blake2bHasher Hasher = "blake2b-256"
+)
+
+// The hasher of a database is recorded in the metadata under hasherKey. Databases without the
+// entry use SHA256Hasher.
+const hasherKey = "hasher"
+
+// newHash returns a new hash.Hash computing the hash function.
+func (h Hasher) newHash() (hash.Hash, error) {
+	switch h {
+	case SHA256Hasher:
+		return sha256.New(), nil
+	case SHA512_256Hasher:
+		return sha512.New512_256(), nil
+	case Blake2bHasher:
+		return blake2b.New256(nil)
+	default:
+		return nil, fmt.Errorf("unknown hasher %q", h)
+	}
+}
+
+// sum returns the hash of the given bytes. It uses the one-shot function of the hash function,
+// which does not allocate a hash.Hash.
+func (h Hasher) sum(bz []byte) ([]byte, error) {
+	var sum [hashSize]byte
+	switch h {
+	case SHA256Hasher:
+		sum = sha256.Sum256(bz)
+	case SHA512_256Hasher:
+		sum = sha512.Sum512_256(bz)
+	case Blake2bHasher:
+		sum = blake2b.Sum256(bz)
+	default:
+		return nil, fmt.Errorf("unknown hasher %q", h)
+	}
+	return sum[:], nil
+}
+
+// hashOp returns the ICS23 hash operation of the hash function.
+func (h Hasher) hashOp() (ics23.HashOp, error) {
+	switch h {
+	case SHA256Hasher:
+		return ics23.HashOp_SHA256, nil
+	case SHA512_256Hasher:
+		return ics23.HashOp_SHA512_256, nil
+	case Blake2bHasher:
+		return ics23.HashOp_NO_HASH, fmt.Errorf("hasher %s has no ICS23 hash operation", h)
+	default:
+		return ics23.HashOp_NO_HASH, fmt.Errorf("unknown hasher %q", h)
+	}
+}
+
+// ProofSpec returns the ICS23 proof spec of trees hashed by the hash function. For
+// SHA256Hasher, it is equal to ics23.IavlSpec.
+func (h Hasher) ProofSpec() (*ics23.ProofSpec, error) {
+	op, err := h.hashOp()
+	if err != nil {
+		return nil, err
+	}
+	return &ics23.ProofSpec{
+		LeafSpec: &ics23.LeafOp{
+			Prefix:       []byte{0},
+			PrehashKey:   ics23.HashOp_NO_HASH,
+			Hash:         op,
+			PrehashValue: op,
+			Length:       ics23.LengthOp_VAR_PROTO,
+		},
+		InnerSpec: &ics23.InnerSpec{
+			ChildOrder:      []int32{0, 1},
+			MinPrefixLength: 4,
+			MaxPrefixLength: 12,
+			ChildSize:       hashSize + 1, // (with length byte)
+			EmptyChild:      nil,
+			Hash:            op,
+		},
+	}, nil
+}
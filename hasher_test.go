@@ -0,0 +1,129 @@
+package iavl
+
+import (
+	"bytes"
+	"testing"
+
+	ics23 "github.com/confio/ics23/go"
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashers(t *testing.T) {
+	hashes := make(map[Hasher][]byte)
+	for _, hasher := range []Hasher{SHA256Hasher, SHA512_256Hasher, Blake2bHasher} {
+		// The one-shot sum matches the hash function.
+		h, err := hasher.newHash()
+		require.NoError(t, err)
+		h.Write([]byte("value"))
+		sum, err := hasher.sum([]byte("value"))
+		require.NoError(t, err)
+		require.Equal(t, h.Sum(nil), sum)
+
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Hasher: hasher}, false)
+		require.NoError(t, err)
+		for i := byte(0); i < 50; i++ {
+			_, err = tree.Set([]byte{i}, []byte{i, i})
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Len(t, hash, hashSize)
+		hashes[hasher] = hash
+
+		// The hasher is kept when reopening the database without the option.
+		tree, err = NewMutableTree(memDB, 0, false)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		reloaded, err := tree.Hash()
+		require.NoError(t, err)
+		require.Equal(t, hash, reloaded)
+
+		// A different hasher can't be used for an existing database.
+		other := SHA256Hasher
+		if hasher == SHA256Hasher {
+			other = Blake2bHasher
+		}
+		mismatch, err := NewMutableTreeWithOpts(memDB, 0, &Options{Hasher: other}, false)
+		require.NoError(t, err)
+		_, err = mismatch.Load()
+		require.Error(t, err)
+
+		// Proofs are generated and verified with the hasher.
+		if hasher == Blake2bHasher {
+			_, err = tree.GetProof([]byte{1})
+			require.Error(t, err)
+			_, err = hasher.ProofSpec()
+			require.Error(t, err)
+			continue
+		}
+		spec, err := hasher.ProofSpec()
+		require.NoError(t, err)
+		proof, err := tree.GetProof([]byte{1})
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyMembership(spec, hash, proof, []byte{1}, []byte{1, 1}))
+		valid, err := tree.VerifyProof(proof, []byte{1})
+		require.NoError(t, err)
+		require.True(t, valid)
+		proof, err = tree.GetProof([]byte{100})
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyNonMembership(spec, hash, proof, []byte{100}))
+	}
+
+	require.NotEqual(t, hashes[SHA256Hasher], hashes[SHA512_256Hasher])
+	require.NotEqual(t, hashes[SHA256Hasher], hashes[Blake2bHasher])
+	require.NotEqual(t, hashes[SHA512_256Hasher], hashes[Blake2bHasher])
+
+	spec, err := SHA256Hasher.ProofSpec()
+	require.NoError(t, err)
+	require.Equal(t, ics23.IavlSpec, spec)
+}
+
+func TestHasherProofNodes(t *testing.T) {
+	for _, hasher := range []Hasher{SHA256Hasher, SHA512_256Hasher, Blake2bHasher} {
+		tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Hasher: hasher}, false)
+		require.NoError(t, err)
+		for i := byte(0); i < 20; i++ {
+			_, err = tree.Set([]byte{i}, []byte{i})
+			require.NoError(t, err)
+		}
+		root, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		path, leaf, err := tree.root.PathToLeaf(tree.ImmutableTree, []byte{7})
+		require.NoError(t, err)
+		valueHash, err := hasher.sum(leaf.value)
+		require.NoError(t, err)
+		hash, err := ProofLeafNode{Key: leaf.key, ValueHash: valueHash, Version: leaf.version}.HashWith(hasher)
+		require.NoError(t, err)
+		for i := len(path) - 1; i >= 0; i-- {
+			hash, err = path[i].HashWith(hasher, hash)
+			require.NoError(t, err)
+		}
+		require.True(t, bytes.Equal(root, hash))
+	}
+}
+
+func TestHasherOfExistingDatabase(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Hasher: SHA512_256Hasher}, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.Error(t, err)
+
+	tree, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Hasher: "md5"}, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+}
@@ -1,6 +1,9 @@
 package iavl
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"strings"
 
@@ -18,6 +21,7 @@ type ImmutableTree struct {
 	ndb                    *nodeDB
 	version                int64
 	skipFastStorageUpgrade bool
+	span                   Span // Span recording the node loads of a traced operation, see traced.
 }
 
 // NewImmutableTree creates both in-memory and persistent instances
@@ -149,14 +153,32 @@ func (t *ImmutableTree) Has(key []byte) (bool, error) {
 
 // Hash returns the root hash.
 func (t *ImmutableTree) Hash() ([]byte, error) {
-	hash, _, err := t.root.hashWithCount()
+	hasher, err := t.hasher()
+	if err != nil {
+		return nil, err
+	}
+	hash, _, err := t.root.hashWithCount(hasher)
 	return hash, err
 }
 
+// hasher returns the hash function of the tree.
+func (t *ImmutableTree) hasher() (Hasher, error) {
+	if t.ndb == nil {
+		return SHA256Hasher, nil
+	}
+	return t.ndb.nodeHasher()
+}
+
 // Export returns an iterator that exports tree nodes as ExportNodes. These nodes can be
 // imported with MutableTree.Import() to recreate an identical tree.
 func (t *ImmutableTree) Export() (*Exporter, error) {
-	return newExporter(t)
+	return t.ExportContext(context.Background())
+}
+
+// ExportContext is like Export, but the exporter stops once the given context is done, in which
+// case Exporter.Next returns the error of the context.
+func (t *ImmutableTree) ExportContext(ctx context.Context) (*Exporter, error) {
+	return newExporter(ctx, t)
 }
 
 // GetWithIndex returns the index and value of the specified key if it exists, or nil and the next index
@@ -176,7 +198,14 @@ func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
 // The returned value must not be modified, since it may point to data stored within IAVL.
 // Get potentially employs a more performant strategy than GetWithIndex for retrieving the value.
 // If tree.skipFastStorageUpgrade is true, this will work almost the same as GetWithIndex.
-func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
+func (t *ImmutableTree) Get(key []byte) (value []byte, err error) {
+	t, span := t.traced(SpanGet, "key", key)
+	defer func() { span.End(err) }()
+	return t.get(key)
+}
+
+// get implements Get, within the span of the tree, if any.
+func (t *ImmutableTree) get(key []byte) ([]byte, error) {
 	if t.root == nil {
 		return nil, nil
 	}
@@ -184,8 +213,9 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 	if !t.skipFastStorageUpgrade {
 		// attempt to get a FastNode directly from db/cache.
 		// if call fails, fall back to the original IAVL logic in place.
-		fastNode, err := t.ndb.GetFastNode(key)
+		fastNode, err := t.ndb.getFastNode(key, t.span)
 		if err != nil {
+			t.ndb.opts.Metrics.IncFastStorageGets(false)
 			_, result, err := t.root.get(t, key)
 			return result, err
 		}
@@ -195,16 +225,20 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 			// then the regular node is not in the tree either because fast node
 			// represents live state.
 			if t.version == t.ndb.latestVersion {
+				t.ndb.opts.Metrics.IncFastStorageGets(true)
 				return nil, nil
 			}
 
+			t.ndb.opts.Metrics.IncFastStorageGets(false)
 			_, result, err := t.root.get(t, key)
 			return result, err
 		}
 
 		if fastNode.GetVersionLastUpdatedAt() <= t.version {
+			t.ndb.opts.Metrics.IncFastStorageGets(true)
 			return fastNode.GetValue(), nil
 		}
+		t.ndb.opts.Metrics.IncFastStorageGets(false)
 	}
 
 	// otherwise skipFastStorageUpgrade is true or
@@ -223,6 +257,72 @@ func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err e
 	return t.root.getByIndex(t, index)
 }
 
+// Rank returns the number of keys below the given key, which is the index of the key if it is
+// in the tree.
+func (t *ImmutableTree) Rank(key []byte) (int64, error) {
+	index, _, err := t.GetWithIndex(key)
+	return index, err
+}
+
+// Count returns the number of keys in the range [start, end), where a nil start or end leaves
+// the range open on that side. It takes O(log n) steps, using the sizes of the subtrees.
+func (t *ImmutableTree) Count(start, end []byte) (int64, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, nil
+	}
+	from, to := int64(0), t.Size()
+	var err error
+	if start != nil {
+		if from, err = t.Rank(start); err != nil {
+			return 0, err
+		}
+	}
+	if end != nil {
+		if to, err = t.Rank(end); err != nil {
+			return 0, err
+		}
+	}
+	return to - from, nil
+}
+
+// IteratorAt returns an iterator starting at the key with the given index, over the keys above
+// it if ascending, or below it otherwise. Ascending from an index past the last key yields no
+// keys, while descending from it starts at the last key.
+func (t *ImmutableTree) IteratorAt(index int64, ascending bool) (dbm.Iterator, error) {
+	return t.iteratorAt(index, ascending, t.Iterator)
+}
+
+// iteratorAt returns the iterator of IteratorAt, using the given function to create iterators
+// over ranges of keys.
+func (t *ImmutableTree) iteratorAt(index int64, ascending bool, iterator func(start, end []byte, ascending bool) (dbm.Iterator, error)) (dbm.Iterator, error) {
+	if index < 0 {
+		return nil, fmt.Errorf("negative index %d", index)
+	}
+	size := t.Size()
+	if size == 0 || (!ascending && index >= size) {
+		return iterator(nil, nil, ascending)
+	}
+
+	pastEnd := index >= size
+	if pastEnd {
+		index = size - 1
+	}
+	key, _, err := t.GetByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	// The smallest key above the key, as the end of a range is exclusive.
+	above := append(append([]byte{}, key...), 0)
+	switch {
+	case pastEnd:
+		return iterator(above, nil, true)
+	case ascending:
+		return iterator(key, nil, true)
+	default:
+		return iterator(nil, above, false)
+	}
+}
+
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callback, false otherwise
 func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, error) {
@@ -244,7 +344,8 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, e
 	return false, nil
 }
 
-// Iterator returns an iterator over the immutable tree.
+// Iterator returns an iterator over the immutable tree, which implements SeekableIterator and
+// MetadataIterator.
 func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterator, error) {
 	if !t.skipFastStorageUpgrade {
 		isFastCacheEnabled, err := t.IsFastCacheEnabled()
@@ -253,9 +354,15 @@ func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterato
 		}
 
 		if isFastCacheEnabled {
-			return NewFastIterator(start, end, ascending, t.ndb), nil
+			itr := NewFastIterator(start, end, ascending, t.ndb)
+			itr.version = t.version
+			t.ndb.opts.Metrics.IncIterators(IteratorKindFast)
+			return itr, nil
 		}
 	}
+	if t.ndb != nil {
+		t.ndb.opts.Metrics.IncIterators(IteratorKindTree)
+	}
 	return NewIterator(start, end, ascending, t), nil
 }
 
@@ -289,6 +396,54 @@ func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool,
 	})
 }
 
+// IterateModifiedSince makes a callback in ascending order for all keys set after the given
+// version, with the version they were last set at. Removed keys are not reported. The keys and
+// values must not be modified, since they may point to data stored within IAVL.
+//
+// Since the version of a node is never below the versions of its children, the subtrees of nodes
+// at or below the given version are skipped. In the version-keyed layout, the node keys tell the
+// versions the nodes were saved at, so that such subtrees are not even loaded.
+func (t *ImmutableTree) IterateModifiedSince(version int64, fn func(key, value []byte, version int64) bool) (stopped bool, err error) {
+	if t.root == nil {
+		return false, nil
+	}
+	return t.iterateModifiedSince(t.root, version, fn)
+}
+
+func (t *ImmutableTree) iterateModifiedSince(node *Node, version int64, fn func(key, value []byte, version int64) bool) (bool, error) {
+	if node.version <= version {
+		return false, nil
+	}
+	if node.isLeaf() {
+		return fn(node.key, node.value, node.version), nil
+	}
+
+	if node.leftNode != nil || !savedAtOrBefore(node.leftNodeKey, version) {
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return false, err
+		}
+		if stopped, err := t.iterateModifiedSince(leftNode, version, fn); stopped || err != nil {
+			return stopped, err
+		}
+	}
+	if node.rightNode != nil || !savedAtOrBefore(node.rightNodeKey, version) {
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return false, err
+		}
+		return t.iterateModifiedSince(rightNode, version, fn)
+	}
+	return false, nil
+}
+
+// savedAtOrBefore returns true if the node key is in the version-keyed layout, and the node was
+// saved at or before the given version. The version of a node is never above the version it was
+// saved at.
+func savedAtOrBefore(nodeKey []byte, version int64) bool {
+	return isVersionedNodeKey(nodeKey) && int64(binary.BigEndian.Uint64(nodeKey)) <= version
+}
+
 // IsFastCacheEnabled returns true if fast cache is enabled, false otherwise.
 // For fast cache to be enabled, the following 2 conditions must be met:
 // 1. The tree is of the latest version.
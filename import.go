@@ -1,7 +1,7 @@
 package iavl
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 
@@ -22,18 +22,26 @@ var ErrNoImport = errors.New("no import in progress")
 // Importer is not concurrency-safe, it is the caller's responsibility to ensure the tree is not
 // modified while performing an import.
 type Importer struct {
+	ctx       context.Context
 	tree      *MutableTree
 	version   int64
 	batch     db.Batch
 	batchSize uint32
 	stack     []*Node
+
+	versionedNodeKeys bool   // Whether nodes are imported in the version-keyed layout.
+	nonce             uint32 // Nonce of the last node key assigned in the version-keyed layout.
 }
 
-// newImporter creates a new Importer for an empty MutableTree.
+// newImporter creates a new Importer for an empty MutableTree, which stops once the given context
+// is done.
 //
 // version should correspond to the version that was initially exported. It must be greater than
 // or equal to the highest ExportNode version number given.
-func newImporter(tree *MutableTree, version int64) (*Importer, error) {
+func newImporter(ctx context.Context, tree *MutableTree, version int64) (*Importer, error) {
+	if err := tree.checkWritable(); err != nil {
+		return nil, err
+	}
 	if version < 0 {
 		return nil, errors.New("imported version cannot be negative")
 	}
@@ -43,12 +51,18 @@ func newImporter(tree *MutableTree, version int64) (*Importer, error) {
 	if !tree.IsEmpty() {
 		return nil, errors.New("tree must be empty")
 	}
+	versionedNodeKeys, err := tree.ndb.useVersionedNodeKeys()
+	if err != nil {
+		return nil, err
+	}
 
 	return &Importer{
-		tree:    tree,
-		version: version,
-		batch:   tree.ndb.db.NewBatch(),
-		stack:   make([]*Node, 0, 8),
+		ctx:               ctx,
+		tree:              tree,
+		version:           version,
+		batch:             tree.ndb.newBatch(),
+		stack:             make([]*Node, 0, 8),
+		versionedNodeKeys: versionedNodeKeys,
 	}, nil
 }
 
@@ -64,11 +78,17 @@ func (i *Importer) Close() {
 
 // Add adds an ExportNode to the import. ExportNodes must be added in the order returned by
 // Exporter, i.e. depth-first post-order (LRN). Nodes are periodically flushed to the database,
-// but the imported version is not visible until Commit() is called.
+// but the imported version is not visible until Commit() is called. Once the context of the
+// importer is done, Add returns its error instead of starting a new batch.
 func (i *Importer) Add(exportNode *ExportNode) error {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	if i.batchSize == 0 {
+		if err := i.ctx.Err(); err != nil {
+			return err
+		}
+	}
 	if exportNode == nil {
 		return errors.New("node cannot be nil")
 	}
@@ -95,12 +115,12 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	switch {
 	case stackSize >= 2 && i.stack[stackSize-1].subtreeHeight < node.subtreeHeight && i.stack[stackSize-2].subtreeHeight < node.subtreeHeight:
 		node.leftNode = i.stack[stackSize-2]
-		node.leftHash = node.leftNode.hash
+		node.leftHash, node.leftNodeKey = node.leftNode.hash, node.leftNode.nodeKey
 		node.rightNode = i.stack[stackSize-1]
-		node.rightHash = node.rightNode.hash
+		node.rightHash, node.rightNodeKey = node.rightNode.hash, node.rightNode.nodeKey
 	case stackSize >= 1 && i.stack[stackSize-1].subtreeHeight < node.subtreeHeight:
 		node.leftNode = i.stack[stackSize-1]
-		node.leftHash = node.leftNode.hash
+		node.leftHash, node.leftNodeKey = node.leftNode.hash, node.leftNode.nodeKey
 	}
 
 	if node.subtreeHeight == 0 {
@@ -113,30 +133,41 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		node.size += node.rightNode.size
 	}
 
-	_, err := node._hash()
+	hasher, err := i.tree.ndb.nodeHasher()
 	if err != nil {
 		return err
 	}
+	if _, err = node._hash(hasher); err != nil {
+		return err
+	}
 
 	err = node.validate()
 	if err != nil {
 		return err
 	}
 
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufPool.Put(buf)
+	// The nonce is only committed to the importer once the node has been added to the batch.
+	nonce := i.nonce
+	if i.versionedNodeKeys {
+		nonce++
+		node.nodeKey = makeVersionedNodeKey(i.version, nonce)
+	} else {
+		node.nodeKey = node.hash
+	}
 
-	if err = node.writeBytes(buf); err != nil {
+	bz, err := i.tree.ndb.encodeNode(node)
+	if err != nil {
 		return err
 	}
 
-	bytesCopy := make([]byte, buf.Len())
-	copy(bytesCopy, buf.Bytes())
-
-	if err = i.batch.Set(i.tree.ndb.nodeKey(node.hash), bytesCopy); err != nil {
+	if err = i.batch.Set(i.tree.ndb.nodeKey(node.nodeKey), bz); err != nil {
+		return err
+	}
+	i.tree.ndb.opts.Metrics.AddBytesWritten(len(bz))
+	if err = i.tree.ndb.saveBlobToBatch(i.batch, node); err != nil {
 		return err
 	}
+	i.nonce = nonce
 
 	i.batchSize++
 	if i.batchSize >= maxBatchSize {
@@ -145,7 +176,7 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 			return err
 		}
 		i.batch.Close()
-		i.batch = i.tree.ndb.db.NewBatch()
+		i.batch = i.tree.ndb.newBatch()
 		i.batchSize = 0
 	}
 
@@ -156,19 +187,26 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	case node.leftHash != nil || node.rightHash != nil:
 		i.stack = i.stack[:stackSize-1]
 	}
-	// Only hash\height\size of the node will be used after it be pushed into the stack.
-	i.stack = append(i.stack, &Node{hash: node.hash, subtreeHeight: node.subtreeHeight, size: node.size})
+	// Only hash\nodeKey\height\size of the node will be used after it be pushed into the stack.
+	i.stack = append(i.stack, &Node{hash: node.hash, nodeKey: node.nodeKey, subtreeHeight: node.subtreeHeight, size: node.size})
 
 	return nil
 }
 
 // Commit finalizes the import by flushing any outstanding nodes to the database, making the
 // version visible, and updating the tree metadata. It can only be called once, and calls Close()
-// internally.
-func (i *Importer) Commit() error {
+// internally. Once the context of the importer is done, Commit returns its error without
+// committing. If the context is done while loading the imported version, the import is committed
+// but the tree must be loaded again.
+func (i *Importer) Commit() (err error) {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	span := i.tree.ndb.startSpan(SpanImportCommit, "version", i.version)
+	defer func() { span.End(err) }()
+	if err := i.ctx.Err(); err != nil {
+		return err
+	}
 
 	switch len(i.stack) {
 	case 0:
@@ -176,21 +214,30 @@ func (i *Importer) Commit() error {
 			return err
 		}
 	case 1:
-		if err := i.batch.Set(i.tree.ndb.rootKey(i.version), i.stack[0].hash); err != nil {
+		if err := i.batch.Set(i.tree.ndb.rootKey(i.version), i.stack[0].nodeKey); err != nil {
 			return err
 		}
 	default:
 		return fmt.Errorf("invalid node structure, found stack size %v when committing",
 			len(i.stack))
 	}
+	if err := i.tree.ndb.setNodeKeyLayoutToBatch(i.batch); err != nil {
+		return err
+	}
+	if err := i.tree.ndb.setStorageFormatToBatch(i.batch); err != nil {
+		return err
+	}
+	if err := i.tree.ndb.setMigrationsToBatch(i.batch, i.version); err != nil {
+		return err
+	}
 
-	err := i.batch.WriteSync()
+	err = i.batch.WriteSync()
 	if err != nil {
 		return err
 	}
 	i.tree.ndb.resetLatestVersion(i.version)
 
-	_, err = i.tree.LoadVersion(i.version)
+	_, err = i.tree.LoadVersionContext(i.ctx, i.version)
 	if err != nil {
 		return err
 	}
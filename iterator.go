@@ -168,16 +168,45 @@ func (t *traversal) next() (*Node, error) {
 	return t.next()
 }
 
+// MetadataIterator is a dbm.Iterator whose items also carry the metadata of their leaf nodes.
+// Iterator, FastIterator and UnsavedFastIterator implement it.
+type MetadataIterator interface {
+	dbm.Iterator
+
+	// KeyVersion returns the version the current key was last updated at.
+	KeyVersion() int64
+
+	// KeyIndex returns the index of the current key in the tree, and false if the iterator
+	// cannot tell it, which is the case of the iterators over fast nodes.
+	KeyIndex() (int64, bool)
+}
+
+var (
+	_ MetadataIterator = (*Iterator)(nil)
+	_ MetadataIterator = (*FastIterator)(nil)
+	_ MetadataIterator = (*UnsavedFastIterator)(nil)
+)
+
 // Iterator is a dbm.Iterator for ImmutableTree
 type Iterator struct {
 	start, end []byte
 
+	ascending bool
+
 	key, value []byte
 
+	keyVersion int64
+
+	index int64 // Index of the key in the tree, or -1 until it is looked up.
+
 	valid bool
 
 	err error
 
+	tree *ImmutableTree
+
+	version int64
+
 	t *traversal
 }
 
@@ -186,13 +215,17 @@ var _ dbm.Iterator = (*Iterator)(nil)
 // Returns a new iterator over the immutable tree. If the tree is nil, the iterator will be invalid.
 func NewIterator(start, end []byte, ascending bool, tree *ImmutableTree) dbm.Iterator {
 	iter := &Iterator{
-		start: start,
-		end:   end,
+		start:     start,
+		end:       end,
+		ascending: ascending,
+		tree:      tree,
+		index:     -1,
 	}
 
 	if tree == nil {
 		iter.err = errIteratorNilTreeGiven
 	} else {
+		iter.version = tree.version
 		iter.valid = true
 		iter.t = tree.root.newTraversal(tree, start, end, ascending, false, false)
 		// Move iterator before the first element
@@ -236,13 +269,59 @@ func (iter *Iterator) Next() {
 	}
 
 	if node.subtreeHeight == 0 {
-		iter.key, iter.value = node.key, node.value
+		iter.key, iter.value, iter.keyVersion = node.key, node.value, node.version
+		if iter.index >= 0 {
+			if iter.ascending {
+				iter.index++
+			} else {
+				iter.index--
+			}
+		}
 		return
 	}
 
 	iter.Next()
 }
 
+// Seek implements SeekableIterator. The traversal restarts from the root of the tree.
+func (iter *Iterator) Seek(key []byte) {
+	if iter.tree == nil {
+		return
+	}
+	start, end := seekDomain(iter.start, iter.end, iter.ascending, key)
+	iter.valid = true
+	iter.index = -1
+	iter.t = iter.tree.root.newTraversal(iter.tree, start, end, iter.ascending, false, false)
+	iter.Next()
+}
+
+// Cursor implements SeekableIterator.
+func (iter *Iterator) Cursor() *Cursor {
+	return newCursor(iter.version, iter.start, iter.end, iter.ascending, iter.valid, iter.key)
+}
+
+// KeyVersion implements MetadataIterator.
+func (iter *Iterator) KeyVersion() int64 {
+	return iter.keyVersion
+}
+
+// KeyIndex implements MetadataIterator. The index of the first key is looked up in the tree,
+// and the next ones are counted from it.
+func (iter *Iterator) KeyIndex() (int64, bool) {
+	if !iter.valid {
+		return 0, false
+	}
+	if iter.index < 0 {
+		index, _, err := iter.tree.GetWithIndex(iter.key)
+		if err != nil {
+			iter.err = err
+			return 0, false
+		}
+		iter.index = index
+	}
+	return iter.index, true
+}
+
 // Close implements dbm.Iterator
 func (iter *Iterator) Close() error {
 	iter.t = nil
@@ -330,3 +330,238 @@ func setupUnsavedFastIterator(t *testing.T, config *iteratorTestConfig) (dbm.Ite
 	itr := NewUnsavedFastIterator(config.startIterate, config.endIterate, config.ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
 	return itr, mirror
 }
+
+func TestIterator_Seek(t *testing.T) {
+	configs := map[string]*iteratorTestConfig{
+		"Ascending":         {startByteToSet: 'a', endByteToSet: 'z', ascending: true},
+		"Descending":        {startByteToSet: 'a', endByteToSet: 'z', ascending: false},
+		"Ranged Ascending":  {startByteToSet: 'a', endByteToSet: 'z', startIterate: []byte("e"), endIterate: []byte("w"), ascending: true},
+		"Ranged Descending": {startByteToSet: 'a', endByteToSet: 'z', startIterate: []byte("e"), endIterate: []byte("w"), ascending: false},
+	}
+
+	performTest := func(t *testing.T, config *iteratorTestConfig, itr dbm.Iterator, mirror [][]string) {
+		seekable, ok := itr.(SeekableIterator)
+		require.True(t, ok)
+		defer seekable.Close()
+		start, end := seekable.Domain()
+		require.Equal(t, config.startIterate, start)
+		require.Equal(t, config.endIterate, end)
+		// The fast iterator reports the domain of its underlying iterator, which seeking narrows.
+		_, isFast := itr.(*FastIterator)
+
+		// Seek to each key and between keys, moving back and forth, including out of the domain.
+		for b := byte('a' - 1); b <= 'z'+1; b++ {
+			for _, key := range [][]byte{{b}, {b, 0x80}} {
+				var expected [][]string
+				for _, kv := range mirror {
+					if (config.ascending && kv[0] >= string(key)) || (!config.ascending && kv[0] <= string(key)) {
+						expected = append(expected, kv)
+					}
+				}
+
+				seekable.Seek(key)
+				var actual [][]string
+				for ; seekable.Valid(); seekable.Next() {
+					actual = append(actual, []string{string(seekable.Key()), string(seekable.Value())})
+				}
+				require.Equal(t, expected, actual, "seek %q", key)
+				require.NoError(t, seekable.Error())
+
+				// The domain is otherwise unchanged by seeking.
+				if !isFast {
+					start, end := seekable.Domain()
+					require.Equal(t, config.startIterate, start)
+					require.Equal(t, config.endIterate, end)
+				}
+			}
+		}
+	}
+
+	for name, config := range configs {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			t.Run("Iterator", func(t *testing.T) {
+				itr, mirror := setupIteratorAndMirror(t, config)
+				performTest(t, config, itr, mirror)
+			})
+
+			t.Run("Fast Iterator", func(t *testing.T) {
+				itr, mirror := setupFastIteratorAndMirror(t, config)
+				performTest(t, config, itr, mirror)
+			})
+
+			t.Run("Unsaved Fast Iterator", func(t *testing.T) {
+				itr, mirror := setupUnsavedFastIterator(t, config)
+				performTest(t, config, itr, mirror)
+			})
+		})
+	}
+}
+
+func TestIterator_Cursor(t *testing.T) {
+	tree, err := NewMutableTree(dbm.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set(i2b(i), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 50; i < 100; i++ {
+		_, err := tree.Set(i2b(i), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+
+	// paginate iterates the given domain in pages of 7 keys, resuming each page from the
+	// serialized cursor of the previous one.
+	paginate := func(t *testing.T, start, end []byte, ascending bool,
+		iterator func(start, end []byte, ascending bool) (dbm.Iterator, error),
+		resume func(*Cursor) (SeekableIterator, error),
+	) []int {
+		itr, err := iterator(start, end, ascending)
+		require.NoError(t, err)
+		var keys []int
+		for {
+			for i := 0; i < 7 && itr.Valid(); i++ {
+				keys = append(keys, int(itr.Value()[0]))
+				itr.Next()
+			}
+			bz, err := itr.(SeekableIterator).Cursor().MarshalBinary()
+			require.NoError(t, err)
+			require.NoError(t, itr.Close())
+
+			cursor := &Cursor{}
+			require.NoError(t, cursor.UnmarshalBinary(bz))
+			resumed, err := resume(cursor)
+			require.NoError(t, err)
+			if !resumed.Valid() {
+				return keys
+			}
+			itr = resumed
+		}
+	}
+	expectedKeys := func(from, to int, ascending bool) []int {
+		var keys []int
+		for i := from; i < to; i++ {
+			keys = append(keys, i)
+		}
+		if !ascending {
+			sort.Sort(sort.Reverse(sort.IntSlice(keys)))
+		}
+		return keys
+	}
+
+	immutable, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	for _, ascending := range []bool{true, false} {
+		require.Equal(t, expectedKeys(0, 50, ascending), paginate(t, nil, nil, ascending, immutable.Iterator, immutable.ResumeIterator))
+		require.Equal(t, expectedKeys(10, 40, ascending), paginate(t, i2b(10), i2b(40), ascending, immutable.Iterator, immutable.ResumeIterator))
+		require.Equal(t, expectedKeys(0, 100, ascending), paginate(t, nil, nil, ascending, tree.Iterator, tree.ResumeIterator))
+		require.Equal(t, expectedKeys(45, 60, ascending), paginate(t, i2b(45), i2b(60), ascending, tree.Iterator, tree.ResumeIterator))
+	}
+
+	// Cursors only resume at the version they were taken at.
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	cursor := itr.(SeekableIterator).Cursor()
+	require.NoError(t, itr.Close())
+	require.Equal(t, version+1, cursor.Version())
+	_, err = immutable.ResumeIterator(cursor)
+	require.ErrorIs(t, err, ErrCursorVersion)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.ResumeIterator(cursor)
+	require.ErrorIs(t, err, ErrCursorVersion)
+	latest, err := tree.GetImmutable(version + 1)
+	require.NoError(t, err)
+	resumed, err := latest.ResumeIterator(cursor)
+	require.NoError(t, err)
+	require.True(t, resumed.Valid())
+	require.Equal(t, i2b(0), resumed.Key())
+	require.NoError(t, resumed.Close())
+
+	require.Error(t, (&Cursor{}).UnmarshalBinary(nil))
+	require.Error(t, (&Cursor{}).UnmarshalBinary([]byte{0xff, 0}))
+}
+
+func TestIterator_Metadata(t *testing.T) {
+	memDB := dbm.NewMemDB()
+	// The fast storage is only built when the tree is loaded again below, from the leaves.
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+
+	versions := map[string]int64{}
+	set := func(version int64, keys ...string) {
+		for _, key := range keys {
+			_, err := tree.Set([]byte(key), []byte(key))
+			require.NoError(t, err)
+			versions[key] = version
+		}
+	}
+	set(1, "a", "b", "c", "d", "e", "f", "g", "h")
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	set(2, "c", "f")
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	savedVersions := make(map[string]int64, len(versions))
+	for key, version := range versions {
+		savedVersions[key] = version
+	}
+	set(3, "b", "i")
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"}
+	performTest := func(t *testing.T, itr dbm.Iterator, versions map[string]int64, indexed bool) {
+		metadata, ok := itr.(MetadataIterator)
+		require.True(t, ok)
+		defer metadata.Close()
+
+		var actual []string
+		for ; metadata.Valid(); metadata.Next() {
+			key := string(metadata.Key())
+			actual = append(actual, key)
+			require.Equal(t, versions[key], metadata.KeyVersion(), "key %s", key)
+			index, ok := metadata.KeyIndex()
+			require.Equal(t, indexed, ok)
+			if indexed {
+				require.EqualValues(t, sort.SearchStrings(keys, key), index, "key %s", key)
+			}
+		}
+		require.NotEmpty(t, actual)
+	}
+
+	for _, ascending := range []bool{true, false} {
+		// The working tree is iterated over saved and unsaved fast nodes.
+		itr, err := tree.Iterator(nil, nil, ascending)
+		require.NoError(t, err)
+		require.IsType(t, &UnsavedFastIterator{}, itr)
+		performTest(t, itr, versions, false)
+
+		// The latest version is iterated over the fast nodes, which keep the versions of the leaves.
+		latest, err := tree.GetImmutable(2)
+		require.NoError(t, err)
+		itr, err = latest.Iterator([]byte("b"), nil, ascending)
+		require.NoError(t, err)
+		require.IsType(t, &FastIterator{}, itr)
+		performTest(t, itr, savedVersions, false)
+
+		// Without fast nodes, the indexes of the keys are known.
+		itr = NewIterator([]byte("b"), []byte("h"), ascending, latest)
+		performTest(t, itr, savedVersions, true)
+		itr = NewIterator(nil, nil, ascending, tree.ImmutableTree)
+		performTest(t, itr, versions, true)
+	}
+
+	// The indexes of the keys follow seeks.
+	itr := NewIterator(nil, nil, true, tree.ImmutableTree).(*Iterator)
+	index, ok := itr.KeyIndex()
+	require.True(t, ok)
+	require.Zero(t, index)
+	itr.Seek([]byte("f"))
+	performTest(t, itr, versions, true)
+}
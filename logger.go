@@ -0,0 +1,24 @@
+package iavl
+
+// Logger is a structured logger, given as Options.Logger. The key/value pairs alternate keys,
+// which are strings, and values. Its methods match those of the CometBFT and Cosmos SDK loggers,
+// which can be given as is.
+type Logger interface {
+	// Debug logs details of individual operations, e.g. every node saved or deleted.
+	Debug(msg string, keyVals ...interface{})
+
+	// Info logs progress of long operations, e.g. migrations, fast storage upgrades and pruning.
+	Info(msg string, keyVals ...interface{})
+
+	// Error logs failures which are not returned to the caller.
+	Error(msg string, keyVals ...interface{})
+}
+
+// NopLogger is a Logger which discards all logs. It is used when Options.Logger is not set.
+type NopLogger struct{}
+
+var _ Logger = NopLogger{}
+
+func (NopLogger) Debug(string, ...interface{}) {}
+func (NopLogger) Info(string, ...interface{})  {}
+func (NopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,104 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// logEntry is a log recorded by recordingLogger.
+type logEntry struct {
+	level   string
+	msg     string
+	keyVals map[string]interface{}
+}
+
+// recordingLogger is a Logger recording the logs.
+type recordingLogger struct {
+	mtx     sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) log(t *testing.T, level, msg string, keyVals []interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	require.Zero(t, len(keyVals)%2, "odd number of key/value pairs in %q", msg)
+	entry := logEntry{level: level, msg: msg, keyVals: map[string]interface{}{}}
+	for i := 0; i < len(keyVals); i += 2 {
+		key, ok := keyVals[i].(string)
+		require.True(t, ok, "key %v of %q is not a string", keyVals[i], msg)
+		entry.keyVals[key] = keyVals[i+1]
+	}
+	l.entries = append(l.entries, entry)
+}
+
+// find returns the logs with the given level and message.
+func (l *recordingLogger) find(level, msg string) []logEntry {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var entries []logEntry
+	for _, entry := range l.entries {
+		if entry.level == level && entry.msg == msg {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// testLogger adapts a recordingLogger to the Logger interface, failing the test on malformed
+// key/value pairs.
+type testLogger struct {
+	*recordingLogger
+	t *testing.T
+}
+
+func (l testLogger) Debug(msg string, keyVals ...interface{}) { l.log(l.t, "debug", msg, keyVals) }
+func (l testLogger) Info(msg string, keyVals ...interface{})  { l.log(l.t, "info", msg, keyVals) }
+func (l testLogger) Error(msg string, keyVals ...interface{}) { l.log(l.t, "error", msg, keyVals) }
+
+func TestLogger(t *testing.T) {
+	memDB := db.NewMemDB()
+	// The tree is saved without fast storage, which is upgraded when loading it again.
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", version)))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	logs := &recordingLogger{}
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Logger: testLogger{logs, t}}, false)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+
+	loaded := logs.find("info", "loaded version")
+	require.Len(t, loaded, 1)
+	require.Equal(t, map[string]interface{}{"version": int64(3), "firstVersion": int64(1), "versions": 3}, loaded[0].keyVals)
+	upgraded := logs.find("info", "upgraded fast storage")
+	require.Len(t, upgraded, 1)
+	require.Equal(t, int64(3), upgraded[0].keyVals["version"])
+
+	require.NoError(t, tree.DeleteVersionsRange(1, 3))
+	deleting := logs.find("info", "deleting versions")
+	require.Len(t, deleting, 1)
+	require.Equal(t, int64(0), deleting[0].keyVals["predecessor"])
+	require.Equal(t, int64(3), deleting[0].keyVals["successor"])
+	require.Len(t, logs.find("debug", "pruned version"), 2)
+	require.NotEmpty(t, logs.find("debug", "deleted node"))
+
+	_, err = tree.Set([]byte("key-0"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Len(t, logs.find("debug", "saving version"), 1)
+	require.NotEmpty(t, logs.find("debug", "saved node"))
+}
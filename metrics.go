@@ -0,0 +1,66 @@
+package iavl
+
+import "time"
+
+// Iterator kinds reported to Metrics.IncIterators.
+const (
+	IteratorKindTree        = "tree"         // Iterator, walking the tree.
+	IteratorKindFast        = "fast"         // FastIterator, over the fast node index.
+	IteratorKindUnsavedFast = "unsaved_fast" // UnsavedFastIterator, over the working tree.
+)
+
+// Metrics receives measurements of the work done by a tree and its nodeDB, see
+// PrometheusMetrics. The methods may be called concurrently.
+type Metrics interface {
+	// ObserveSaveVersion records the time a SaveVersion or SaveVersionAsync call took, and the
+	// number of nodes it wrote. The time of SaveVersionAsync excludes the background write.
+	ObserveSaveVersion(duration time.Duration, nodesWritten int)
+
+	// AddOrphansWritten records the number of nodes of the previously saved version which the
+	// saved version no longer references, and which pruning may delete.
+	AddOrphansWritten(n int)
+
+	// AddOrphansDeleted records the number of orphaned nodes deleted by pruning.
+	AddOrphansDeleted(n int)
+
+	// AddBytesRead records the number of bytes of nodes, fast nodes and blobs read from the
+	// database.
+	AddBytesRead(n int)
+
+	// AddBytesWritten records the number of bytes of nodes, fast nodes and blobs written to the
+	// database.
+	AddBytesWritten(n int)
+
+	// ObserveDeleteVersion records the time a DeleteVersion or DeleteVersionsRange call took.
+	ObserveDeleteVersion(duration time.Duration)
+
+	// IncIterators records the creation of an iterator of the given IteratorKind.
+	IncIterators(kind string)
+
+	// IncFastStorageGets records a Get which tried the fast node index, and whether the index
+	// answered it, as opposed to falling back to the tree.
+	IncFastStorageGets(hit bool)
+}
+
+// NopMetrics is a Metrics which discards all measurements. It is used when Options.Metrics is
+// not set.
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+func (NopMetrics) ObserveSaveVersion(time.Duration, int) {}
+func (NopMetrics) AddOrphansWritten(int)                 {}
+func (NopMetrics) AddOrphansDeleted(int)                 {}
+func (NopMetrics) AddBytesRead(int)                      {}
+func (NopMetrics) AddBytesWritten(int)                   {}
+func (NopMetrics) ObserveDeleteVersion(time.Duration)    {}
+func (NopMetrics) IncIterators(string)                   {}
+func (NopMetrics) IncFastStorageGets(bool)               {}
+
+// nodeCount returns the number of nodes of the subtree of the given node, which may be nil.
+func nodeCount(node *Node) int {
+	if node == nil {
+		return 0
+	}
+	return int(2*node.size - 1)
+}
@@ -0,0 +1,182 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetrics is a Metrics recording the measurements.
+type recordingMetrics struct {
+	mtx             sync.Mutex
+	saveVersions    int
+	nodesWritten    []int
+	orphansWritten  int
+	orphansDeleted  int
+	bytesRead       int
+	bytesWritten    int
+	deleteVersions  int
+	iterators       map[string]int
+	fastStorageGets map[bool]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{iterators: map[string]int{}, fastStorageGets: map[bool]int{}}
+}
+
+func (m *recordingMetrics) ObserveSaveVersion(_ time.Duration, nodesWritten int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.saveVersions++
+	m.nodesWritten = append(m.nodesWritten, nodesWritten)
+}
+
+func (m *recordingMetrics) AddOrphansWritten(n int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.orphansWritten += n
+}
+
+func (m *recordingMetrics) AddOrphansDeleted(n int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.orphansDeleted += n
+}
+
+func (m *recordingMetrics) AddBytesRead(n int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.bytesRead += n
+}
+
+func (m *recordingMetrics) AddBytesWritten(n int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.bytesWritten += n
+}
+
+func (m *recordingMetrics) ObserveDeleteVersion(time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.deleteVersions++
+}
+
+func (m *recordingMetrics) IncIterators(kind string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.iterators[kind]++
+}
+
+func (m *recordingMetrics) IncFastStorageGets(hit bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.fastStorageGets[hit]++
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := newRecordingMetrics()
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Metrics: metrics}, false)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{199}, metrics.nodesWritten)
+	require.Zero(t, metrics.orphansWritten)
+	require.Positive(t, metrics.bytesWritten)
+
+	// Updating a key orphans the nodes on its path, which the new nodes replace.
+	_, err = tree.Set([]byte("key-050"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 2, metrics.saveVersions)
+	require.Equal(t, metrics.nodesWritten[1], metrics.orphansWritten)
+	require.Equal(t, int(tree.root.subtreeHeight)+1, metrics.orphansWritten)
+
+	// Deleting the first version deletes the nodes the second one orphaned.
+	require.NoError(t, tree.DeleteVersion(1))
+	require.Equal(t, 1, metrics.deleteVersions)
+	require.Equal(t, metrics.orphansWritten, metrics.orphansDeleted)
+
+	// Reading from a new tree reads the nodes and fast nodes from the database.
+	loaded, err := NewMutableTreeWithOpts(memDB, 0, &Options{Metrics: metrics}, false)
+	require.NoError(t, err)
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	bytesRead := metrics.bytesRead
+	value, err := loaded.Get([]byte("key-050"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+	value, err = loaded.Get([]byte("missing"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.Equal(t, map[bool]int{true: 2}, metrics.fastStorageGets)
+	require.Greater(t, metrics.bytesRead, bytesRead)
+
+	// Older versions are read from the tree.
+	_, err = loaded.Set([]byte("key-051"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = loaded.SaveVersion()
+	require.NoError(t, err)
+	immutable, err := loaded.GetImmutable(2)
+	require.NoError(t, err)
+	value, err = immutable.Get([]byte("key-051"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, map[bool]int{true: 2, false: 1}, metrics.fastStorageGets)
+
+	for _, itr := range []func() error{
+		func() error { _, err := loaded.Iterator(nil, nil, true); return err },
+		func() error { _, err := loaded.ImmutableTree.Iterator(nil, nil, true); return err },
+		func() error { _, err := immutable.Iterator(nil, nil, true); return err },
+	} {
+		require.NoError(t, itr())
+	}
+	require.Equal(t, map[string]int{IteratorKindUnsavedFast: 1, IteratorKindFast: 1, IteratorKindTree: 1}, metrics.iterators)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics, err := NewPrometheusMetrics("test", registry)
+	require.NoError(t, err)
+	_, err = NewPrometheusMetrics("test", registry)
+	require.Error(t, err)
+
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Metrics: metrics}, false)
+	require.NoError(t, err)
+	for version := 0; version < 3; version++ {
+		_, err := tree.Set([]byte("key"), []byte(fmt.Sprintf("value-%d", version)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsRange(1, 3))
+	_, err = tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	_, err = tree.ImmutableTree.Get([]byte("key"))
+	require.NoError(t, err)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{
+		"save_version_duration_seconds", "nodes_written", "orphans_written_total",
+		"orphans_deleted_total", "written_bytes_total", "delete_version_duration_seconds",
+		"iterators_total", "fast_storage_gets_total",
+	} {
+		require.True(t, names["test_iavl_"+name], "missing metric %s", name)
+	}
+}
@@ -0,0 +1,232 @@
+package iavl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+// The completion of a migration is recorded in the metadata under migrationKeyPrefix followed
+// by the migration ID, with the latest version of the tree at the time as value.
+const migrationKeyPrefix = "migration/"
+
+// Migration IDs are recorded on disk, and must never change.
+const (
+	storageVersionMigrationID    = "storage_version"
+	orphanIndexMigrationID       = "delete_orphan_index"
+	versionedNodeKeysMigrationID = "versioned_node_keys"
+	fastStorageMigrationID       = "fast_storage"
+)
+
+// migration is a step upgrading the data of a tree on disk, run when the tree is loaded.
+//
+// A migration must be idempotent, since it may be interrupted at any point, in which case it is
+// run again on the next load. Long migrations commit their work in chunks, and resume from what
+// was committed. They stop after a commit once the context given to run is done. A migration
+// records its completion with setMigrationToBatch, together with its last changes.
+type migration struct {
+	// id identifies the migration in its completion record.
+	id string
+	// pending reports whether the migration must run. If nil, the migration runs until its
+	// completion is recorded.
+	pending func(tree *MutableTree) (bool, error)
+	// run performs the migration, returning the error of the context if it stopped early.
+	run func(ctx context.Context, tree *MutableTree) error
+}
+
+// migrations is the list of migrations, in the order they run. New migrations are appended.
+var migrations = []migration{
+	{
+		id:  storageVersionMigrationID,
+		run: func(_ context.Context, tree *MutableTree) error { return tree.ndb.migrateStorageVersion() },
+	},
+	{
+		id:  orphanIndexMigrationID,
+		run: func(ctx context.Context, tree *MutableTree) error { return tree.ndb.deleteOrphanIndex(ctx) },
+	},
+	{
+		id: versionedNodeKeysMigrationID,
+		pending: func(tree *MutableTree) (bool, error) {
+			if !tree.ndb.opts.VersionKeyedNodes {
+				return false, nil
+			}
+			versioned, err := tree.ndb.useVersionedNodeKeys()
+			return !versioned, err
+		},
+		run: func(ctx context.Context, tree *MutableTree) error { return tree.ndb.migrateToVersionedNodeKeys(ctx) },
+	},
+	{
+		// The fast node index is rebuilt whenever it does not match the latest version, which
+		// happens when versions were saved by a release without fast storage.
+		id:      fastStorageMigrationID,
+		pending: func(tree *MutableTree) (bool, error) { return tree.IsUpgradeable() },
+		run:     func(ctx context.Context, tree *MutableTree) error { return tree.upgradeFastStorage(ctx) },
+	},
+}
+
+// migrate runs the pending migrations, in order, until the context is done.
+//
+// A read-only tree runs no migrations, since reads don't depend on them, but ignores a stale fast
+// node index. An empty database has nothing to migrate, and its migrations are recorded along
+// with its first version instead, so that it stays empty until then.
+func (tree *MutableTree) migrate(ctx context.Context) error {
+	if tree.ndb.opts.ReadOnly {
+		return tree.ndb.ignoreStaleFastStorage()
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latestVersion == 0 {
+		tree.ndb.recordMigrations = true
+		if !tree.skipFastStorageUpgrade {
+			// The empty fast node index matches, and is recorded along with every version.
+			tree.ndb.fastStorageVersion = 0
+		}
+		return nil
+	}
+	for _, m := range migrations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var pending bool
+		if m.pending != nil {
+			var err error
+			if pending, err = m.pending(tree); err != nil {
+				return err
+			}
+		} else {
+			_, done, err := tree.ndb.getMigration(m.id)
+			if err != nil {
+				return err
+			}
+			pending = !done
+		}
+		if !pending {
+			continue
+		}
+
+		tree.ndb.opts.Logger.Info("running migration", "migration", m.id)
+		if err := m.run(ctx, tree); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.id, err)
+		}
+		tree.ndb.opts.Logger.Info("completed migration", "migration", m.id)
+	}
+	return nil
+}
+
+// getMigration returns the latest version of the tree when the given migration completed, and
+// whether it completed at all.
+func (ndb *nodeDB) getMigration(id string) (version int64, done bool, err error) {
+	value, err := ndb.db.Get(migrationKey(id))
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	version, err = strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid completion record %q of migration %s: %w", value, id, err)
+	}
+	return version, true, nil
+}
+
+// setMigrationToBatch records that the given migration completed at the given latest version.
+func (ndb *nodeDB) setMigrationToBatch(batch dbm.Batch, id string, version int64) error {
+	return batch.Set(migrationKey(id), []byte(strconv.FormatInt(version, 10)))
+}
+
+// setMigrationsToBatch records the migrations as completed at the given version, if the database
+// was empty when loaded. It is called along with saving the first root of an empty database.
+// Migrations with a pending function are left out, since they don't depend on their record.
+func (ndb *nodeDB) setMigrationsToBatch(batch dbm.Batch, version int64) error {
+	if !ndb.recordMigrations {
+		return nil
+	}
+	for _, m := range migrations {
+		if m.pending != nil {
+			continue
+		}
+		if err := ndb.setMigrationToBatch(batch, m.id, version); err != nil {
+			return err
+		}
+	}
+	ndb.recordMigrations = false
+	return nil
+}
+
+// setMigration records that the given migration completed at the latest version.
+func (ndb *nodeDB) setMigration(id string) error {
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	batch := ndb.newBatch()
+	if err := ndb.setMigrationToBatch(batch, id, latestVersion); err != nil {
+		batch.Close()
+		return err
+	}
+	return ndb.writeBatch(batch)
+}
+
+func migrationKey(id string) []byte {
+	return metadataKeyFormat.Key([]byte(migrationKeyPrefix + id))
+}
+
+// migrateStorageVersion imports the storage version recorded by earlier releases, which is
+// missing or "1.0.0" before the upgrade to fast storage, and "1.1.0-<version>" after it, where
+// version is the latest version the fast node index matches, or just "1.1.0" if it matches the
+// latest version. The fast storage upgrade is recorded as a completed migration instead, and
+// the storage version is deleted.
+//
+// The migration is one-way: the storage version is no longer maintained, and releases reading
+// it must not open the database afterwards.
+func (ndb *nodeDB) migrateStorageVersion() error {
+	key := metadataKeyFormat.Key([]byte(storageVersionKey))
+	value, err := ndb.db.Get(key)
+	if err != nil {
+		return err
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+
+	fastStorageVersion := int64(-1)
+	if value != nil {
+		versions := strings.Split(string(value), fastStorageVersionDelimiter)
+		switch {
+		case len(versions) > 2:
+			return errors.New(errInvalidFastStorageVersion)
+		case versions[0] < fastStorageVersionValue:
+		case len(versions) == 1:
+			fastStorageVersion = latestVersion
+		default:
+			if fastStorageVersion, err = strconv.ParseInt(versions[1], 10, 64); err != nil {
+				return fmt.Errorf("invalid storage version %q: %w", value, err)
+			}
+		}
+	}
+
+	batch := ndb.newBatch()
+	err = batch.Delete(key)
+	if err == nil && fastStorageVersion >= 0 {
+		err = ndb.setMigrationToBatch(batch, fastStorageMigrationID, fastStorageVersion)
+	}
+	if err == nil {
+		err = ndb.setMigrationToBatch(batch, storageVersionMigrationID, latestVersion)
+	}
+	if err != nil {
+		batch.Close()
+		return err
+	}
+	if err := ndb.writeBatch(batch); err != nil {
+		return err
+	}
+	if fastStorageVersion >= 0 {
+		ndb.fastStorageVersion = fastStorageVersion
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package iavl
+
+import (
+	"math/rand"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+func TestMigrate(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(7))
+	for v := 0; v < 3; v++ {
+		applyRandomVersion(t, r, tree)
+	}
+
+	// Mimic a database written by an earlier release, whose fast node index was last updated at
+	// version 2 and has a stale entry.
+	require.NoError(t, memDB.Delete(migrationKey(fastStorageMigrationID)))
+	require.NoError(t, memDB.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(fastStorageVersionValue+fastStorageVersionDelimiter+"2")))
+	require.NoError(t, memDB.Set(orphanKeyFormat.Key(int64(2), int64(1), make([]byte, hashSize)), []byte{}))
+	tree.ndb.fastStorageVersion = -1
+	require.NoError(t, tree.ndb.SaveFastNodeNoCache(fastnode.NewNode([]byte("stale"), []byte("value"), 2)))
+	require.NoError(t, tree.ndb.Commit())
+
+	// Interrupt the migrations a few times, they must complete on the next load.
+	for writes := 0; writes < 3; writes++ {
+		tree, err = NewMutableTree(&limitedDB{DB: memDB, writes: writes}, 0, false)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.ErrorIs(t, err, errWriteLimit)
+	}
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+
+	for _, id := range []string{storageVersionMigrationID, orphanIndexMigrationID, fastStorageMigrationID} {
+		completed, done, err := tree.ndb.getMigration(id)
+		require.NoError(t, err)
+		require.True(t, done, id)
+		require.EqualValues(t, 3, completed, id)
+	}
+	_, done, err := tree.ndb.getMigration(versionedNodeKeysMigrationID)
+	require.NoError(t, err)
+	require.False(t, done)
+
+	has, err := memDB.Has(metadataKeyFormat.Key([]byte(storageVersionKey)))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.Zero(t, countPrefix(t, memDB, orphanKeyFormat.Key()))
+
+	// The fast node index was rebuilt from the latest version.
+	stale, err := tree.ndb.GetFastNode([]byte("stale"))
+	require.NoError(t, err)
+	require.Nil(t, stale)
+	isFastCacheEnabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, isFastCacheEnabled)
+	count := 0
+	tree.Iterate(func(key, value []byte) bool {
+		fastNode, err := tree.ndb.GetFastNode(key)
+		require.NoError(t, err)
+		require.Equal(t, value, fastNode.GetValue())
+		count++
+		return false
+	})
+	require.EqualValues(t, tree.Size(), count)
+	require.Equal(t, count, countPrefix(t, memDB, fastKeyFormat.Key()))
+
+	// Completed migrations don't run again.
+	tree, err = NewMutableTree(&limitedDB{DB: memDB}, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+}
+
+func TestMigrate_EmptyDB(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	isFastCacheEnabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, isFastCacheEnabled)
+
+	// Loading an empty database writes nothing.
+	itr, err := memDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	require.NoError(t, itr.Close())
+
+	// The migrations are recorded along with the first version, and don't run afterwards.
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for _, id := range []string{storageVersionMigrationID, orphanIndexMigrationID, fastStorageMigrationID} {
+		completed, done, err := tree.ndb.getMigration(id)
+		require.NoError(t, err)
+		require.True(t, done, id)
+		require.EqualValues(t, 1, completed, id)
+	}
+	tree, err = NewMutableTree(&limitedDB{DB: memDB}, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	requireTreeContents(t, tree, map[string]string{"key": "value"})
+}
@@ -2,17 +2,17 @@ package iavl
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	dbm "github.com/cosmos/cosmos-db"
 
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
-	"github.com/cosmos/iavl/internal/logger"
 )
 
 // commitGap after upgrade/delete commitGap FastNodes when commit the batch
@@ -21,6 +21,12 @@ var commitGap uint64 = 5000000
 // ErrVersionDoesNotExist is returned if a requested version does not exist.
 var ErrVersionDoesNotExist = errors.New("version does not exist")
 
+// ErrReadOnly is returned when writing to a tree opened with Options.ReadOnly.
+var ErrReadOnly = errors.New("tree is read-only")
+
+// ErrBranchWrite is returned when writing a branch to the database, see Branch.
+var ErrBranchWrite = errors.New("cannot write a branch to the database, merge it into its parent instead")
+
 // MutableTree is a persistent tree which keeps track of versions. It is not safe for concurrent
 // use, and should be guarded by a Mutex or RWLock as appropriate. An immutable tree at a given
 // version can be returned via GetImmutable, which is safe for concurrent access.
@@ -32,13 +38,17 @@ var ErrVersionDoesNotExist = errors.New("version does not exist")
 type MutableTree struct {
 	*ImmutableTree                                     // The current, working tree.
 	lastSaved                *ImmutableTree            // The most recently saved tree.
-	orphans                  map[string]int64          // Nodes removed by changes to working tree.
 	versions                 map[int64]bool            // The previous, saved versions of the tree.
 	allRootLoaded            bool                      // Whether all roots are loaded or not(by LazyLoadVersion)
 	unsavedFastNodeAdditions map[string]*fastnode.Node // FastNodes that have not yet been saved to disk
 	unsavedFastNodeRemovals  map[string]interface{}    // FastNodes that have not yet been removed from disk
 	ndb                      *nodeDB
-	skipFastStorageUpgrade   bool // If true, the tree will work like no fast storage and always not upgrade fast storage
+	skipFastStorageUpgrade   bool             // If true, the tree will work like no fast storage and always not upgrade fast storage
+	pendingCommit            *CommitHandle    // Version being written to disk by SaveVersionAsync, if any
+	savepoints               []*Savepoint     // Savepoints of the working tree, see Savepoint
+	fastNodeJournal          []fastNodeChange // Changes of the unsaved fast nodes since the first savepoint
+	branchOf                 *MutableTree     // Tree the branch was created from, if the tree is a branch
+	branchRoot               *Node            // Working root of branchOf when the branch was created
 
 	mtx sync.Mutex
 }
@@ -56,7 +66,6 @@ func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options, skipFastSto
 	return &MutableTree{
 		ImmutableTree:            head,
 		lastSaved:                head.clone(),
-		orphans:                  map[string]int64{},
 		versions:                 map[int64]bool{},
 		allRootLoaded:            false,
 		unsavedFastNodeAdditions: make(map[string]*fastnode.Node),
@@ -66,6 +75,17 @@ func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options, skipFastSto
 	}, nil
 }
 
+// checkWritable returns an error if the tree can't write to the database.
+func (tree *MutableTree) checkWritable() error {
+	if tree.ndb.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if tree.branchOf != nil {
+		return ErrBranchWrite
+	}
+	return nil
+}
+
 // IsEmpty returns whether or not the tree has any keys. Only trees that are
 // not empty can be saved.
 func (tree *MutableTree) IsEmpty() bool {
@@ -132,22 +152,21 @@ func (tree *MutableTree) prepareOrphansSlice() []*Node {
 // to slices stored within IAVL. It returns true when an existing value was
 // updated, while false means it was a new key.
 func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
-	var orphaned []*Node
-	orphaned, updated, err = tree.set(key, value)
+	end := tree.trace(SpanSet, "key", key)
+	defer func() { end(err) }()
+	_, updated, err = tree.set(key, value)
 	if err != nil {
 		return false, err
 	}
-	err = tree.addOrphans(orphaned)
-	if err != nil {
-		return updated, err
-	}
 	return updated, nil
 }
 
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
-func (tree *MutableTree) Get(key []byte) ([]byte, error) {
-	if tree.root == nil {
+func (tree *MutableTree) Get(key []byte) (value []byte, err error) {
+	t, span := tree.ImmutableTree.traced(SpanGet, "key", key)
+	defer func() { span.End(err) }()
+	if t.root == nil {
 		return nil, nil
 	}
 
@@ -159,9 +178,18 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 		if _, ok := tree.unsavedFastNodeRemovals[string(key)]; ok {
 			return nil, nil
 		}
+		// check the changes of a version which may not be on disk yet
+		if pending := tree.pendingCommit; pending != nil {
+			if fastNode, ok := pending.fastNodeAdditions[ibytes.UnsafeBytesToStr(key)]; ok {
+				return fastNode.GetValue(), nil
+			}
+			if _, ok := pending.fastNodeRemovals[ibytes.UnsafeBytesToStr(key)]; ok {
+				return nil, nil
+			}
+		}
 	}
 
-	return tree.ImmutableTree.Get(key)
+	return t.get(key)
 }
 
 // Import returns an importer for tree nodes previously exported by ImmutableTree.Export(),
@@ -173,7 +201,14 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 // Import can only be called on an empty tree. It is the callers responsibility that no other
 // modifications are made to the tree while importing.
 func (tree *MutableTree) Import(version int64) (*Importer, error) {
-	return newImporter(tree, version)
+	return tree.ImportContext(context.Background(), version)
+}
+
+// ImportContext is like Import, but the importer stops once the given context is done: Add
+// returns the error of the context before starting a new batch, and Commit before committing the
+// import. The batches flushed until then are not visible, and the tree remains empty.
+func (tree *MutableTree) ImportContext(ctx context.Context, version int64) (*Importer, error) {
+	return newImporter(ctx, tree, version)
 }
 
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
@@ -195,7 +230,8 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 		return tree.ImmutableTree.Iterate(fn)
 	}
 
-	itr := NewUnsavedFastIterator(nil, nil, true, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
+	additions, removals := tree.unsavedFastNodes()
+	itr := NewUnsavedFastIterator(nil, nil, true, tree.ndb, additions, removals)
 	defer itr.Close()
 	for ; itr.Valid(); itr.Next() {
 		if fn(itr.Key(), itr.Value()) {
@@ -205,7 +241,8 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 	return false, nil
 }
 
-// Iterator returns an iterator over the mutable tree.
+// Iterator returns an iterator over the mutable tree, which implements SeekableIterator and
+// MetadataIterator.
 // CONTRACT: no updates are made to the tree while an iterator is active.
 func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterator, error) {
 	if !tree.skipFastStorageUpgrade {
@@ -215,11 +252,55 @@ func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterat
 		}
 
 		if isFastCacheEnabled {
-			return NewUnsavedFastIterator(start, end, ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals), nil
+			additions, removals := tree.unsavedFastNodes()
+			itr := NewUnsavedFastIterator(start, end, ascending, tree.ndb, additions, removals)
+			itr.version = tree.version + 1
+			tree.ndb.opts.Metrics.IncIterators(IteratorKindUnsavedFast)
+			return itr, nil
 		}
 	}
 
-	return tree.ImmutableTree.Iterator(start, end, ascending)
+	itr, err := tree.ImmutableTree.Iterator(start, end, ascending)
+	if treeItr, ok := itr.(*Iterator); ok {
+		// The iterator is over the working tree, which is saved as the next version.
+		treeItr.version = tree.version + 1
+	}
+	return itr, err
+}
+
+// IteratorAt returns an iterator over the mutable tree starting at the key with the given index,
+// see ImmutableTree.IteratorAt.
+// CONTRACT: no updates are made to the tree while an iterator is active.
+func (tree *MutableTree) IteratorAt(index int64, ascending bool) (dbm.Iterator, error) {
+	return tree.iteratorAt(index, ascending, tree.Iterator)
+}
+
+// unsavedFastNodes returns the fast node changes which are not visible on disk yet. These
+// include the changes of a version still being written by SaveVersionAsync, merged with the
+// changes of the working tree.
+func (tree *MutableTree) unsavedFastNodes() (map[string]*fastnode.Node, map[string]interface{}) {
+	pending := tree.pendingCommit
+	if pending == nil || pending.isDone() {
+		return tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals
+	}
+
+	additions := make(map[string]*fastnode.Node, len(pending.fastNodeAdditions)+len(tree.unsavedFastNodeAdditions))
+	removals := make(map[string]interface{}, len(pending.fastNodeRemovals)+len(tree.unsavedFastNodeRemovals))
+	for key, node := range pending.fastNodeAdditions {
+		additions[key] = node
+	}
+	for key := range pending.fastNodeRemovals {
+		removals[key] = true
+	}
+	for key, node := range tree.unsavedFastNodeAdditions {
+		delete(removals, key)
+		additions[key] = node
+	}
+	for key := range tree.unsavedFastNodeRemovals {
+		delete(additions, key)
+		removals[key] = true
+	}
+	return additions, removals
 }
 
 func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, updated bool, err error) {
@@ -289,7 +370,7 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orph
 			if err != nil {
 				return nil, updated, err
 			}
-			node.leftHash = nil // leftHash is yet unknown
+			node.leftHash, node.leftNodeKey = nil, nil // leftHash is yet unknown
 		} else {
 			rightNode, err := node.getRightNode(tree.ImmutableTree)
 			if err != nil {
@@ -299,7 +380,7 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orph
 			if err != nil {
 				return nil, updated, err
 			}
-			node.rightHash = nil // rightHash is yet unknown
+			node.rightHash, node.rightNodeKey = nil, nil // rightHash is yet unknown
 		}
 
 		if updated {
@@ -320,16 +401,13 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orph
 
 // Remove removes a key from the working tree. The given key byte slice should not be modified
 // after this call, since it may point to data stored inside IAVL.
-func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
-	val, orphaned, removed, err := tree.remove(key)
+func (tree *MutableTree) Remove(key []byte) (value []byte, removed bool, err error) {
+	end := tree.trace(SpanRemove, "key", key)
+	defer func() { end(err) }()
+	val, _, removed, err := tree.remove(key)
 	if err != nil {
 		return nil, false, err
 	}
-
-	err = tree.addOrphans(orphaned)
-	if err != nil {
-		return val, removed, err
-	}
 	return val, removed, nil
 }
 
@@ -340,7 +418,7 @@ func (tree *MutableTree) remove(key []byte) (value []byte, orphaned []*Node, rem
 		return nil, nil, false, nil
 	}
 	orphaned = tree.prepareOrphansSlice()
-	newRootHash, newRoot, _, value, err := tree.recursiveRemove(tree.root, key, &orphaned)
+	newRoot, _, value, err := tree.recursiveRemove(tree.root, key, &orphaned)
 	if err != nil {
 		return nil, nil, false, err
 	}
@@ -352,108 +430,108 @@ func (tree *MutableTree) remove(key []byte) (value []byte, orphaned []*Node, rem
 		tree.addUnsavedRemoval(key)
 	}
 
-	if newRoot == nil && newRootHash != nil {
-		tree.root, err = tree.ndb.GetNode(newRootHash)
-		if err != nil {
-			return nil, nil, false, err
-		}
-	} else {
-		tree.root = newRoot
-	}
+	tree.root = newRoot
 	return value, orphaned, true, nil
 }
 
 // removes the node corresponding to the passed key and balances the tree.
 // It returns:
-// - the hash of the new node (or nil if the node is the one removed)
-// - the node that replaces the orig. node after remove
+// - the node that replaces the orig. node after remove (or nil if the node is the one removed)
 // - new leftmost leaf key for tree after successfully removing 'key' if changed.
 // - the removed value
 // - the orphaned nodes.
-func (tree *MutableTree) recursiveRemove(node *Node, key []byte, orphans *[]*Node) (newHash []byte, newSelf *Node, newKey []byte, newValue []byte, err error) {
+func (tree *MutableTree) recursiveRemove(node *Node, key []byte, orphans *[]*Node) (newSelf *Node, newKey []byte, newValue []byte, err error) {
 	version := tree.version + 1
 
 	if node.isLeaf() {
 		if bytes.Equal(key, node.key) {
 			*orphans = append(*orphans, node)
-			return nil, nil, nil, node.value, nil
+			return nil, nil, node.value, nil
 		}
-		return node.hash, node, nil, nil, nil
+		return node, nil, nil, nil
 	}
 
 	// node.key < key; we go to the left to find the key:
 	if bytes.Compare(key, node.key) < 0 {
 		leftNode, err := node.getLeftNode(tree.ImmutableTree)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
-		newLeftHash, newLeftNode, newKey, value, err := tree.recursiveRemove(leftNode, key, orphans)
+		newLeftNode, newKey, value, err := tree.recursiveRemove(leftNode, key, orphans)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
 
 		if len(*orphans) == 0 {
-			return node.hash, node, nil, value, nil
+			return node, nil, value, nil
 		}
 		*orphans = append(*orphans, node)
-		if newLeftHash == nil && newLeftNode == nil { // left node held value, was removed
-			return node.rightHash, node.rightNode, node.key, value, nil
+		if newLeftNode == nil { // left node held value, was removed
+			rightNode, err := node.getRightNode(tree.ImmutableTree)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return rightNode, node.key, value, nil
 		}
 
 		newNode, err := node.clone(version)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
 
-		newNode.leftHash, newNode.leftNode = newLeftHash, newLeftNode
+		newNode.leftHash, newNode.leftNodeKey, newNode.leftNode = newLeftNode.hash, newLeftNode.nodeKey, newLeftNode
 		err = newNode.calcHeightAndSize(tree.ImmutableTree)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
 		newNode, err = tree.balance(newNode, orphans)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
 
-		return newNode.hash, newNode, newKey, value, nil
+		return newNode, newKey, value, nil
 	}
 	// node.key >= key; either found or look to the right:
 	rightNode, err := node.getRightNode(tree.ImmutableTree)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
-	newRightHash, newRightNode, newKey, value, err := tree.recursiveRemove(rightNode, key, orphans)
+	newRightNode, newKey, value, err := tree.recursiveRemove(rightNode, key, orphans)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
 	if len(*orphans) == 0 {
-		return node.hash, node, nil, value, nil
+		return node, nil, value, nil
 	}
 	*orphans = append(*orphans, node)
-	if newRightHash == nil && newRightNode == nil { // right node held value, was removed
-		return node.leftHash, node.leftNode, nil, value, nil
+	if newRightNode == nil { // right node held value, was removed
+		leftNode, err := node.getLeftNode(tree.ImmutableTree)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return leftNode, nil, value, nil
 	}
 
 	newNode, err := node.clone(version)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	newNode.rightHash, newNode.rightNode = newRightHash, newRightNode
+	newNode.rightHash, newNode.rightNodeKey, newNode.rightNode = newRightNode.hash, newRightNode.nodeKey, newRightNode
 	if newKey != nil {
 		newNode.key = newKey
 	}
 	err = newNode.calcHeightAndSize(tree.ImmutableTree)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	newNode, err = tree.balance(newNode, orphans)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return newNode.hash, newNode, nil, value, nil
+	return newNode, nil, value, nil
 }
 
 // Load the latest versioned tree from disk.
@@ -469,6 +547,14 @@ func (tree *MutableTree) Load() (int64, error) {
 // performs a no-op. Otherwise, if the root does not exist, an error will be
 // returned.
 func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
+	tree.discardPendingCommit()
+	if err := tree.ndb.storageFormat(); err != nil {
+		return 0, err
+	}
+	if err := tree.migrate(context.Background()); err != nil {
+		return 0, err
+	}
+
 	latestVersion, err := tree.ndb.getLatestVersion()
 	if err != nil {
 		return 0, err
@@ -480,12 +566,6 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 	// no versions have been saved if the latest version is non-positive
 	if latestVersion <= 0 {
 		if targetVersion <= 0 {
-			if !tree.skipFastStorageUpgrade {
-				tree.mtx.Lock()
-				defer tree.mtx.Unlock()
-				_, err := tree.enableFastStorageAndCommitIfNotEnabled()
-				return 0, err
-			}
 			return 0, nil
 		}
 		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
@@ -523,22 +603,34 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		}
 	}
 
-	tree.orphans = map[string]int64{}
 	tree.ImmutableTree = iTree
 	tree.lastSaved = iTree.clone()
+	tree.resetSavepoints()
 
-	if !tree.skipFastStorageUpgrade {
-		// Attempt to upgrade
-		if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
-			return 0, err
-		}
-	}
-
+	tree.ndb.opts.Logger.Info("lazily loaded version", "version", targetVersion)
 	return targetVersion, nil
 }
 
 // Returns the version number of the latest version found
 func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
+	return tree.LoadVersionContext(context.Background(), targetVersion)
+}
+
+// LoadVersionContext is like LoadVersion, but stops the migrations run when loading, such as the
+// fast storage upgrade, once the given context is done, and returns the error of the context.
+// The migrations stop after committing a batch of their work, and resume from it when the tree
+// is loaded again.
+func (tree *MutableTree) LoadVersionContext(ctx context.Context, targetVersion int64) (version int64, err error) {
+	span := tree.ndb.startSpan(SpanLoadVersion, "targetVersion", targetVersion)
+	defer func() { span.End(err) }()
+	tree.discardPendingCommit()
+	if err := tree.ndb.storageFormat(); err != nil {
+		return 0, err
+	}
+	if err := tree.migrate(ctx); err != nil {
+		return 0, err
+	}
+
 	roots, err := tree.ndb.getRoots()
 	if err != nil {
 		return 0, err
@@ -546,12 +638,7 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 
 	if len(roots) == 0 {
 		if targetVersion <= 0 {
-			if !tree.skipFastStorageUpgrade {
-				tree.mtx.Lock()
-				defer tree.mtx.Unlock()
-				_, err := tree.enableFastStorageAndCommitIfNotEnabled()
-				return 0, err
-			}
+			tree.ndb.opts.Logger.Info("no versions to load")
 			return 0, nil
 		}
 		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
@@ -592,30 +679,27 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	}
 
 	if len(latestRoot) != 0 {
-		t.root, err = tree.ndb.GetNode(latestRoot)
+		t.root, err = tree.ndb.getNode(latestRoot, span)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	tree.orphans = map[string]int64{}
 	tree.ImmutableTree = t
 	tree.lastSaved = t.clone()
 	tree.allRootLoaded = true
+	tree.resetSavepoints()
 
-	if !tree.skipFastStorageUpgrade {
-		// Attempt to upgrade
-		if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
-			return 0, err
-		}
-	}
-
+	tree.ndb.opts.Logger.Info("loaded version", "version", latestVersion, "firstVersion", firstVersion, "versions", len(roots))
 	return latestVersion, nil
 }
 
 // LoadVersionForOverwriting attempts to load a tree at a previously committed
 // version, or the latest version below it. Any versions greater than targetVersion will be deleted.
 func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) (int64, error) {
+	if err := tree.checkWritable(); err != nil {
+		return 0, err
+	}
 	latestVersion, err := tree.LoadVersion(targetVersion)
 	if err != nil {
 		return latestVersion, err
@@ -666,7 +750,7 @@ func (tree *MutableTree) IsUpgradeable() (bool, error) {
 
 // enableFastStorageAndCommitIfNotEnabled if nodeDB doesn't mark fast storage as enabled, enable it, and commit the update.
 // Checks whether the fast cache on disk matches latest live state. If not, deletes all existing fast nodes and repopulates them
-// from latest tree.
+// from the working tree.
 // nolint: unparam
 func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error) {
 	isUpgradeable, err := tree.IsUpgradeable()
@@ -678,46 +762,109 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 		return false, nil
 	}
 
+	if err := tree.rebuildFastStorage(context.Background(), tree.ImmutableTree); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// upgradeFastStorage repopulates the fast nodes from the latest version of the tree on disk, until
+// the context is done.
+func (tree *MutableTree) upgradeFastStorage(ctx context.Context) error {
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	rootKey, err := tree.ndb.getRoot(latestVersion)
+	if err != nil {
+		return err
+	}
+
+	latest := &ImmutableTree{
+		ndb:                    tree.ndb,
+		version:                latestVersion,
+		skipFastStorageUpgrade: tree.skipFastStorageUpgrade,
+	}
+	if len(rootKey) > 0 {
+		if latest.root, err = tree.ndb.GetNode(rootKey); err != nil {
+			return err
+		}
+	}
+	return tree.rebuildFastStorage(ctx, latest)
+}
+
+// rebuildFastStorage deletes all existing fast nodes and repopulates them from the given tree,
+// committing every commitGap fast nodes. Once the context is done, it stops after a commit and
+// returns the error of the context. The fast node index is then unused until it is rebuilt, which
+// the fast storage migration does on the next load, since its completion is not recorded.
+func (tree *MutableTree) rebuildFastStorage(ctx context.Context, t *ImmutableTree) (err error) {
+	if err := tree.checkWritable(); err != nil {
+		return err
+	}
 	// If there is a mismatch between which fast nodes are on disk and the live state due to temporary
 	// downgrade and subsequent re-upgrade, we cannot know for sure which fast nodes have been removed while downgraded,
 	// Therefore, there might exist stale fast nodes on disk. As a result, to avoid persisting the stale state, it might
 	// be worth to delete the fast nodes from disk.
-	fastItr := NewFastIterator(nil, nil, true, tree.ndb)
+	logger := tree.ndb.opts.Logger
+	logger.Info("upgrading fast storage", "version", t.version, "fastStorageVersion", tree.ndb.fastStorageVersion)
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			tree.ndb.fastStorageVersion = -1
+			logger.Error("failed to upgrade fast storage", "version", t.version, "err", err)
+		}
+	}()
+
+	// The keys are iterated without decoding the fast nodes, which may be stale or corrupt.
+	fastItr, err := tree.ndb.getFastIterator(nil, nil, true)
+	if err != nil {
+		return err
+	}
 	defer fastItr.Close()
 	var deletedFastNodes uint64
 	for ; fastItr.Valid(); fastItr.Next() {
 		deletedFastNodes++
-		if err := tree.ndb.DeleteFastNode(fastItr.Key()); err != nil {
-			return false, err
+		if err := tree.ndb.DeleteFastNode(fastItr.Key()[1:]); err != nil {
+			return err
 		}
 		if deletedFastNodes%commitGap == 0 {
 			if err := tree.ndb.Commit(); err != nil {
-				return false, err
+				return err
+			}
+			logger.Info("deleting stale fast nodes", "deleted", deletedFastNodes)
+			if err := ctx.Err(); err != nil {
+				return err
 			}
 		}
 	}
+	if err := fastItr.Error(); err != nil {
+		return err
+	}
 	if deletedFastNodes%commitGap != 0 {
 		if err := tree.ndb.Commit(); err != nil {
-			return false, err
+			return err
 		}
 	}
 
-	if err := tree.enableFastStorageAndCommit(); err != nil {
-		tree.ndb.storageVersion = defaultStorageVersionValue
-		return false, err
+	if err := tree.enableFastStorageAndCommit(ctx, t); err != nil {
+		return err
 	}
-	return true, nil
+	logger.Info("upgraded fast storage", "version", t.version, "deletedFastNodes", deletedFastNodes, "duration", time.Since(start))
+	return nil
 }
 
-func (tree *MutableTree) enableFastStorageAndCommit() error {
+// enableFastStorageAndCommit saves the fast nodes of the given tree, committing every commitGap
+// fast nodes, and records the fast storage upgrade. Once the context is done, it stops after a
+// commit and returns the error of the context, without recording the upgrade.
+func (tree *MutableTree) enableFastStorageAndCommit(ctx context.Context, t *ImmutableTree) error {
 	var err error
 
-	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+	itr := NewIterator(nil, nil, true, t).(MetadataIterator)
 	defer itr.Close()
 	var upgradedFastNodes uint64
 	for ; itr.Valid(); itr.Next() {
 		upgradedFastNodes++
-		if err = tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(itr.Key(), itr.Value(), tree.version)); err != nil {
+		if err = tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(itr.Key(), itr.Value(), itr.KeyVersion())); err != nil {
 			return err
 		}
 		if upgradedFastNodes%commitGap == 0 {
@@ -725,6 +872,10 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 			if err != nil {
 				return err
 			}
+			tree.ndb.opts.Logger.Info("upgrading fast storage", "version", t.version, "fastNodes", upgradedFastNodes)
+			if err = ctx.Err(); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -742,6 +893,10 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 // GetImmutable loads an ImmutableTree at a given version for querying. The returned tree is
 // safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`.
 func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	if err := tree.waitForVersion(version); err != nil {
+		return nil, err
+	}
+
 	rootHash, err := tree.ndb.getRoot(version)
 	if err != nil {
 		return nil, err
@@ -786,16 +941,20 @@ func (tree *MutableTree) Rollback() {
 			skipFastStorageUpgrade: tree.skipFastStorageUpgrade,
 		}
 	}
-	tree.orphans = map[string]int64{}
 	if !tree.skipFastStorageUpgrade {
 		tree.unsavedFastNodeAdditions = map[string]*fastnode.Node{}
 		tree.unsavedFastNodeRemovals = map[string]interface{}{}
 	}
+	tree.resetSavepoints()
 }
 
 // GetVersioned gets the value at the specified key and version. The returned value must not be
 // modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error) {
+	if err := tree.waitForVersion(version); err != nil {
+		return nil, err
+	}
+
 	if tree.VersionExists(version) {
 		if !tree.skipFastStorageUpgrade {
 			isFastCacheEnabled, err := tree.IsFastCacheEnabled()
@@ -829,58 +988,159 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error)
 
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Returns the hash and new version number.
-func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
-	version := tree.version + 1
-	if version == 1 && tree.ndb.opts.InitialVersion > 0 {
-		version = int64(tree.ndb.opts.InitialVersion)
+func (tree *MutableTree) SaveVersion() (hash []byte, version int64, err error) {
+	span := tree.ndb.startSpan(SpanSaveVersion)
+	defer func() { span.End(err) }()
+	start := time.Now()
+	if err := tree.checkWritable(); err != nil {
+		return nil, 0, err
+	}
+	if err := tree.waitPendingCommit(); err != nil {
+		return nil, 0, err
+	}
+
+	version = tree.nextVersion()
+	if tree.VersionExists(version) {
+		return tree.resaveExistingVersion(version)
+	}
+
+	savedNodes, written, err := tree.stageVersion(version)
+	if err != nil {
+		return nil, version, err
+	}
+	clearChildNodes(savedNodes)
+
+	if err := tree.ndb.Commit(); err != nil {
+		return nil, version, err
+	}
+
+	tree.setSavedVersion(version)
+
+	hash, err = tree.Hash()
+	if err != nil {
+		return nil, version, err
+	}
+
+	tree.ndb.opts.Metrics.ObserveSaveVersion(time.Since(start), written)
+	return hash, version, nil
+}
+
+// SaveVersionAsync saves a new tree version like SaveVersion, but returns as soon as the root
+// hash is computed and the version is staged in the batch. Writing the batch to disk happens on a
+// background goroutine, tracked by the returned CommitHandle.
+//
+// The working tree can be modified right away, e.g. to execute the next block, while the version
+// is being written; the new version is served from memory until it is durable. Saving the next
+// version, deleting versions and loading the tree wait for the write to finish first. If the write
+// failed, they return its error until the tree is reloaded with LoadVersion.
+func (tree *MutableTree) SaveVersionAsync() (*CommitHandle, error) {
+	start := time.Now()
+	if err := tree.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := tree.waitPendingCommit(); err != nil {
+		return nil, err
 	}
 
+	version := tree.nextVersion()
 	if tree.VersionExists(version) {
-		// If the version already exists, return an error as we're attempting to overwrite.
-		// However, the same hash means idempotent (i.e. no-op).
-		existingHash, err := tree.ndb.getRoot(version)
+		hash, version, err := tree.resaveExistingVersion(version)
 		if err != nil {
-			return nil, version, err
+			return nil, err
 		}
+		return newCommitHandle(version, hash), nil
+	}
 
-		// If the existing root hash is empty (because the tree is empty), then we need to
-		// compare with the hash of an empty input which is what `WorkingHash()` returns.
-		if len(existingHash) == 0 {
-			existingHash = sha256.New().Sum(nil)
-		}
+	savedNodes, written, err := tree.stageVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &CommitHandle{
+		version:           version,
+		done:              make(chan struct{}),
+		savedNodes:        savedNodes,
+		fastNodeAdditions: tree.unsavedFastNodeAdditions,
+		fastNodeRemovals:  tree.unsavedFastNodeRemovals,
+	}
+	batch := tree.ndb.detachBatch()
+
+	tree.setSavedVersion(version)
+
+	handle.hash, err = tree.Hash()
+	if err != nil {
+		batch.Close()
+		return nil, err
+	}
+
+	tree.mtx.Lock()
+	tree.pendingCommit = handle
+	tree.mtx.Unlock()
 
-		newHash, err := tree.WorkingHash()
+	go handle.write(tree.ndb, batch)
+
+	tree.ndb.opts.Metrics.ObserveSaveVersion(time.Since(start), written)
+	return handle, nil
+}
+
+// nextVersion returns the version number the working tree will be saved as.
+func (tree *MutableTree) nextVersion() int64 {
+	version := tree.version + 1
+	if version == 1 && tree.ndb.opts.InitialVersion > 0 {
+		version = int64(tree.ndb.opts.InitialVersion)
+	}
+	return version
+}
+
+// resaveExistingVersion handles saving a version which already exists on disk.
+func (tree *MutableTree) resaveExistingVersion(version int64) ([]byte, int64, error) {
+	// If the version already exists, return an error as we're attempting to overwrite.
+	// However, the same hash means idempotent (i.e. no-op).
+	existingHash, err := tree.ndb.getRootHash(version)
+	if err != nil {
+		return nil, version, err
+	}
+
+	// If the existing root hash is empty (because the tree is empty), then we need to
+	// compare with the hash of an empty input which is what `WorkingHash()` returns.
+	if len(existingHash) == 0 {
+		hasher, err := tree.ndb.nodeHasher()
 		if err != nil {
 			return nil, version, err
 		}
-
-		if bytes.Equal(existingHash, newHash) {
-			tree.version = version
-			tree.ImmutableTree = tree.ImmutableTree.clone()
-			tree.lastSaved = tree.ImmutableTree.clone()
-			tree.orphans = map[string]int64{}
-			return existingHash, version, nil
+		if existingHash, err = hasher.sum(nil); err != nil {
+			return nil, version, err
 		}
+	}
 
-		return nil, version, fmt.Errorf("version %d was already saved to different hash %X (existing hash %X)", version, newHash, existingHash)
+	newHash, err := tree.WorkingHash()
+	if err != nil {
+		return nil, version, err
+	}
+
+	if bytes.Equal(existingHash, newHash) {
+		tree.version = version
+		tree.ImmutableTree = tree.ImmutableTree.clone()
+		tree.lastSaved = tree.ImmutableTree.clone()
+		tree.resetSavepoints()
+		return existingHash, version, nil
 	}
 
+	return nil, version, fmt.Errorf("version %d was already saved to different hash %X (existing hash %X)", version, newHash, existingHash)
+}
+
+// stageVersion writes the working tree and the fast node changes to the nodeDB
+// batch as the given version, without committing the batch. It returns the nodes written whose
+// child pointers are left in place, see saveBranch, and the number of nodes written.
+func (tree *MutableTree) stageVersion(version int64) (savedNodes []*Node, written int, err error) {
 	if tree.root == nil {
-		// There can still be orphans, for example if the root is the node being
-		// removed.
-		logger.Debug("SAVE EMPTY TREE %v\n", version)
-		if err := tree.ndb.SaveOrphans(version, tree.orphans); err != nil {
-			return nil, 0, err
-		}
+		tree.ndb.opts.Logger.Debug("saving empty version", "version", version)
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
 			return nil, 0, err
 		}
 	} else {
-		logger.Debug("SAVE TREE %v\n", version)
-		if _, err := tree.ndb.SaveBranch(tree.root); err != nil {
-			return nil, 0, err
-		}
-		if err := tree.ndb.SaveOrphans(version, tree.orphans); err != nil {
+		tree.ndb.opts.Logger.Debug("saving version", "version", version)
+		if savedNodes, written, err = tree.ndb.saveBranch(tree.root, version); err != nil {
 			return nil, 0, err
 		}
 		if err := tree.ndb.SaveRoot(tree.root, version); err != nil {
@@ -890,14 +1150,19 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 
 	if !tree.skipFastStorageUpgrade {
 		if err := tree.saveFastNodeVersion(); err != nil {
-			return nil, version, err
+			return nil, 0, err
 		}
 	}
 
-	if err := tree.ndb.Commit(); err != nil {
-		return nil, version, err
-	}
+	// The saved tree shares all nodes of the previous one except the orphaned ones, and
+	// references the saved nodes in addition.
+	tree.ndb.opts.Metrics.AddOrphansWritten(nodeCount(tree.lastSaved.root) + written - nodeCount(tree.root))
+	return savedNodes, written, nil
+}
 
+// setSavedVersion makes the working tree the latest saved version, and starts a new working tree
+// on top of it.
+func (tree *MutableTree) setSavedVersion(version int64) {
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 	tree.version = version
@@ -906,18 +1171,67 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 	// set new working tree
 	tree.ImmutableTree = tree.ImmutableTree.clone()
 	tree.lastSaved = tree.ImmutableTree.clone()
-	tree.orphans = map[string]int64{}
 	if !tree.skipFastStorageUpgrade {
 		tree.unsavedFastNodeAdditions = make(map[string]*fastnode.Node)
 		tree.unsavedFastNodeRemovals = make(map[string]interface{})
 	}
+	tree.resetSavepoints()
+}
 
-	hash, err := tree.Hash()
-	if err != nil {
-		return nil, version, err
+// waitPendingCommit waits for the version saved by SaveVersionAsync, if any, to be written to
+// disk. It must be called before any operation which relies on the latest version being on disk.
+// A failed write is returned on every call, since the tree no longer matches the disk.
+func (tree *MutableTree) waitPendingCommit() error {
+	pending := tree.pendingCommit
+	if pending == nil {
+		return nil
+	}
+	if err := pending.Wait(); err != nil {
+		return fmt.Errorf("failed to commit version %d: %w", pending.version, err)
 	}
+	clearChildNodes(pending.savedNodes)
 
-	return hash, version, nil
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	tree.pendingCommit = nil
+	return nil
+}
+
+// discardPendingCommit waits for the pending commit like waitPendingCommit, but drops it even if
+// the write failed. It is used before reloading the tree from disk.
+func (tree *MutableTree) discardPendingCommit() {
+	pending := tree.pendingCommit
+	if pending == nil {
+		return
+	}
+	failed := pending.Wait() != nil
+	if failed {
+		// The version never made it to disk, so forget about it.
+		pending.discard(tree.ndb)
+	} else {
+		clearChildNodes(pending.savedNodes)
+	}
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	tree.pendingCommit = nil
+	if failed {
+		delete(tree.versions, pending.version)
+	}
+}
+
+// waitForVersion blocks until the given version is on disk, in case it is being written by
+// SaveVersionAsync. Unlike waitPendingCommit, it is safe to call concurrently with the tree
+// being modified.
+func (tree *MutableTree) waitForVersion(version int64) error {
+	tree.mtx.Lock()
+	pending := tree.pendingCommit
+	tree.mtx.Unlock()
+
+	if pending != nil && pending.version == version {
+		return pending.Wait()
+	}
+	return nil
 }
 
 func (tree *MutableTree) saveFastNodeVersion() error {
@@ -943,6 +1257,7 @@ func (tree *MutableTree) getUnsavedFastNodeRemovals() map[string]interface{} {
 
 func (tree *MutableTree) addUnsavedAddition(key []byte, node *fastnode.Node) {
 	skey := ibytes.UnsafeBytesToStr(key)
+	tree.journalFastNode(skey)
 	delete(tree.unsavedFastNodeRemovals, skey)
 	tree.unsavedFastNodeAdditions[skey] = node
 }
@@ -964,6 +1279,7 @@ func (tree *MutableTree) saveFastNodeAdditions() error {
 
 func (tree *MutableTree) addUnsavedRemoval(key []byte) {
 	skey := ibytes.UnsafeBytesToStr(key)
+	tree.journalFastNode(skey)
 	delete(tree.unsavedFastNodeAdditions, skey)
 	tree.unsavedFastNodeRemovals[skey] = true
 }
@@ -984,6 +1300,13 @@ func (tree *MutableTree) saveFastNodeRemovals() error {
 }
 
 func (tree *MutableTree) deleteVersion(version int64) error {
+	if err := tree.checkWritable(); err != nil {
+		return err
+	}
+	if err := tree.waitPendingCommit(); err != nil {
+		return err
+	}
+
 	if version <= 0 {
 		return errors.New("version must be greater than 0")
 	}
@@ -1010,8 +1333,6 @@ func (tree *MutableTree) SetInitialVersion(version uint64) {
 // DeleteVersions deletes a series of versions from the MutableTree.
 // Deprecated: please use DeleteVersionsRange instead.
 func (tree *MutableTree) DeleteVersions(versions ...int64) error {
-	logger.Debug("DELETING VERSIONS: %v\n", versions)
-
 	if len(versions) == 0 {
 		return nil
 	}
@@ -1042,8 +1363,18 @@ func (tree *MutableTree) DeleteVersions(versions ...int64) error {
 // DeleteVersionsRange removes versions from an interval from the MutableTree (not inclusive).
 // An error is returned if any single version has active readers.
 // All writes happen in a single batch with a single commit.
-func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error {
-	if err := tree.ndb.DeleteVersionsRange(fromVersion, toVersion); err != nil {
+func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) (err error) {
+	span := tree.ndb.startSpan(SpanDeleteVersionsRange, "fromVersion", fromVersion, "toVersion", toVersion)
+	defer func() { span.End(err) }()
+	if err := tree.checkWritable(); err != nil {
+		return err
+	}
+	if err := tree.waitPendingCommit(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if err := tree.ndb.DeleteVersionsRange(fromVersion, toVersion, span); err != nil {
 		return err
 	}
 
@@ -1051,6 +1382,8 @@ func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error
 		return err
 	}
 
+	tree.ndb.opts.Metrics.ObserveDeleteVersion(time.Since(start))
+
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 	for version := fromVersion; version < toVersion; version++ {
@@ -1060,11 +1393,48 @@ func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error
 	return nil
 }
 
+// DeleteVersionsRangeContext is like DeleteVersionsRange, but deletes the versions one at a time,
+// each with its own commit, and stops before deleting the next version once the given context is
+// done, returning the error of the context. The versions deleted until then remain deleted.
+func (tree *MutableTree) DeleteVersionsRangeContext(ctx context.Context, fromVersion, toVersion int64) (err error) {
+	span := tree.ndb.startSpan(SpanDeleteVersionsRange, "fromVersion", fromVersion, "toVersion", toVersion)
+	defer func() { span.End(err) }()
+	if err := tree.checkWritable(); err != nil {
+		return err
+	}
+	if err := tree.waitPendingCommit(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	versions, err := tree.ndb.deletableVersions(fromVersion, toVersion)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := tree.ndb.DeleteVersionsRange(version, version+1, span); err != nil {
+			return err
+		}
+		if err := tree.ndb.Commit(); err != nil {
+			return err
+		}
+
+		tree.mtx.Lock()
+		delete(tree.versions, version)
+		tree.mtx.Unlock()
+	}
+
+	tree.ndb.opts.Metrics.ObserveDeleteVersion(time.Since(start))
+	return nil
+}
+
 // DeleteVersion deletes a tree version from disk. The version can then no
 // longer be accessed.
 func (tree *MutableTree) DeleteVersion(version int64) error {
-	logger.Debug("DELETE VERSION: %d\n", version)
-
+	start := time.Now()
 	if err := tree.deleteVersion(version); err != nil {
 		return err
 	}
@@ -1072,6 +1442,7 @@ func (tree *MutableTree) DeleteVersion(version int64) error {
 	if err := tree.ndb.Commit(); err != nil {
 		return err
 	}
+	tree.ndb.opts.Metrics.ObserveDeleteVersion(time.Since(start))
 
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
@@ -1099,9 +1470,9 @@ func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node, error) {
 		return nil, nil, err
 	}
 
-	newNoderHash, newNoderCached := newNode.rightHash, newNode.rightNode
-	newNode.rightHash, newNode.rightNode = node.hash, node
-	node.leftHash, node.leftNode = newNoderHash, newNoderCached
+	newNoderHash, newNoderKey, newNoderCached := newNode.rightHash, newNode.rightNodeKey, newNode.rightNode
+	newNode.rightHash, newNode.rightNodeKey, newNode.rightNode = node.hash, node.nodeKey, node
+	node.leftHash, node.leftNodeKey, node.leftNode = newNoderHash, newNoderKey, newNoderCached
 
 	err = node.calcHeightAndSize(tree.ImmutableTree)
 	if err != nil {
@@ -1136,9 +1507,9 @@ func (tree *MutableTree) rotateLeft(node *Node) (*Node, *Node, error) {
 		return nil, nil, err
 	}
 
-	newNodelHash, newNodelCached := newNode.leftHash, newNode.leftNode
-	newNode.leftHash, newNode.leftNode = node.hash, node
-	node.rightHash, node.rightNode = newNodelHash, newNodelCached
+	newNodelHash, newNodelKey, newNodelCached := newNode.leftHash, newNode.leftNodeKey, newNode.leftNode
+	newNode.leftHash, newNode.leftNodeKey, newNode.leftNode = node.hash, node.nodeKey, node
+	node.rightHash, node.rightNodeKey, node.rightNode = newNodelHash, newNodelKey, newNodelCached
 
 	err = node.calcHeightAndSize(tree.ImmutableTree)
 	if err != nil {
@@ -1191,7 +1562,7 @@ func (tree *MutableTree) balance(node *Node, orphans *[]*Node) (newSelf *Node, e
 		if err != nil {
 			return nil, err
 		}
-		node.leftHash = nil
+		node.leftHash, node.leftNodeKey = nil, nil
 		node.leftNode, leftOrphaned, err = tree.rotateLeft(left)
 		if err != nil {
 			return nil, err
@@ -1230,7 +1601,7 @@ func (tree *MutableTree) balance(node *Node, orphans *[]*Node) (newSelf *Node, e
 		if err != nil {
 			return nil, err
 		}
-		node.rightHash = nil
+		node.rightHash, node.rightNodeKey = nil, nil
 		node.rightNode, rightOrphaned, err = tree.rotateRight(right)
 		if err != nil {
 			return nil, err
@@ -1246,17 +1617,3 @@ func (tree *MutableTree) balance(node *Node, orphans *[]*Node) (newSelf *Node, e
 	// Nothing changed
 	return node, nil
 }
-
-func (tree *MutableTree) addOrphans(orphans []*Node) error {
-	for _, node := range orphans {
-		if !node.persisted {
-			// We don't need to orphan nodes that were never persisted.
-			continue
-		}
-		if len(node.hash) == 0 {
-			return fmt.Errorf("expected to find node hash, but was empty")
-		}
-		tree.orphans[ibytes.UnsafeBytesToStr(node.hash)] = node.version
-	}
-	return nil
-}
@@ -2,17 +2,18 @@ package iavl
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"runtime"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/cosmos/iavl/fastnode"
 
-	"github.com/cosmos/iavl/internal/encoding"
 	iavlrand "github.com/cosmos/iavl/internal/rand"
 	"github.com/cosmos/iavl/mock"
 	"github.com/golang/mock/gomock"
@@ -899,6 +900,9 @@ func TestUpgradeStorageToFast_DbErrorConstructor_Failure(t *testing.T) {
 
 	expectedError := errors.New("some db error")
 
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, expectedError).Times(1)
 	dbMock.EXPECT().NewBatch().Return(nil).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
@@ -926,6 +930,9 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 
 	batchMock := mock.NewMockBatch(ctrl)
 
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
@@ -933,7 +940,7 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 	iterMock := mock.NewMockIterator(ctrl)
 	dbMock.EXPECT().Iterator(gomock.Any(), gomock.Any()).Return(iterMock, nil)
 	iterMock.EXPECT().Error()
-	iterMock.EXPECT().Valid().Times(2)
+	iterMock.EXPECT().Valid().Times(1)
 	iterMock.EXPECT().Close()
 
 	batchMock.EXPECT().Set(gomock.Any(), gomock.Any()).Return(expectedError).Times(1)
@@ -966,7 +973,7 @@ func TestFastStorageReUpgradeProtection_NoForceUpgrade_Success(t *testing.T) {
 	const latestTreeVersion = latestFastStorageVersionOnDisk
 
 	// Setup fake reverse iterator db to traverse root versions, called by ndb's getLatestVersion
-	expectedStorageVersion := []byte(fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(latestFastStorageVersionOnDisk))
+	expectedStorageVersion := []byte(strconv.Itoa(latestFastStorageVersionOnDisk))
 
 	// rIterMock is used to get the latest version from disk. We are mocking that rIterMock returns latestTreeVersion from disk
 	rIterMock.EXPECT().Valid().Return(true).Times(1)
@@ -975,6 +982,9 @@ func TestFastStorageReUpgradeProtection_NoForceUpgrade_Success(t *testing.T) {
 
 	batchMock := mock.NewMockBatch(ctrl)
 
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
@@ -1016,13 +1026,16 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 	const latestTreeVersion = latestFastStorageVersionOnDisk + 1
 
 	// Setup db for iterator and reverse iterator mocks
-	expectedStorageVersion := []byte(fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(latestFastStorageVersionOnDisk))
+	expectedStorageVersion := []byte(strconv.Itoa(latestFastStorageVersionOnDisk))
 
 	// Setup fake reverse iterator db to traverse root versions, called by ndb's getLatestVersion
 	// rItr, err := db.ReverseIterator(rootKeyFormat.Key(1), rootKeyFormat.Key(latestTreeVersion + 1))
 	// require.NoError(t, err)
 
 	// dbMock represents the underlying database under the hood of nodeDB
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(3)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
@@ -1044,32 +1057,20 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 	copy(updatedExpectedStorageVersion, expectedStorageVersion)
 	updatedExpectedStorageVersion[len(updatedExpectedStorageVersion)-1]++
 	batchMock.EXPECT().Delete(fastKeyFormat.Key(fastNodeKeyToDelete)).Return(nil).Times(1)
-	batchMock.EXPECT().Set(metadataKeyFormat.Key([]byte(storageVersionKey)), updatedExpectedStorageVersion).Return(nil).Times(1)
+	batchMock.EXPECT().Set(migrationKey(fastStorageMigrationID), updatedExpectedStorageVersion).Return(nil).Times(1)
 	batchMock.EXPECT().Write().Return(nil).Times(2)
 	batchMock.EXPECT().Close().Return(nil).Times(2)
 
-	// iterMock is used to mock the underlying db iterator behing fast iterator
+	// iterMock is used to mock the underlying db iterator over the fast node keys
 	// Here, we want to mock the behavior of deleting fast nodes from disk when
 	// force upgrade is detected.
 	iterMock.EXPECT().Valid().Return(true).Times(1)
-	iterMock.EXPECT().Error().Return(nil).Times(1)
 	iterMock.EXPECT().Key().Return(fastKeyFormat.Key(fastNodeKeyToDelete)).Times(1)
-	// encode value
-	var buf bytes.Buffer
-	testValue := "test_value"
-	buf.Grow(encoding.EncodeVarintSize(int64(latestFastStorageVersionOnDisk)) + encoding.EncodeBytesSize([]byte(testValue)))
-	err := encoding.EncodeVarint(&buf, int64(latestFastStorageVersionOnDisk))
-	require.NoError(t, err)
-	err = encoding.EncodeBytes(&buf, []byte(testValue))
-	require.NoError(t, err)
-	iterMock.EXPECT().Value().Return(buf.Bytes()).Times(1) // this is encoded as version 1 with value "2"
-	iterMock.EXPECT().Valid().Return(true).Times(1)
 	// Call Next at the end of loop iteration
 	iterMock.EXPECT().Next().Return().Times(1)
-	iterMock.EXPECT().Error().Return(nil).Times(1)
-	iterMock.EXPECT().Valid().Return(false).Times(1)
 	// Call Valid after first iteraton
 	iterMock.EXPECT().Valid().Return(false).Times(1)
+	iterMock.EXPECT().Error().Return(nil).Times(1)
 	iterMock.EXPECT().Close().Return(nil).Times(1)
 
 	tree, err := NewMutableTree(dbMock, 0, false)
@@ -1516,3 +1517,290 @@ func TestNoFastStorageUpgrade_Integration_SaveVersion_Load_Iterate_Success(t *te
 		})
 	})
 }
+
+// blockingDB holds back batch writes until release is closed.
+type blockingDB struct {
+	db.DB
+	release chan struct{}
+}
+
+func (bdb *blockingDB) NewBatch() db.Batch {
+	return &blockingBatch{Batch: bdb.DB.NewBatch(), db: bdb}
+}
+
+type blockingBatch struct {
+	db.Batch
+	db *blockingDB
+}
+
+func (b *blockingBatch) Write() error {
+	<-b.db.release
+	return b.Batch.Write()
+}
+
+func (b *blockingBatch) WriteSync() error {
+	<-b.db.release
+	return b.Batch.WriteSync()
+}
+
+func TestMutableTree_SaveVersionAsync(t *testing.T) {
+	syncTree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	asyncTree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	r := iavlrand.NewRand()
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 200; i++ {
+			key := []byte(strconv.Itoa(r.Intn(500)))
+			if r.Intn(4) == 0 {
+				_, _, err = syncTree.Remove(key)
+				require.NoError(t, err)
+				_, _, err = asyncTree.Remove(key)
+				require.NoError(t, err)
+			} else {
+				value := []byte(strconv.Itoa(r.Int()))
+				_, err = syncTree.Set(key, value)
+				require.NoError(t, err)
+				_, err = asyncTree.Set(key, value)
+				require.NoError(t, err)
+			}
+		}
+
+		hash, version, err := syncTree.SaveVersion()
+		require.NoError(t, err)
+		handle, err := asyncTree.SaveVersionAsync()
+		require.NoError(t, err)
+		require.Equal(t, version, handle.Version())
+		require.Equal(t, hash, handle.Hash())
+	}
+	require.NoError(t, asyncTree.waitPendingCommit())
+
+	reloaded, err := NewMutableTree(asyncTree.ndb.db, 0, false)
+	require.NoError(t, err)
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, version)
+
+	for v := int64(1); v <= 10; v++ {
+		expected, err := syncTree.GetImmutable(v)
+		require.NoError(t, err)
+		actual, err := reloaded.GetImmutable(v)
+		require.NoError(t, err)
+		expectedHash, err := expected.Hash()
+		require.NoError(t, err)
+		actualHash, err := actual.Hash()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, actualHash)
+	}
+}
+
+func TestMutableTree_SaveVersionAsync_ReadsWhilePending(t *testing.T) {
+	bdb := &blockingDB{DB: db.NewMemDB(), release: make(chan struct{})}
+	close(bdb.release)
+	tree, err := NewMutableTree(bdb, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Hold back the write of version 2.
+	bdb.release = make(chan struct{})
+
+	_, err = tree.Set([]byte{1}, []byte("updated"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte{20}, []byte{20})
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte{2})
+	require.NoError(t, err)
+	handle, err := tree.SaveVersionAsync()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, handle.Version())
+
+	select {
+	case <-handle.Done():
+		t.Fatal("commit finished before the write was released")
+	default:
+	}
+
+	// Version 2 is served from memory, and the next block can be executed on top of it.
+	_, err = tree.Set([]byte{3}, []byte("next"))
+	require.NoError(t, err)
+
+	value, err := tree.Get([]byte{1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+	value, err = tree.Get([]byte{2})
+	require.NoError(t, err)
+	require.Nil(t, value)
+	value, err = tree.Get([]byte{3})
+	require.NoError(t, err)
+	require.Equal(t, []byte("next"), value)
+
+	keys := [][]byte{}
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		keys = append(keys, key)
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{0}, {1}, {3}, {4}, {5}, {6}, {7}, {8}, {9}, {20}}, keys)
+
+	close(bdb.release)
+	require.NoError(t, handle.Wait())
+
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	value, err = itree.Get([]byte{3})
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, value)
+	value, err = itree.Get([]byte{2})
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+// failingBatchDB fails batch writes while fail is set.
+type failingBatchDB struct {
+	db.DB
+	fail *int32
+}
+
+func (fdb failingBatchDB) NewBatch() db.Batch {
+	return failingBatch{Batch: fdb.DB.NewBatch(), fail: fdb.fail}
+}
+
+type failingBatch struct {
+	db.Batch
+	fail *int32
+}
+
+var errBatchWrite = errors.New("batch write failed")
+
+func (b failingBatch) Write() error {
+	if atomic.LoadInt32(b.fail) == 1 {
+		return errBatchWrite
+	}
+	return b.Batch.Write()
+}
+
+func (b failingBatch) WriteSync() error {
+	if atomic.LoadInt32(b.fail) == 1 {
+		return errBatchWrite
+	}
+	return b.Batch.WriteSync()
+}
+
+func TestMutableTree_SaveVersionAsync_Discard(t *testing.T) {
+	var fail int32
+	tree, err := NewMutableTree(failingBatchDB{DB: db.NewMemDB(), fail: &fail}, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// A durable version is kept when the pending commit is discarded.
+	_, err = tree.Set([]byte{1}, []byte("two"))
+	require.NoError(t, err)
+	handle, err := tree.SaveVersionAsync()
+	require.NoError(t, err)
+	require.NoError(t, handle.Wait())
+	_, err = tree.LazyLoadVersion(1)
+	require.NoError(t, err)
+	require.True(t, tree.VersionExists(2))
+
+	// A failed commit leaves no trace of the version in memory.
+	_, err = tree.LoadVersion(2)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte{1}, []byte("three"))
+	require.NoError(t, err)
+	atomic.StoreInt32(&fail, 1)
+	handle, err = tree.SaveVersionAsync()
+	require.NoError(t, err)
+	require.ErrorIs(t, handle.Wait(), errBatchWrite)
+	require.Equal(t, int64(3), tree.ndb.fastStorageVersion)
+	atomic.StoreInt32(&fail, 0)
+
+	version, err := tree.LoadVersion(0)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.False(t, tree.VersionExists(3))
+	require.Equal(t, int64(2), tree.ndb.fastStorageVersion)
+	for _, node := range handle.savedNodes {
+		require.False(t, tree.ndb.nodeCache.Has(node.GetKey()))
+	}
+	require.Nil(t, tree.ndb.fastNodeCache.Get([]byte{1}))
+	value, err := tree.Get([]byte{1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("two"), value)
+}
+
+func TestMutableTree_ReadOnly(t *testing.T) {
+	memDB := db.NewMemDB()
+	writer, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for v := 1; v <= 3; v++ {
+		_, err := writer.Set([]byte("key"), []byte{byte(v)})
+		require.NoError(t, err)
+		_, _, err = writer.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// Saving a version without fast storage leaves the fast node index behind.
+	writer, err = NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	_, err = writer.Load()
+	require.NoError(t, err)
+	_, err = writer.Set([]byte("key"), []byte{4})
+	require.NoError(t, err)
+	_, _, err = writer.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err := NewMutableTreeWithOpts(writeFailingDB{memDB}, 0, &Options{ReadOnly: true}, false)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+
+	// Internal write paths are rejected by the batch rather than reaching the database.
+	require.ErrorIs(t, tree.ndb.SaveFastNode(fastnode.NewNode([]byte("key"), []byte{5}, 5)), ErrReadOnly)
+	require.ErrorIs(t, tree.ndb.DeleteFastNode([]byte("key")), ErrReadOnly)
+	require.ErrorIs(t, tree.ndb.setMigrationToBatch(tree.ndb.batch, fastStorageMigrationID, 5), ErrReadOnly)
+	require.ErrorIs(t, tree.ndb.Commit(), ErrReadOnly)
+
+	// The stale fast node index is ignored rather than rebuilt.
+	value, err := tree.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, value)
+	isFastCacheEnabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.False(t, isFastCacheEnabled)
+
+	_, err = tree.Set([]byte("key"), []byte{5})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = tree.SaveVersionAsync()
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, tree.DeleteVersion(1), ErrReadOnly)
+	require.ErrorIs(t, tree.DeleteVersionsRange(1, 3), ErrReadOnly)
+	_, err = tree.LoadVersionForOverwriting(2)
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, tree.upgradeFastStorage(context.Background()), ErrReadOnly)
+
+	empty, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{ReadOnly: true}, false)
+	require.NoError(t, err)
+	_, err = empty.Import(1)
+	require.ErrorIs(t, err, ErrReadOnly)
+}
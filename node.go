@@ -5,7 +5,6 @@ package iavl
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -17,12 +16,20 @@ import (
 )
 
 // Node represents a node in a Tree.
+//
+// The nodeKey is the reference under which the node is stored by the nodeDB, and the child
+// node keys reference the children. In the hash-keyed storage layout they are equal to the
+// respective hashes, in the version-keyed layout they are built by makeVersionedNodeKey. They
+// are only set once the node has been (or is being) persisted.
 type Node struct {
 	key           []byte
 	value         []byte
 	hash          []byte
+	nodeKey       []byte
 	leftHash      []byte
 	rightHash     []byte
+	leftNodeKey   []byte
+	rightNodeKey  []byte
 	version       int64
 	size          int64
 	leftNode      *Node
@@ -49,31 +56,102 @@ func NewNode(key []byte, value []byte, version int64) *Node {
 // The new node doesn't have its hash saved or set. The caller must set it
 // afterwards.
 func MakeNode(buf []byte) (*Node, error) {
+	node, buf, err := decodeNodeHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read node body.
+
+	if node.isLeaf() {
+		val, _, cause := encoding.DecodeBytes(buf)
+		if cause != nil {
+			return nil, fmt.Errorf("decoding node.value, %w", cause)
+		}
+		node.value = val
+	} else { // Read children.
+		leftHash, n, cause := encoding.DecodeBytes(buf)
+		if cause != nil {
+			return nil, fmt.Errorf("deocding node.leftHash, %w", cause)
+		}
+		buf = buf[n:]
+
+		rightHash, _, cause := encoding.DecodeBytes(buf)
+		if cause != nil {
+			return nil, fmt.Errorf("decoding node.rightHash, %w", cause)
+		}
+		node.leftHash = leftHash
+		node.rightHash = rightHash
+	}
+	return node, nil
+}
+
+// makeVersionedNode constructs an *Node from a byte slice encoded by writeVersionedBytes.
+//
+// Unlike MakeNode, the node hash is part of the encoding and is set. The caller must set the
+// node key afterwards.
+func makeVersionedNode(buf []byte) (*Node, error) {
+	node, buf, err := decodeNodeHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, n, cause := encoding.DecodeBytes(buf)
+	if cause != nil {
+		return nil, fmt.Errorf("decoding node.hash, %w", cause)
+	}
+	buf = buf[n:]
+	node.hash = hash
+
+	if node.isLeaf() {
+		val, _, cause := encoding.DecodeBytes(buf)
+		if cause != nil {
+			return nil, fmt.Errorf("decoding node.value, %w", cause)
+		}
+		node.value = val
+		return node, nil
+	}
+
+	children := []*[]byte{&node.leftHash, &node.leftNodeKey, &node.rightHash, &node.rightNodeKey}
+	for _, child := range children {
+		bz, n, cause := encoding.DecodeBytes(buf)
+		if cause != nil {
+			return nil, fmt.Errorf("decoding node children, %w", cause)
+		}
+		buf = buf[n:]
+		*child = bz
+	}
+	return node, nil
+}
+
+// decodeNodeHeader decodes the fields common to all node encodings (height, size, version, key),
+// returning the partially decoded node and the remaining bytes.
+func decodeNodeHeader(buf []byte) (*Node, []byte, error) {
 	// Read node header (height, size, version, key).
 	height, n, cause := encoding.DecodeVarint(buf)
 	if cause != nil {
-		return nil, fmt.Errorf("decoding node.height, %w", cause)
+		return nil, nil, fmt.Errorf("decoding node.height, %w", cause)
 	}
 	buf = buf[n:]
 	if height < int64(math.MinInt8) || height > int64(math.MaxInt8) {
-		return nil, errors.New("invalid height, must be int8")
+		return nil, nil, errors.New("invalid height, must be int8")
 	}
 
 	size, n, cause := encoding.DecodeVarint(buf)
 	if cause != nil {
-		return nil, fmt.Errorf("decoding node.size, %w", cause)
+		return nil, nil, fmt.Errorf("decoding node.size, %w", cause)
 	}
 	buf = buf[n:]
 
 	ver, n, cause := encoding.DecodeVarint(buf)
 	if cause != nil {
-		return nil, fmt.Errorf("decoding node.version, %w", cause)
+		return nil, nil, fmt.Errorf("decoding node.version, %w", cause)
 	}
 	buf = buf[n:]
 
 	key, n, cause := encoding.DecodeBytes(buf)
 	if cause != nil {
-		return nil, fmt.Errorf("decoding node.key, %w", cause)
+		return nil, nil, fmt.Errorf("decoding node.key, %w", cause)
 	}
 	buf = buf[n:]
 
@@ -83,34 +161,12 @@ func MakeNode(buf []byte) (*Node, error) {
 		version:       ver,
 		key:           key,
 	}
-
-	// Read node body.
-
-	if node.isLeaf() {
-		val, _, cause := encoding.DecodeBytes(buf)
-		if cause != nil {
-			return nil, fmt.Errorf("decoding node.value, %w", cause)
-		}
-		node.value = val
-	} else { // Read children.
-		leftHash, n, cause := encoding.DecodeBytes(buf)
-		if cause != nil {
-			return nil, fmt.Errorf("deocding node.leftHash, %w", cause)
-		}
-		buf = buf[n:]
-
-		rightHash, _, cause := encoding.DecodeBytes(buf)
-		if cause != nil {
-			return nil, fmt.Errorf("decoding node.rightHash, %w", cause)
-		}
-		node.leftHash = leftHash
-		node.rightHash = rightHash
-	}
-	return node, nil
+	return node, buf, nil
 }
 
+// GetKey returns the reference the node is stored and cached under.
 func (node *Node) GetKey() []byte {
-	return node.hash
+	return node.nodeKey
 }
 
 // String returns a string representation of the node.
@@ -138,9 +194,12 @@ func (node *Node) clone(version int64) (*Node, error) {
 		version:       version,
 		size:          node.size,
 		hash:          nil,
+		nodeKey:       nil,
 		leftHash:      node.leftHash,
+		leftNodeKey:   node.leftNodeKey,
 		leftNode:      node.leftNode,
 		rightHash:     node.rightHash,
+		rightNodeKey:  node.rightNodeKey,
 		rightNode:     node.rightNode,
 		persisted:     false,
 	}, nil
@@ -241,21 +300,20 @@ func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value [
 
 // Computes the hash of the node without computing its descendants. Must be
 // called on nodes which have descendant node hashes already computed.
-func (node *Node) _hash() ([]byte, error) {
+func (node *Node) _hash(hasher Hasher) ([]byte, error) {
 	if node.hash != nil {
 		return node.hash, nil
 	}
 
-	h := sha256.New()
 	buf := new(bytes.Buffer)
-	if err := node.writeHashBytes(buf); err != nil {
+	if err := node.writeHashBytes(buf, hasher); err != nil {
 		return nil, err
 	}
-	_, err := h.Write(buf.Bytes())
+	hash, err := hasher.sum(buf.Bytes())
 	if err != nil {
 		return nil, err
 	}
-	node.hash = h.Sum(nil)
+	node.hash = hash
 
 	return node.hash, nil
 }
@@ -264,25 +322,25 @@ func (node *Node) _hash() ([]byte, error) {
 // descendant nodes. Returns the node hash and number of nodes hashed.
 // If the tree is empty (i.e. the node is nil), returns the hash of an empty input,
 // to conform with RFC-6962.
-func (node *Node) hashWithCount() ([]byte, int64, error) {
+func (node *Node) hashWithCount(hasher Hasher) ([]byte, int64, error) {
 	if node == nil {
-		return sha256.New().Sum(nil), 0, nil
+		hash, err := hasher.sum(nil)
+		return hash, 0, err
 	}
 	if node.hash != nil {
 		return node.hash, 0, nil
 	}
 
-	h := sha256.New()
 	buf := new(bytes.Buffer)
-	hashCount, err := node.writeHashBytesRecursively(buf)
+	hashCount, err := node.writeHashBytesRecursively(buf, hasher)
 	if err != nil {
 		return nil, 0, err
 	}
-	_, err = h.Write(buf.Bytes())
+	hash, err := hasher.sum(buf.Bytes())
 	if err != nil {
 		return nil, 0, err
 	}
-	node.hash = h.Sum(nil)
+	node.hash = hash
 
 	return node.hash, hashCount + 1, nil
 }
@@ -330,7 +388,7 @@ func (node *Node) validate() error {
 
 // Writes the node's hash to the given io.Writer. This function expects
 // child hashes to be already set.
-func (node *Node) writeHashBytes(w io.Writer) error {
+func (node *Node) writeHashBytes(w io.Writer, hasher Hasher) error {
 	err := encoding.EncodeVarint(w, int64(node.subtreeHeight))
 	if err != nil {
 		return fmt.Errorf("writing height, %w", err)
@@ -354,9 +412,12 @@ func (node *Node) writeHashBytes(w io.Writer) error {
 
 		// Indirection needed to provide proofs without values.
 		// (e.g. ProofLeafNode.ValueHash)
-		valueHash := sha256.Sum256(node.value)
+		valueHash, err := hasher.sum(node.value)
+		if err != nil {
+			return err
+		}
 
-		err = encoding.EncodeBytes(w, valueHash[:])
+		err = encoding.EncodeBytes(w, valueHash)
 		if err != nil {
 			return fmt.Errorf("writing value, %w", err)
 		}
@@ -379,9 +440,9 @@ func (node *Node) writeHashBytes(w io.Writer) error {
 
 // Writes the node's hash to the given io.Writer.
 // This function has the side-effect of calling hashWithCount.
-func (node *Node) writeHashBytesRecursively(w io.Writer) (hashCount int64, err error) {
+func (node *Node) writeHashBytesRecursively(w io.Writer, hasher Hasher) (hashCount int64, err error) {
 	if node.leftNode != nil {
-		leftHash, leftCount, err := node.leftNode.hashWithCount()
+		leftHash, leftCount, err := node.leftNode.hashWithCount(hasher)
 		if err != nil {
 			return 0, err
 		}
@@ -389,14 +450,14 @@ func (node *Node) writeHashBytesRecursively(w io.Writer) (hashCount int64, err e
 		hashCount += leftCount
 	}
 	if node.rightNode != nil {
-		rightHash, rightCount, err := node.rightNode.hashWithCount()
+		rightHash, rightCount, err := node.rightNode.hashWithCount(hasher)
 		if err != nil {
 			return 0, err
 		}
 		node.rightHash = rightHash
 		hashCount += rightCount
 	}
-	err = node.writeHashBytes(w)
+	err = node.writeHashBytes(w, hasher)
 
 	return
 }
@@ -415,28 +476,32 @@ func (node *Node) encodedSize() int {
 	return n
 }
 
+// versionedEncodedSize returns the size of the encoding written by writeVersionedBytes.
+func (node *Node) versionedEncodedSize() int {
+	n := 1 +
+		encoding.EncodeVarintSize(node.size) +
+		encoding.EncodeVarintSize(node.version) +
+		encoding.EncodeBytesSize(node.key) +
+		encoding.EncodeBytesSize(node.hash)
+	if node.isLeaf() {
+		n += encoding.EncodeBytesSize(node.value)
+	} else {
+		n += encoding.EncodeBytesSize(node.leftHash) +
+			encoding.EncodeBytesSize(node.leftNodeKey) +
+			encoding.EncodeBytesSize(node.rightHash) +
+			encoding.EncodeBytesSize(node.rightNodeKey)
+	}
+	return n
+}
+
 // Writes the node as a serialized byte slice to the supplied io.Writer.
 func (node *Node) writeBytes(w io.Writer) error {
 	if node == nil {
 		return errors.New("cannot write nil node")
 	}
-	cause := encoding.EncodeVarint(w, int64(node.subtreeHeight))
-	if cause != nil {
-		return fmt.Errorf("writing height, %w", cause)
-	}
-	cause = encoding.EncodeVarint(w, node.size)
+	cause := node.writeHeaderBytes(w)
 	if cause != nil {
-		return fmt.Errorf("writing size, %w", cause)
-	}
-	cause = encoding.EncodeVarint(w, node.version)
-	if cause != nil {
-		return fmt.Errorf("writing version, %w", cause)
-	}
-
-	// Unlike writeHashBytes, key is written for inner nodes.
-	cause = encoding.EncodeBytes(w, node.key)
-	if cause != nil {
-		return fmt.Errorf("writing key, %w", cause)
+		return cause
 	}
 
 	if node.isLeaf() {
@@ -464,11 +529,82 @@ func (node *Node) writeBytes(w io.Writer) error {
 	return nil
 }
 
+// Writes the node as a serialized byte slice for the version-keyed storage layout to the
+// supplied io.Writer. Besides the fields written by writeBytes, it contains the node hash and
+// the node keys of the children, since nodes are no longer stored under their hash.
+func (node *Node) writeVersionedBytes(w io.Writer) error {
+	if node == nil {
+		return errors.New("cannot write nil node")
+	}
+	cause := node.writeHeaderBytes(w)
+	if cause != nil {
+		return cause
+	}
+	if node.hash == nil {
+		return ErrHashIsNil
+	}
+	cause = encoding.EncodeBytes(w, node.hash)
+	if cause != nil {
+		return fmt.Errorf("writing hash, %w", cause)
+	}
+
+	if node.isLeaf() {
+		cause = encoding.EncodeBytes(w, node.value)
+		if cause != nil {
+			return fmt.Errorf("writing value, %w", cause)
+		}
+		return nil
+	}
+
+	if node.leftHash == nil {
+		return ErrLeftHashIsNil
+	}
+	if node.leftNodeKey == nil {
+		return ErrLeftNodeKeyIsNil
+	}
+	if node.rightHash == nil {
+		return ErrRightHashIsNil
+	}
+	if node.rightNodeKey == nil {
+		return ErrRightNodeKeyIsNil
+	}
+	for _, bz := range [][]byte{node.leftHash, node.leftNodeKey, node.rightHash, node.rightNodeKey} {
+		cause = encoding.EncodeBytes(w, bz)
+		if cause != nil {
+			return fmt.Errorf("writing children, %w", cause)
+		}
+	}
+	return nil
+}
+
+// writeHeaderBytes writes the fields common to all node encodings (height, size, version, key).
+func (node *Node) writeHeaderBytes(w io.Writer) error {
+	cause := encoding.EncodeVarint(w, int64(node.subtreeHeight))
+	if cause != nil {
+		return fmt.Errorf("writing height, %w", cause)
+	}
+	cause = encoding.EncodeVarint(w, node.size)
+	if cause != nil {
+		return fmt.Errorf("writing size, %w", cause)
+	}
+	cause = encoding.EncodeVarint(w, node.version)
+	if cause != nil {
+		return fmt.Errorf("writing version, %w", cause)
+	}
+
+	// Unlike writeHashBytes, key is written for inner nodes.
+	cause = encoding.EncodeBytes(w, node.key)
+	if cause != nil {
+		return fmt.Errorf("writing key, %w", cause)
+	}
+	return nil
+}
+
 func (node *Node) getLeftNode(t *ImmutableTree) (*Node, error) {
 	if node.leftNode != nil {
 		return node.leftNode, nil
 	}
-	leftNode, err := t.ndb.GetNode(node.leftHash)
+	leftNode, err := t.ndb.getNode(node.leftNodeKey, t.span)
 	if err != nil {
 		return nil, err
 	}
@@ -480,7 +616,7 @@ func (node *Node) getRightNode(t *ImmutableTree) (*Node, error) {
 	if node.rightNode != nil {
 		return node.rightNode, nil
 	}
-	rightNode, err := t.ndb.GetNode(node.rightHash)
+	rightNode, err := t.ndb.getNode(node.rightNodeKey, t.span)
 	if err != nil {
 		return nil, err
 	}
@@ -552,4 +688,8 @@ var (
 	ErrEmptyChildHash = fmt.Errorf("found an empty child hash")
 	ErrLeftHashIsNil  = fmt.Errorf("node.leftHash was nil in writeBytes")
 	ErrRightHashIsNil = fmt.Errorf("node.rightHash was nil in writeBytes")
+	ErrHashIsNil      = fmt.Errorf("node.hash was nil in writeVersionedBytes")
+
+	ErrLeftNodeKeyIsNil  = fmt.Errorf("node.leftNodeKey was nil in writeVersionedBytes")
+	ErrRightNodeKeyIsNil = fmt.Errorf("node.rightNodeKey was nil in writeVersionedBytes")
 )
@@ -0,0 +1,221 @@
+package iavl
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// nodeKeyMigrationKey is the metadata key holding the progress of an interrupted migration to
+// the version-keyed layout, as the last node key assigned.
+const nodeKeyMigrationKey = "node_key_migration"
+
+// While migrating to the version-keyed layout, the node key assigned to each node is indexed by
+// the node hash, so that nodes shared between versions are migrated only once. The index is
+// deleted once the migration completes.
+var nodeKeyIndexFormat = keyformat.NewKeyFormat('h', hashSize) // h<hash>
+
+// migrateToVersionedNodeKeys migrates a database storing nodes by hash to the version-keyed
+// layout. It runs if enabled by Options.VersionKeyedNodes and not done already, see migrations.
+//
+// The versions are migrated in ascending order. Every node reachable from a root is rewritten
+// under a node key made of the version of the root it was first reached from and a sequence
+// number, and the root entries are rewritten to reference the new node keys. The
+// batch is committed every commitGap nodes together with the progress, so an interrupted
+// migration resumes where it stopped, e.g. after the migration stopped at a commit once the
+// context was done. The old nodes are only deleted at the end, which keeps the database readable
+// in the meantime.
+func (ndb *nodeDB) migrateToVersionedNodeKeys(ctx context.Context) error {
+	m := &nodeKeyMigration{
+		ctx:     ctx,
+		ndb:     ndb,
+		batch:   ndb.newBatch(),
+		pending: make(map[string][]byte),
+	}
+	defer func() {
+		m.batch.Close()
+	}()
+
+	if err := m.migrateRoots(); err != nil {
+		return err
+	}
+	for _, prefix := range [][]byte{nodeKeyFormat.Key(), nodeKeyIndexFormat.Key()} {
+		if err := ndb.deletePrefix(ctx, prefix); err != nil {
+			return err
+		}
+	}
+
+	if err := m.batch.Set(metadataKeyFormat.Key([]byte(nodeKeyLayoutKey)), []byte(versionedNodeKeyLayout)); err != nil {
+		return err
+	}
+	if err := m.batch.Delete(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey))); err != nil {
+		return err
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if err := ndb.setMigrationToBatch(m.batch, versionedNodeKeysMigrationID, latestVersion); err != nil {
+		return err
+	}
+	if err := m.commit(); err != nil {
+		return err
+	}
+
+	ndb.versionedNodeKeys = true
+	return nil
+}
+
+// nodeKeyMigration holds the state of migrateToVersionedNodeKeys.
+type nodeKeyMigration struct {
+	ctx   context.Context
+	ndb   *nodeDB
+	batch dbm.Batch
+	size  uint64
+
+	// Node keys assigned since the last commit, indexed by node hash.
+	pending map[string][]byte
+	// The version and nonce of the node key last assigned.
+	version int64
+	nonce   uint32
+}
+
+// migrateRoots migrates the nodes of every version not yet migrated, and rewrites its root.
+func (m *nodeKeyMigration) migrateRoots() error {
+	progress, err := m.ndb.db.Get(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)))
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		if !isVersionedNodeKey(progress) {
+			return fmt.Errorf("invalid node key migration progress %X", progress)
+		}
+		m.version = int64(binary.BigEndian.Uint64(progress))
+		m.nonce = binary.BigEndian.Uint32(progress[int64Size:])
+	}
+
+	roots, err := m.ndb.getRoots()
+	if err != nil {
+		return err
+	}
+	versions := make([]int64, 0, len(roots))
+	for version := range roots {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	for _, version := range versions {
+		rootHash := roots[version]
+		// Empty roots need no migration, and migrated roots reference versioned node keys.
+		if len(rootHash) == 0 || isVersionedNodeKey(rootHash) {
+			continue
+		}
+		if version != m.version {
+			m.version, m.nonce = version, 0
+		}
+		rootKey, err := m.migrateNode(rootHash)
+		if err != nil {
+			return err
+		}
+		if err := m.batch.Set(m.ndb.rootKey(version), rootKey); err != nil {
+			return err
+		}
+	}
+	return m.commitProgress()
+}
+
+// migrateNode migrates the node with the given hash and all of its descendants which have not
+// been migrated yet, and returns its new node key.
+func (m *nodeKeyMigration) migrateNode(hash []byte) ([]byte, error) {
+	if nodeKey, ok := m.pending[string(hash)]; ok {
+		return nodeKey, nil
+	}
+	nodeKey, err := m.ndb.db.Get(nodeKeyIndexFormat.KeyBytes(hash))
+	if err != nil || nodeKey != nil {
+		return nodeKey, err
+	}
+
+	buf, err := m.ndb.db.Get(nodeKeyFormat.KeyBytes(hash))
+	if err != nil {
+		return nil, err
+	}
+	if buf == nil {
+		return nil, fmt.Errorf("node %X not found while migrating node keys", hash)
+	}
+	node, err := m.ndb.decodeNode(hash, buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading node %X, %w", hash, err)
+	}
+
+	if !node.isLeaf() {
+		if node.leftNodeKey, err = m.migrateNode(node.leftHash); err != nil {
+			return nil, err
+		}
+		if node.rightNodeKey, err = m.migrateNode(node.rightHash); err != nil {
+			return nil, err
+		}
+	}
+
+	// The reference to the blob of the node, if any, moves to the new node key.
+	if refKey := m.ndb.blobRefKey(node); refKey != nil {
+		if err := m.batch.Delete(refKey); err != nil {
+			return nil, err
+		}
+	}
+	m.nonce++
+	node.nodeKey = makeVersionedNodeKey(m.version, m.nonce)
+	buf, err = m.ndb.encodeNode(node)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.batch.Set(m.ndb.nodeKey(node.nodeKey), buf); err != nil {
+		return nil, err
+	}
+	if err := m.ndb.saveBlobToBatch(m.batch, node); err != nil {
+		return nil, err
+	}
+	if err := m.batch.Set(nodeKeyIndexFormat.KeyBytes(hash), node.nodeKey); err != nil {
+		return nil, err
+	}
+	m.pending[string(hash)] = node.nodeKey
+
+	m.size++
+	if m.size >= commitGap {
+		if err := m.commitProgress(); err != nil {
+			return nil, err
+		}
+		if err := m.ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return node.nodeKey, nil
+}
+
+// commitProgress commits the batch along with the version and nonce of the node key last
+// assigned, from which an interrupted migration resumes.
+func (m *nodeKeyMigration) commitProgress() error {
+	m.ndb.opts.Logger.Info("migrating nodes to the version-keyed layout", "version", m.version)
+	if m.version > 0 {
+		progress := makeVersionedNodeKey(m.version, m.nonce)
+		if err := m.batch.Set(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)), progress); err != nil {
+			return err
+		}
+	}
+	return m.commit()
+}
+
+// commit writes the batch and starts a new one.
+func (m *nodeKeyMigration) commit() error {
+	if err := m.ndb.writeBatch(m.batch); err != nil {
+		return err
+	}
+	m.batch = m.ndb.newBatch()
+	m.pending = make(map[string][]byte)
+	m.size = 0
+	return nil
+}
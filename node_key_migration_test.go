@@ -0,0 +1,102 @@
+package iavl
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// limitedDB fails every batch write once the given number of writes has succeeded.
+type limitedDB struct {
+	db.DB
+	writes int
+}
+
+func (ldb *limitedDB) NewBatch() db.Batch {
+	return &limitedBatch{Batch: ldb.DB.NewBatch(), db: ldb}
+}
+
+type limitedBatch struct {
+	db.Batch
+	db *limitedDB
+}
+
+var errWriteLimit = errors.New("write limit reached")
+
+func (b *limitedBatch) Write() error {
+	if b.db.writes <= 0 {
+		return errWriteLimit
+	}
+	b.db.writes--
+	return b.Batch.Write()
+}
+
+func (b *limitedBatch) WriteSync() error {
+	return b.Write()
+}
+
+func TestMigrateToVersionedNodeKeys(t *testing.T) {
+	tmpCommitGap := commitGap
+	t.Cleanup(func() {
+		commitGap = tmpCommitGap
+	})
+	commitGap = 50
+
+	expectedTree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(3))
+	for v := int64(1); v <= 12; v++ {
+		applyRandomVersion(t, r, expectedTree, tree)
+		if v%3 == 0 {
+			require.NoError(t, expectedTree.DeleteVersionsRange(v-2, v))
+			require.NoError(t, tree.DeleteVersionsRange(v-2, v))
+		}
+	}
+
+	// Interrupt the migration a few times, it must resume where it stopped.
+	opts := &Options{VersionKeyedNodes: true}
+	for writes := 0; writes < 3; writes++ {
+		tree, err = NewMutableTreeWithOpts(&limitedDB{DB: memDB, writes: writes}, 0, opts, false)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.ErrorIs(t, err, errWriteLimit)
+	}
+	progress, err := memDB.Get(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)))
+	require.NoError(t, err)
+	require.NotNil(t, progress)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	require.Zero(t, countPrefix(t, memDB, nodeKeyFormat.Key()))
+	require.Zero(t, countPrefix(t, memDB, nodeKeyIndexFormat.Key()))
+	progress, err = memDB.Get(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)))
+	require.NoError(t, err)
+	require.Nil(t, progress)
+	layout, err := memDB.Get(metadataKeyFormat.Key([]byte(nodeKeyLayoutKey)))
+	require.NoError(t, err)
+	require.Equal(t, versionedNodeKeyLayout, string(layout))
+	requireSameVersions(t, expectedTree, tree)
+
+	// The migrated tree keeps working, including pruning of versions saved before the migration.
+	for v := 0; v < 5; v++ {
+		hashes := applyRandomVersion(t, r, expectedTree, tree)
+		require.Equal(t, hashes[0], hashes[1])
+	}
+	require.NoError(t, expectedTree.DeleteVersionsRange(1, expectedTree.Version()))
+	require.NoError(t, tree.DeleteVersionsRange(1, tree.Version()))
+	requireSameVersions(t, expectedTree, tree)
+
+	// Only the nodes of the latest version are left.
+	nodes := countPrefix(t, memDB, versionedNodeKeyFormat.Key())
+	require.EqualValues(t, tree.root.size*2-1, nodes)
+}
@@ -2,13 +2,14 @@ package iavl
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 
 	dbm "github.com/cosmos/cosmos-db"
@@ -16,26 +17,30 @@ import (
 	"github.com/cosmos/iavl/cache"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
-	"github.com/cosmos/iavl/internal/logger"
 	"github.com/cosmos/iavl/keyformat"
 )
 
 const (
 	int64Size         = 8
+	int32Size         = 4
 	hashSize          = sha256.Size
 	genesisVersion    = 1
 	storageVersionKey = "storage_version"
-	// We store latest saved version together with storage version delimited by the constant below.
-	// This delimiter is valid only if fast storage is enabled (i.e. storageVersion >= fastStorageVersionValue).
-	// The latest saved version is needed for protection against downgrade and re-upgrade. In such a case, it would
-	// be possible to observe mismatch between the latest version state and the fast nodes on disk.
-	// Therefore, we would like to detect that and overwrite fast nodes on disk with the latest version state.
+	// Earlier releases stored the storage version under storageVersionKey, see
+	// migrateStorageVersion. With fast storage, the latest saved version was stored together with
+	// the storage version, delimited by the constant below.
 	fastStorageVersionDelimiter = "-"
 	// Using semantic versioning: https://semver.org/
 	defaultStorageVersionValue = "1.0.0"
 	fastStorageVersionValue    = "1.1.0"
 	fastNodeCacheSize          = 100000
 	maxVersion                 = int64(math.MaxInt64)
+
+	// The node key layout is recorded in the metadata once nodes are stored by version. Databases
+	// without the entry store nodes by their hash.
+	nodeKeyLayoutKey       = "node_key_layout"
+	versionedNodeKeyLayout = "version"
+	versionedNodeKeySize   = int64Size + int32Size
 )
 
 var (
@@ -43,14 +48,18 @@ var (
 	// possible with the other keys, and makes them easier to traverse. They are indexed by the node hash.
 	nodeKeyFormat = keyformat.NewKeyFormat('n', hashSize) // n<hash>
 
-	// Orphans are keyed in the database by their expected lifetime.
+	// In the version-keyed layout, nodes are prefixed with the byte 's' instead, and indexed by
+	// the version they were saved at and a sequence number (nonce) unique within that version.
+	// Unlike node hashes, these keys preserve the data locality of the nodes of a version.
+	versionedNodeKeyFormat = keyformat.NewKeyFormat('s', int64Size, int32Size) // s<version><nonce>
+
+	// Orphans were keyed in the database by their expected lifetime.
 	// The first number represents the *last* version at which the orphan needs
 	// to exist, while the second number represents the *earliest* version at
 	// which it is expected to exist - which starts out by being the version
 	// of the node being orphaned.
-	// To clarify:
-	// When I write to key {X} with value V and old value O, we orphan O with <last-version>=time of write
-	// and <first-version> = version O was created at.
+	// They are no longer written, since pruning compares the trees of adjacent
+	// versions instead, and existing entries are deleted by deleteOrphanIndex.
 	orphanKeyFormat = keyformat.NewKeyFormat('o', int64Size, int64Size, hashSize) // o<last-version><first-version><hash>
 
 	// Key Format for making reads and iterates go through a data-locality preserving db.
@@ -65,22 +74,37 @@ var (
 	// decide how to parse.
 	metadataKeyFormat = keyformat.NewKeyFormat('m', 0) // v<keystring>
 
-	// Root nodes are indexed separately by their version
+	// Root nodes are indexed separately by their version. The value is the node key of the root.
 	rootKeyFormat = keyformat.NewKeyFormat('r', int64Size) // r<version>
 )
 
 var errInvalidFastStorageVersion = fmt.Sprintf("Fast storage version must be in the format <storage version>%s<latest fast cache version>", fastStorageVersionDelimiter)
 
 type nodeDB struct {
-	mtx            sync.Mutex       // Read/write lock.
-	db             dbm.DB           // Persistent node storage.
-	batch          dbm.Batch        // Batched writing buffer.
-	opts           Options          // Options to customize for pruning/writing
-	versionReaders map[int64]uint32 // Number of active version readers
-	storageVersion string           // Storage version
-	latestVersion  int64            // Latest version of nodeDB.
-	nodeCache      cache.Cache      // Cache for nodes in the regular tree that consists of key-value pairs at any version.
-	fastNodeCache  cache.Cache      // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
+	mtx                sync.Mutex       // Read/write lock.
+	db                 dbm.DB           // Persistent node storage.
+	batch              dbm.Batch        // Batched writing buffer.
+	opts               Options          // Options to customize for pruning/writing
+	versionReaders     map[int64]uint32 // Number of active version readers
+	fastStorageVersion int64            // Latest version the fast node index matches, or -1 without fast storage.
+	latestVersion      int64            // Latest version of nodeDB.
+	recordMigrations   bool             // Whether the migrations of an empty database still need to be recorded in the metadata.
+	nodeCache          cache.Cache      // Cache for nodes in the regular tree that consists of key-value pairs at any version.
+	fastNodeCache      cache.Cache      // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
+
+	nodeKeyLayoutOnce   sync.Once // Reads the node key layout on first use, see useVersionedNodeKeys.
+	nodeKeyLayoutErr    error     // Error reading the node key layout.
+	versionedNodeKeys   bool      // Whether new nodes are stored in the version-keyed layout.
+	recordNodeKeyLayout bool      // Whether the version-keyed layout still needs to be recorded in the metadata.
+
+	storageFormatOnce   sync.Once           // Decides the storage format on first use, see storageFormat.
+	storageFormatErr    error               // Error reading or deciding the storage format.
+	recordStorageFormat bool                // Whether the storage format still needs to be recorded in the metadata.
+	hasher              Hasher              // Hash function of the nodes.
+	compression         Compression         // Compression of the values on disk.
+	compressor          compressor          // Compressor of the values on disk, nil without compression.
+	blobThreshold       int                 // Minimum size of the values stored as blobs, or 0 if disabled.
+	blobCandidates      map[string]struct{} // Hashes of the blobs which lost a reference, see collectBlobs.
 }
 
 func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
@@ -89,68 +113,148 @@ func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
 		opts = &o
 	}
 
-	storeVersion, err := db.Get(metadataKeyFormat.Key(ibytes.UnsafeStrToBytes(storageVersionKey)))
+	ndb := &nodeDB{
+		db:                 db,
+		opts:               *opts,
+		latestVersion:      0, // initially invalid
+		nodeCache:          cache.New(cacheSize),
+		fastNodeCache:      cache.New(fastNodeCacheSize),
+		versionReaders:     make(map[int64]uint32, 8),
+		fastStorageVersion: -1,
+	}
+	if ndb.opts.Metrics == nil {
+		ndb.opts.Metrics = NopMetrics{}
+	}
+	if ndb.opts.Logger == nil {
+		ndb.opts.Logger = NopLogger{}
+	}
+	ndb.batch = ndb.newBatch()
 
-	if err != nil || storeVersion == nil {
-		storeVersion = []byte(defaultStorageVersionValue)
+	fastStorageVersion, upgraded, err := ndb.getMigration(fastStorageMigrationID)
+	if err == nil && upgraded {
+		ndb.fastStorageVersion = fastStorageVersion
 	}
 
-	return &nodeDB{
-		db:             db,
-		batch:          db.NewBatch(),
-		opts:           *opts,
-		latestVersion:  0, // initially invalid
-		nodeCache:      cache.New(cacheSize),
-		fastNodeCache:  cache.New(fastNodeCacheSize),
-		versionReaders: make(map[int64]uint32, 8),
-		storageVersion: string(storeVersion),
+	hasher, err := db.Get(metadataKeyFormat.Key([]byte(hasherKey)))
+	if err != nil {
+		ndb.storageFormatErr = err
+		return ndb
+	}
+	ndb.hasher = SHA256Hasher
+	if hasher != nil {
+		ndb.hasher = Hasher(hasher)
+	}
+	compression, err := db.Get(metadataKeyFormat.Key([]byte(compressionKey)))
+	if err != nil {
+		ndb.storageFormatErr = err
+		return ndb
 	}
+	ndb.compression = Compression(compression)
+	blobThreshold, err := db.Get(metadataKeyFormat.Key([]byte(blobThresholdKey)))
+	if err != nil {
+		ndb.storageFormatErr = err
+		return ndb
+	}
+	if blobThreshold != nil {
+		ndb.blobThreshold, ndb.storageFormatErr = strconv.Atoi(string(blobThreshold))
+	}
+	return ndb
 }
 
 // GetNode gets a node from memory or disk. If it is an inner node, it does not
 // load its children.
-func (ndb *nodeDB) GetNode(hash []byte) (*Node, error) {
+//
+// The node key is either the node hash or a version-keyed reference, depending on the layout
+// the node was saved with, see makeVersionedNodeKey.
+func (ndb *nodeDB) GetNode(nodeKey []byte) (*Node, error) {
+	return ndb.getNode(nodeKey, nil)
+}
+
+// getNode gets a node like GetNode, recording a cache miss and load in the given span, if any.
+func (ndb *nodeDB) getNode(nodeKey []byte, span Span) (*Node, error) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
-	return ndb.unsafeGetNode(hash)
+	return ndb.unsafeGetNode(nodeKey, span)
 }
 
+// unsafeGetNode gets a node, recording a cache miss and load in the given span, if any.
+//
 // Contract: the caller should hold the ndb.mtx lock.
-func (ndb *nodeDB) unsafeGetNode(hash []byte) (*Node, error) {
-	if len(hash) == 0 {
+func (ndb *nodeDB) unsafeGetNode(nodeKey []byte, span Span) (*Node, error) {
+	if len(nodeKey) == 0 {
 		return nil, ErrNodeMissingHash
 	}
 
 	// Check the cache.
-	if cachedNode := ndb.nodeCache.Get(hash); cachedNode != nil {
+	if cachedNode := ndb.nodeCache.Get(nodeKey); cachedNode != nil {
 		ndb.opts.Stat.IncCacheHitCnt()
 		return cachedNode.(*Node), nil
 	}
 
 	ndb.opts.Stat.IncCacheMissCnt()
+	if span != nil {
+		span.AddEvent(EventNodeCacheMiss, "nodeKey", nodeKey)
+	}
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.nodeKey(hash))
+	buf, err := ndb.db.Get(ndb.nodeKey(nodeKey))
 	if err != nil {
-		return nil, fmt.Errorf("can't get node %X: %v", hash, err)
+		return nil, fmt.Errorf("can't get node %X: %v", nodeKey, err)
 	}
 	if buf == nil {
-		return nil, fmt.Errorf("Value missing for hash %x corresponding to nodeKey %x", hash, ndb.nodeKey(hash))
+		return nil, fmt.Errorf("Value missing for key %x corresponding to nodeKey %x", nodeKey, ndb.nodeKey(nodeKey))
 	}
+	ndb.opts.Metrics.AddBytesRead(len(buf))
 
-	node, err := MakeNode(buf)
+	node, err := ndb.decodeNode(nodeKey, buf)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading Node. bytes: %x, error: %v", buf, err)
 	}
+	if span != nil {
+		span.AddEvent(EventNodeLoaded, "nodeKey", nodeKey, "version", node.version, "bytes", len(buf))
+	}
 
-	node.hash = hash
 	node.persisted = true
 	ndb.nodeCache.Add(node)
 
 	return node, nil
 }
 
+// decodeNode decodes a node stored under the given node key, in the encoding matching the
+// layout of the key.
+func (ndb *nodeDB) decodeNode(nodeKey, buf []byte) (*Node, error) {
+	var node *Node
+	var err error
+	if isVersionedNodeKey(nodeKey) {
+		if node, err = makeVersionedNode(buf); err != nil {
+			return nil, err
+		}
+		node.nodeKey = nodeKey
+	} else {
+		if node, err = MakeNode(buf); err != nil {
+			return nil, err
+		}
+		// Nodes stored by hash reference their children by hash as well.
+		node.hash = nodeKey
+		node.nodeKey = nodeKey
+		node.leftNodeKey = node.leftHash
+		node.rightNodeKey = node.rightHash
+	}
+
+	if node.isLeaf() {
+		if node.value, err = ndb.decodeValue(node.value); err != nil {
+			return nil, fmt.Errorf("decoding value, %w", err)
+		}
+	}
+	return node, nil
+}
+
 func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
+	return ndb.getFastNode(key, nil)
+}
+
+// getFastNode gets a fast node like GetFastNode, recording a cache miss in the given span, if any.
+func (ndb *nodeDB) getFastNode(key []byte, span Span) (*fastnode.Node, error) {
 	if !ndb.hasUpgradedToFastStorage() {
 		return nil, errors.New("storage version is not fast")
 	}
@@ -168,6 +272,9 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	}
 
 	ndb.opts.Stat.IncFastCacheMissCnt()
+	if span != nil {
+		span.AddEvent(EventFastNodeCacheMiss, "key", key)
+	}
 
 	// Doesn't exist, load.
 	buf, err := ndb.db.Get(ndb.fastNodeKey(key))
@@ -177,8 +284,9 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	if buf == nil {
 		return nil, nil
 	}
+	ndb.opts.Metrics.AddBytesRead(len(buf))
 
-	fastNode, err := fastnode.DeserializeNode(key, buf)
+	fastNode, err := ndb.decodeFastNode(key, buf)
 	if err != nil {
 		return nil, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
 	}
@@ -187,35 +295,272 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	return fastNode, nil
 }
 
-// SaveNode saves a node to disk.
-func (ndb *nodeDB) SaveNode(node *Node) error {
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
+// decodeFastNode decodes a fast node stored under the given key.
+func (ndb *nodeDB) decodeFastNode(key, buf []byte) (*fastnode.Node, error) {
+	fastNode, err := fastnode.DeserializeNode(key, buf)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ndb.decodeValue(fastNode.GetValue())
+	if err != nil {
+		return nil, fmt.Errorf("decoding fastnode.value, %w", err)
+	}
+	return fastnode.NewNode(key, value, fastNode.GetVersionLastUpdatedAt()), nil
+}
 
+// SaveNode saves a node to disk. Nodes without a node key are stored under their hash.
+func (ndb *nodeDB) SaveNode(node *Node) error {
 	if node.hash == nil {
 		return ErrNodeMissingHash
 	}
 	if node.persisted {
 		return ErrNodeAlreadyPersisted
 	}
+	if node.nodeKey == nil {
+		node.nodeKey = node.hash
+	}
 
-	// Save node bytes to db.
-	var buf bytes.Buffer
-	buf.Grow(node.encodedSize())
-
-	if err := node.writeBytes(&buf); err != nil {
+	buf, err := ndb.encodeNode(node)
+	if err != nil {
 		return err
 	}
 
-	if err := ndb.batch.Set(ndb.nodeKey(node.hash), buf.Bytes()); err != nil {
+	return ndb.saveEncodedNode(node, buf)
+}
+
+// saveEncodedNode saves a node whose bytes were already encoded by encodeNode.
+func (ndb *nodeDB) saveEncodedNode(node *Node, buf []byte) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if err := ndb.batch.Set(ndb.nodeKey(node.nodeKey), buf); err != nil {
 		return err
 	}
-	logger.Debug("BATCH SAVE %X %p\n", node.hash, node)
+	ndb.opts.Metrics.AddBytesWritten(len(buf))
+	if err := ndb.saveBlobToBatch(ndb.batch, node); err != nil {
+		return err
+	}
+	ndb.opts.Logger.Debug("saved node", "nodeKey", fmt.Sprintf("%X", node.nodeKey), "version", node.version)
 	node.persisted = true
 	ndb.nodeCache.Add(node)
 	return nil
 }
 
+// encodeNode returns the serialized bytes of a node, as stored on disk. The encoding depends
+// on the layout of the node key, and the value of leaf nodes is encoded by encodeValue.
+func (ndb *nodeDB) encodeNode(node *Node) ([]byte, error) {
+	if node.isLeaf() {
+		value, err := ndb.encodeValue(node.value)
+		if err != nil {
+			return nil, err
+		}
+		// The node hash, which is computed from the original value, is encoded as is.
+		stored := *node
+		stored.value = value
+		node = &stored
+	}
+
+	var buf bytes.Buffer
+	if isVersionedNodeKey(node.nodeKey) {
+		buf.Grow(node.versionedEncodedSize())
+		if err := node.writeVersionedBytes(&buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	buf.Grow(node.encodedSize())
+	if err := node.writeBytes(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// makeVersionedNodeKey returns the node key of the nonce'th node saved at the given version in
+// the version-keyed layout. It consists of the big-endian version followed by the big-endian
+// nonce, so that it can never be mistaken for a node hash.
+func makeVersionedNodeKey(version int64, nonce uint32) []byte {
+	nodeKey := make([]byte, versionedNodeKeySize)
+	binary.BigEndian.PutUint64(nodeKey, uint64(version))
+	binary.BigEndian.PutUint32(nodeKey[int64Size:], nonce)
+	return nodeKey
+}
+
+// isVersionedNodeKey returns true if the node key is in the version-keyed layout, false if it
+// is a node hash.
+func isVersionedNodeKey(nodeKey []byte) bool {
+	return len(nodeKey) == versionedNodeKeySize
+}
+
+// useVersionedNodeKeys returns true if new nodes are stored in the version-keyed layout.
+//
+// The layout is read from the metadata on first use. Empty databases use the layout given by
+// Options.VersionKeyedNodes, existing ones keep storing nodes by hash until they are migrated
+// by migrateToVersionedNodeKeys.
+func (ndb *nodeDB) useVersionedNodeKeys() (bool, error) {
+	ndb.nodeKeyLayoutOnce.Do(func() {
+		layout, err := ndb.db.Get(metadataKeyFormat.Key([]byte(nodeKeyLayoutKey)))
+		if err != nil {
+			ndb.nodeKeyLayoutErr = err
+			return
+		}
+		if string(layout) == versionedNodeKeyLayout {
+			ndb.versionedNodeKeys = true
+			return
+		}
+		if !ndb.opts.VersionKeyedNodes {
+			return
+		}
+
+		for _, prefix := range [][]byte{rootKeyFormat.Key(), nodeKeyFormat.Key()} {
+			found, err := ndb.hasPrefix(prefix)
+			if err != nil {
+				ndb.nodeKeyLayoutErr = err
+				return
+			}
+			if found {
+				return
+			}
+		}
+		ndb.versionedNodeKeys = true
+		ndb.recordNodeKeyLayout = true
+	})
+	return ndb.versionedNodeKeys, ndb.nodeKeyLayoutErr
+}
+
+// setNodeKeyLayoutToBatch records the version-keyed layout in the metadata, if it has not been
+// recorded yet. It is called along with saving the first root of an empty database.
+func (ndb *nodeDB) setNodeKeyLayoutToBatch(batch dbm.Batch) error {
+	if !ndb.recordNodeKeyLayout {
+		return nil
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(nodeKeyLayoutKey)), []byte(versionedNodeKeyLayout)); err != nil {
+		return err
+	}
+	ndb.recordNodeKeyLayout = false
+	return nil
+}
+
+// hasPrefix returns true if the database contains any key with the given prefix.
+func (ndb *nodeDB) hasPrefix(prefix []byte) (bool, error) {
+	itr, err := dbm.IteratePrefix(ndb.db, prefix)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+
+	return itr.Valid(), itr.Error()
+}
+
+// storageFormat decides on first use the storage format: the hash function of the nodes, the
+// compression of the values, and the threshold above which they are stored as blobs. Databases
+// keep the format recorded in their metadata, while empty databases use the format given by
+// the options.
+func (ndb *nodeDB) storageFormat() error {
+	ndb.storageFormatOnce.Do(func() {
+		if ndb.storageFormatErr != nil {
+			return
+		}
+		hasher, compression, blobThreshold := ndb.opts.Hasher, ndb.opts.Compression, ndb.opts.BlobThreshold
+		if hasher == "" {
+			hasher = ndb.hasher
+		}
+		if compression == NoCompression {
+			compression = ndb.compression
+		}
+		if blobThreshold == 0 {
+			blobThreshold = ndb.blobThreshold
+		}
+		if hasher != ndb.hasher || compression != ndb.compression || blobThreshold != ndb.blobThreshold {
+			ndb.storageFormatErr = ndb.setStorageFormat(hasher, compression, blobThreshold)
+			if ndb.storageFormatErr != nil {
+				return
+			}
+		}
+		if _, ndb.storageFormatErr = ndb.hasher.newHash(); ndb.storageFormatErr != nil {
+			return
+		}
+		ndb.compressor, ndb.storageFormatErr = newCompressor(ndb.compression)
+	})
+	return ndb.storageFormatErr
+}
+
+// nodeHasher returns the hash function of the nodes.
+func (ndb *nodeDB) nodeHasher() (Hasher, error) {
+	if err := ndb.storageFormat(); err != nil {
+		return "", err
+	}
+	return ndb.hasher, nil
+}
+
+// setStorageFormat changes the storage format to the given one, which is only possible for
+// databases which did not record a format yet, and are empty.
+func (ndb *nodeDB) setStorageFormat(hasher Hasher, compression Compression, blobThreshold int) error {
+	switch {
+	case ndb.hasher != SHA256Hasher && hasher != ndb.hasher:
+		return fmt.Errorf("database uses the %s hasher, not %s", ndb.hasher, hasher)
+	case ndb.compression != NoCompression && compression != ndb.compression:
+		return fmt.Errorf("database uses %s compression, not %s", ndb.compression, compression)
+	case ndb.blobThreshold != 0 && blobThreshold != ndb.blobThreshold:
+		return fmt.Errorf("database uses a blob threshold of %d, not %d", ndb.blobThreshold, blobThreshold)
+	case blobThreshold < 0:
+		return fmt.Errorf("invalid blob threshold %d", blobThreshold)
+	}
+	for _, prefix := range [][]byte{rootKeyFormat.Key(), nodeKeyFormat.Key(), versionedNodeKeyFormat.Key()} {
+		found, err := ndb.hasPrefix(prefix)
+		if err != nil {
+			return err
+		}
+		if found {
+			return errors.New("can't change the storage format of an existing database")
+		}
+	}
+	ndb.hasher, ndb.compression, ndb.blobThreshold = hasher, compression, blobThreshold
+	ndb.recordStorageFormat = true
+	return nil
+}
+
+// setStorageFormatToBatch records the storage format in the metadata, if it has not been
+// recorded yet. It is called along with saving the first root of an empty database.
+func (ndb *nodeDB) setStorageFormatToBatch(batch dbm.Batch) error {
+	if !ndb.recordStorageFormat {
+		return nil
+	}
+	if ndb.hasher != SHA256Hasher {
+		if err := batch.Set(metadataKeyFormat.Key([]byte(hasherKey)), []byte(ndb.hasher)); err != nil {
+			return err
+		}
+	}
+	if ndb.compression != NoCompression {
+		if err := batch.Set(metadataKeyFormat.Key([]byte(compressionKey)), []byte(ndb.compression)); err != nil {
+			return err
+		}
+	}
+	if ndb.blobThreshold > 0 {
+		if err := batch.Set(metadataKeyFormat.Key([]byte(blobThresholdKey)), []byte(strconv.Itoa(ndb.blobThreshold))); err != nil {
+			return err
+		}
+	}
+	ndb.recordStorageFormat = false
+	return nil
+}
+
+// compressValue returns the value compressed as configured.
+func (ndb *nodeDB) compressValue(value []byte) ([]byte, error) {
+	if err := ndb.storageFormat(); err != nil || ndb.compressor == nil {
+		return value, err
+	}
+	return ndb.compressor.compress(value), nil
+}
+
+// decompressValue returns the value compressed as buf by compressValue.
+func (ndb *nodeDB) decompressValue(buf []byte) ([]byte, error) {
+	if err := ndb.storageFormat(); err != nil || ndb.compressor == nil {
+		return buf, err
+	}
+	return ndb.compressor.decompress(buf)
+}
+
 // SaveNode saves a FastNode to disk and add to cache.
 func (ndb *nodeDB) SaveFastNode(node *fastnode.Node) error {
 	ndb.mtx.Lock()
@@ -230,65 +575,53 @@ func (ndb *nodeDB) SaveFastNodeNoCache(node *fastnode.Node) error {
 	return ndb.saveFastNodeUnlocked(node, false)
 }
 
-// setFastStorageVersionToBatch sets storage version to fast where the version is
-// 1.1.0-<version of the current live state>. Returns error if storage version is incorrect or on
-// db error, nil otherwise. Requires changes to be committed after to be persisted.
+// setFastStorageVersionToBatch records the fast node index as matching the latest version.
+// Requires changes to be committed after to be persisted.
 func (ndb *nodeDB) setFastStorageVersionToBatch() error {
-	var newVersion string
-	if ndb.storageVersion >= fastStorageVersionValue {
-		// Storage version should be at index 0 and latest fast cache version at index 1
-		versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
-
-		if len(versions) > 2 {
-			return errors.New(errInvalidFastStorageVersion)
-		}
-
-		newVersion = versions[0]
-	} else {
-		newVersion = fastStorageVersionValue
-	}
-
 	latestVersion, err := ndb.getLatestVersion()
 	if err != nil {
 		return err
 	}
-
-	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion))
-
-	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
+	if err := ndb.setMigrationToBatch(ndb.batch, fastStorageMigrationID, latestVersion); err != nil {
 		return err
 	}
-	ndb.storageVersion = newVersion
+	ndb.fastStorageVersion = latestVersion
 	return nil
 }
 
-func (ndb *nodeDB) getStorageVersion() string {
-	return ndb.storageVersion
-}
-
-// Returns true if the upgrade to latest storage version has been performed, false otherwise.
+// Returns true if the upgrade to fast storage has been performed, false otherwise.
 func (ndb *nodeDB) hasUpgradedToFastStorage() bool {
-	return ndb.getStorageVersion() >= fastStorageVersionValue
+	return ndb.fastStorageVersion >= 0
 }
 
 // Returns true if the upgrade to fast storage has occurred but it does not match the live state, false otherwise.
 // When the live state is not matched, we must force reupgrade.
+// This protects against downgrade and re-upgrade, in which case it would be possible to observe
+// mismatch between the latest version state and the fast nodes on disk.
 // We determine this by checking the version of the live state and the version of the live state when
-// latest storage was updated on disk the last time.
+// the fast node index was updated on disk the last time.
 func (ndb *nodeDB) shouldForceFastStorageUpgrade() (bool, error) {
-	versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
+	if !ndb.hasUpgradedToFastStorage() {
+		return false, nil
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return false, err
+	}
+	return ndb.fastStorageVersion != latestVersion, nil
+}
 
-	if len(versions) == 2 {
-		latestVersion, err := ndb.getLatestVersion()
-		if err != nil {
-			// TODO: should be true or false as default? (removed panic here)
-			return false, err
-		}
-		if versions[1] != strconv.Itoa(int(latestVersion)) {
-			return true, nil
-		}
+// ignoreStaleFastStorage disables the fast node index in memory if it does not match the live
+// state, which a read-only nodeDB can't rebuild. Reads then go through the tree.
+func (ndb *nodeDB) ignoreStaleFastStorage() error {
+	stale, err := ndb.shouldForceFastStorageUpgrade()
+	if err != nil {
+		return err
 	}
-	return false, nil
+	if stale {
+		ndb.fastStorageVersion = -1
+	}
+	return nil
 }
 
 // SaveNode saves a FastNode to disk.
@@ -297,26 +630,41 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bo
 		return fmt.Errorf("cannot have FastNode with a nil value for key")
 	}
 
+	// Blobs are saved along with the leaf nodes, which fast nodes are copies of.
+	value, err := ndb.encodeValue(node.GetValue())
+	if err != nil {
+		return err
+	}
+	stored := fastnode.NewNode(node.GetKey(), value, node.GetVersionLastUpdatedAt())
+
 	// Save node bytes to db.
 	var buf bytes.Buffer
-	buf.Grow(node.EncodedSize())
+	buf.Grow(stored.EncodedSize())
 
-	if err := node.WriteBytes(&buf); err != nil {
+	if err := stored.WriteBytes(&buf); err != nil {
 		return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
 	}
 
 	if err := ndb.batch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes()); err != nil {
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
+	ndb.opts.Metrics.AddBytesWritten(buf.Len())
+	var blobHash []byte
+	if ndb.isBlob(node.GetValue()) {
+		blobHash = value[1:]
+	}
+	if err := ndb.setFastNodeBlobRef(node.GetKey(), blobHash); err != nil {
+		return err
+	}
 	if shouldAddToCache {
 		ndb.fastNodeCache.Add(node)
 	}
 	return nil
 }
 
-// Has checks if a hash exists in the database.
-func (ndb *nodeDB) Has(hash []byte) (bool, error) {
-	key := ndb.nodeKey(hash)
+// Has checks if a node key exists in the database.
+func (ndb *nodeDB) Has(nodeKey []byte) (bool, error) {
+	key := ndb.nodeKey(nodeKey)
 
 	if ldb, ok := ndb.db.(*dbm.GoLevelDB); ok {
 		exists, err := ldb.DB().Has(key, nil)
@@ -333,52 +681,210 @@ func (ndb *nodeDB) Has(hash []byte) (bool, error) {
 	return value != nil, nil
 }
 
-// SaveBranch saves the given node and all of its descendants.
+// SaveBranch saves the given node and all of its descendants as the given version.
 // NOTE: This function clears leftNode/rigthNode recursively and
 // calls _hash() on the given node.
-// TODO refactor, maybe use hashWithCount() but provide a callback.
-func (ndb *nodeDB) SaveBranch(node *Node) ([]byte, error) {
-	if node.persisted {
-		return node.hash, nil
+//
+// Dirty subtrees of at least parallelHashThreshold nodes are hashed concurrently by hashBranch.
+// The nodes are then written to the batch on the calling goroutine in depth-first post-order,
+// so the batch writes are the same regardless of how the hashing was scheduled.
+func (ndb *nodeDB) SaveBranch(node *Node, version int64) ([]byte, error) {
+	saved, _, err := ndb.saveBranch(node, version)
+	if err != nil {
+		return nil, err
 	}
+	clearChildNodes(saved)
+	return node.hash, nil
+}
 
-	var err error
-	if node.leftNode != nil {
-		node.leftHash, err = ndb.SaveBranch(node.leftNode)
+// saveBranch is like SaveBranch, but it keeps the leftNode/rightNode pointers of the saved
+// nodes, which are returned along with the number of nodes written. It is used when the batch
+// is written asynchronously, in which case the nodes must stay reachable in memory until the
+// batch is durable, see clearChildNodes.
+//
+// The genesis version is saved by saveGenesisBranch instead, which flushes every node and drops
+// the child pointers right away, and returns no nodes.
+func (ndb *nodeDB) saveBranch(node *Node, version int64) (saved []*Node, written int, err error) {
+	if node.persisted {
+		return nil, 0, nil
 	}
 
+	versioned, err := ndb.useVersionedNodeKeys()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if versioned {
+		// Node keys are assigned sequentially up front, since parents are encoded with the keys
+		// of their children, and the hashing below may run out of order.
+		var nonce uint32
+		assignVersionedNodeKeys(node, version, &nonce)
+	}
+	hasher, err := ndb.nodeHasher()
+	if err != nil {
+		return nil, 0, err
 	}
 
-	if node.rightNode != nil {
-		node.rightHash, err = ndb.SaveBranch(node.rightNode)
+	if version <= genesisVersion {
+		written, err := ndb.saveGenesisBranch(node, hasher)
+		return nil, written, err
 	}
+	if err := hashBranch(node, hasher, parallelHashThreshold); err != nil {
+		return nil, 0, err
+	}
+	if err := ndb.writeBranch(node, &saved); err != nil {
+		return nil, 0, err
+	}
+	return saved, len(saved), nil
+}
 
-	if err != nil {
-		return nil, err
+// clearChildNodes drops the in-memory child pointers of persisted nodes, so that their
+// children are loaded from the nodeDB on demand.
+func clearChildNodes(nodes []*Node) {
+	for _, node := range nodes {
+		node.leftNode = nil
+		node.rightNode = nil
 	}
+}
 
-	_, err = node._hash()
-	if err != nil {
-		return nil, err
+// assignVersionedNodeKeys assigns version-keyed node keys to the given node and all of its
+// unpersisted descendants in depth-first post-order (LRN), starting after the given nonce.
+func assignVersionedNodeKeys(node *Node, version int64, nonce *uint32) {
+	if node.persisted {
+		return
 	}
+	if node.leftNode != nil {
+		assignVersionedNodeKeys(node.leftNode, version, nonce)
+	}
+	if node.rightNode != nil {
+		assignVersionedNodeKeys(node.rightNode, version, nonce)
+	}
+	*nonce++
+	node.nodeKey = makeVersionedNodeKey(version, *nonce)
+}
 
-	err = ndb.SaveNode(node)
-	if err != nil {
-		return nil, err
+// parallelHashThreshold is the minimum size of a node for which its dirty left and right
+// subtrees are hashed concurrently by hashBranch. Smaller subtrees are not worth the goroutine
+// overhead.
+const parallelHashThreshold = 4096
+
+// saveGenesisBranch writes the given node and all of its unpersisted descendants in depth-first
+// post-order, and returns the number of nodes written. It flushes the batch after every node and
+// drops its child pointers right away, which keeps memory use low when saving a large genesis
+// version, e.g. of an initial import.
+func (ndb *nodeDB) saveGenesisBranch(node *Node, hasher Hasher) (int, error) {
+	if node.persisted {
+		return 0, nil
 	}
 
-	// resetBatch only working on generate a genesis block
-	if node.version <= genesisVersion {
-		if err = ndb.resetBatch(); err != nil {
-			return nil, err
+	written := 0
+	for _, child := range []*Node{node.leftNode, node.rightNode} {
+		if child == nil {
+			continue
+		}
+		n, err := ndb.saveGenesisBranch(child, hasher)
+		if err != nil {
+			return 0, err
 		}
+		written += n
+	}
+
+	if err := hashNode(node, hasher); err != nil {
+		return 0, err
+	}
+	if err := ndb.SaveNode(node); err != nil {
+		return 0, err
+	}
+	if err := ndb.resetBatch(); err != nil {
+		return 0, err
 	}
 	node.leftNode = nil
 	node.rightNode = nil
+	return written + 1, nil
+}
 
-	return node.hash, nil
+// hashBranch hashes the given node and all of its unpersisted descendants, without writing
+// them. When both children are dirty and the node size reaches the given threshold, the left
+// subtree is hashed on a separate goroutine.
+func hashBranch(node *Node, hasher Hasher, threshold int64) error {
+	if node.persisted {
+		return nil
+	}
+
+	left, right := node.leftNode, node.rightNode
+	leftDirty := left != nil && !left.persisted
+	rightDirty := right != nil && !right.persisted
+
+	if leftDirty && rightDirty && node.size >= threshold {
+		var (
+			wg      sync.WaitGroup
+			leftErr error
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leftErr = hashBranch(left, hasher, threshold)
+		}()
+		rightErr := hashBranch(right, hasher, threshold)
+		wg.Wait()
+
+		if leftErr != nil {
+			return leftErr
+		}
+		if rightErr != nil {
+			return rightErr
+		}
+	} else {
+		if leftDirty {
+			if err := hashBranch(left, hasher, threshold); err != nil {
+				return err
+			}
+		}
+		if rightDirty {
+			if err := hashBranch(right, hasher, threshold); err != nil {
+				return err
+			}
+		}
+	}
+	return hashNode(node, hasher)
+}
+
+// hashNode sets the child hashes and node keys of a node whose children are hashed, and hashes
+// it. Nodes without a node key are keyed by their hash.
+func hashNode(node *Node, hasher Hasher) error {
+	if left := node.leftNode; left != nil {
+		node.leftHash, node.leftNodeKey = left.hash, left.nodeKey
+	}
+	if right := node.rightNode; right != nil {
+		node.rightHash, node.rightNodeKey = right.hash, right.nodeKey
+	}
+	if _, err := node._hash(hasher); err != nil {
+		return err
+	}
+	if node.nodeKey == nil {
+		node.nodeKey = node.hash
+	}
+	return nil
+}
+
+// writeBranch writes the given node and all of its unpersisted descendants, which must be
+// hashed, to the batch in depth-first post-order, and appends them to saved in that order.
+func (ndb *nodeDB) writeBranch(node *Node, saved *[]*Node) error {
+	if node.persisted {
+		return nil
+	}
+	for _, child := range []*Node{node.leftNode, node.rightNode} {
+		if child == nil {
+			continue
+		}
+		if err := ndb.writeBranch(child, saved); err != nil {
+			return err
+		}
+	}
+	if err := ndb.SaveNode(node); err != nil {
+		return err
+	}
+	*saved = append(*saved, node)
+	return nil
 }
 
 // resetBatch reset the db batch, keep low memory used
@@ -397,13 +903,13 @@ func (ndb *nodeDB) resetBatch() error {
 		return err
 	}
 
-	ndb.batch = ndb.db.NewBatch()
+	ndb.batch = ndb.newBatch()
 
 	return nil
 }
 
 // DeleteVersion deletes a tree version from disk.
-// calls deleteOrphans(version), deleteRoot(version, checkLatestVersion)
+// calls deleteVersionNodes(...), deleteRoot(version, checkLatestVersion)
 func (ndb *nodeDB) DeleteVersion(version int64, checkLatestVersion bool) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -412,7 +918,17 @@ func (ndb *nodeDB) DeleteVersion(version int64, checkLatestVersion bool) error {
 		return fmt.Errorf("unable to delete version %v, it has %v active readers", version, ndb.versionReaders[version])
 	}
 
-	err := ndb.deleteOrphans(version)
+	predecessor, err := ndb.getPreviousVersion(version)
+	if err != nil {
+		return err
+	}
+	successor, err := ndb.getNextVersion(version + 1)
+	if err != nil {
+		return err
+	}
+	ndb.opts.Logger.Info("deleting version", "version", version, "predecessor", predecessor, "successor", successor)
+
+	err = ndb.deleteVersionNodes(predecessor, []int64{version}, successor, nil)
 	if err != nil {
 		return err
 	}
@@ -433,13 +949,6 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 	if latest < version {
 		return nil
 	}
-	root, err := ndb.getRoot(latest)
-	if err != nil {
-		return err
-	}
-	if root == nil {
-		return fmt.Errorf("root for version %v not found", latest)
-	}
 
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -450,38 +959,34 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 		}
 	}
 
-	// First, delete all active nodes in the current (latest) version whose node version is after
-	// the given version.
-	err = ndb.deleteNodesFrom(version, root)
+	predecessor, err := ndb.getPreviousVersion(version)
 	if err != nil {
 		return err
 	}
+	versions, err := ndb.getVersions(version, maxVersion)
+	if err != nil {
+		return err
+	}
+	ndb.opts.Logger.Info("deleting versions from", "version", version, "versions", len(versions), "predecessor", predecessor)
 
-	// Next, delete orphans:
-	// - Delete orphan entries *and referred nodes* with fromVersion >= version
-	// - Delete orphan entries with toVersion >= version-1 (since orphans at latest are not orphans)
-	err = ndb.traverseRange(orphanKeyFormat.Key(version-1), orphanKeyFormat.Key(maxVersion), func(key, hash []byte) error {
-		var fromVersion, toVersion int64
-		orphanKeyFormat.Scan(key, &toVersion, &fromVersion)
-
-		if fromVersion >= version {
-			if err = ndb.batch.Delete(key); err != nil {
-				return err
-			}
-			if err = ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
-				return err
-			}
-			ndb.nodeCache.Remove(hash)
-		} else if toVersion >= version-1 {
-			if err = ndb.batch.Delete(key); err != nil {
-				return err
+	// Delete the nodes of every version which are not part of the preceding one. Since nodes are
+	// only ever shared with later versions, these are exactly the nodes with a version after the
+	// preceding one, and whole subtrees of older nodes can be skipped.
+	for _, v := range versions {
+		root, err := ndb.getRoot(v)
+		if err != nil {
+			return err
+		}
+		err = ndb.walkNodes(root, nil, func(node *Node) (bool, error) {
+			if node.version <= predecessor {
+				return false, nil
 			}
+			return true, ndb.deleteNode(node)
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
-
-	if err != nil {
-		return err
+		predecessor = v
 	}
 
 	// Delete the version root entries
@@ -501,63 +1006,22 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 	return nil
 }
 
-// DeleteVersionsRange deletes versions from an interval (not inclusive).
-func (ndb *nodeDB) DeleteVersionsRange(fromVersion, toVersion int64) error {
-	if fromVersion >= toVersion {
-		return errors.New("toVersion must be greater than fromVersion")
-	}
-	if toVersion == 0 {
-		return errors.New("toVersion must be greater than 0")
-	}
-
+// DeleteVersionsRange deletes versions from an interval (not inclusive), recording the nodes it
+// loads in the given span, if any.
+func (ndb *nodeDB) DeleteVersionsRange(fromVersion, toVersion int64, span Span) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	latest, err := ndb.getLatestVersion()
+	predecessor, versions, successor, err := ndb.checkDeleteVersionsRange(fromVersion, toVersion)
 	if err != nil {
 		return err
 	}
-	if latest < toVersion {
-		return fmt.Errorf("cannot delete latest saved version (%d)", latest)
-	}
-
-	predecessor, err := ndb.getPreviousVersion(fromVersion)
-	if err != nil {
+	ndb.opts.Logger.Info("deleting versions", "fromVersion", fromVersion, "toVersion", toVersion,
+		"versions", len(versions), "predecessor", predecessor, "successor", successor)
+	if err := ndb.deleteVersionNodes(predecessor, versions, successor, span); err != nil {
 		return err
 	}
 
-	for v, r := range ndb.versionReaders {
-		if v < toVersion && v > predecessor && r != 0 {
-			return fmt.Errorf("unable to delete version %v with %v active readers", v, r)
-		}
-	}
-
-	// If the predecessor is earlier than the beginning of the lifetime, we can delete the orphan.
-	// Otherwise, we shorten its lifetime, by moving its endpoint to the predecessor version.
-	for version := fromVersion; version < toVersion; version++ {
-		err := ndb.traverseOrphansVersion(version, func(key, hash []byte) error {
-			var from, to int64
-			orphanKeyFormat.Scan(key, &to, &from)
-			if err := ndb.batch.Delete(key); err != nil {
-				return err
-			}
-			if from > predecessor {
-				if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
-					return err
-				}
-				ndb.nodeCache.Remove(hash)
-			} else {
-				if err := ndb.saveOrphan(hash, from, predecessor); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-	}
-
 	// Delete the version root entries
 	err = ndb.traverseRange(rootKeyFormat.Key(fromVersion), rootKeyFormat.Key(toVersion), func(k, v []byte) error {
 		if err := ndb.batch.Delete(k); err != nil {
@@ -572,146 +1036,249 @@ func (ndb *nodeDB) DeleteVersionsRange(fromVersion, toVersion int64) error {
 	return nil
 }
 
-func (ndb *nodeDB) DeleteFastNode(key []byte) error {
+// deletableVersions returns the saved versions in the range [fromVersion, toVersion), if they can
+// be deleted by DeleteVersionsRange.
+func (ndb *nodeDB) deletableVersions(fromVersion, toVersion int64) ([]int64, error) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
-	if err := ndb.batch.Delete(ndb.fastNodeKey(key)); err != nil {
-		return err
-	}
-	ndb.fastNodeCache.Remove(key)
-	return nil
+
+	_, versions, _, err := ndb.checkDeleteVersionsRange(fromVersion, toVersion)
+	return versions, err
 }
 
-// deleteNodesFrom deletes the given node and any descendants that have versions after the given
-// (inclusive). It is mainly used via LoadVersionForOverwriting, to delete the current version.
-func (ndb *nodeDB) deleteNodesFrom(version int64, hash []byte) error {
-	if len(hash) == 0 {
-		return nil
+// checkDeleteVersionsRange checks that the versions in the range [fromVersion, toVersion) can be
+// deleted, and returns them along with the retained versions preceding and following them, see
+// deleteVersionNodes.
+func (ndb *nodeDB) checkDeleteVersionsRange(fromVersion, toVersion int64) (predecessor int64, versions []int64, successor int64, err error) {
+	if fromVersion >= toVersion {
+		return 0, nil, 0, errors.New("toVersion must be greater than fromVersion")
+	}
+	if toVersion == 0 {
+		return 0, nil, 0, errors.New("toVersion must be greater than 0")
 	}
 
-	node, err := ndb.unsafeGetNode(hash)
+	latest, err := ndb.getLatestVersion()
 	if err != nil {
-		return err
+		return 0, nil, 0, err
 	}
-
-	if node.version < version {
-		// We can skip the whole sub-tree since children.version <= parent.version.
-		return nil
+	if latest < toVersion {
+		return 0, nil, 0, fmt.Errorf("cannot delete latest saved version (%d)", latest)
 	}
 
-	if node.leftHash != nil {
-		if err := ndb.deleteNodesFrom(version, node.leftHash); err != nil {
-			return err
-		}
-	}
-	if node.rightHash != nil {
-		if err := ndb.deleteNodesFrom(version, node.rightHash); err != nil {
-			return err
-		}
+	predecessor, err = ndb.getPreviousVersion(fromVersion)
+	if err != nil {
+		return 0, nil, 0, err
 	}
 
-	if node.version >= version {
-		if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
-			return err
+	for v, r := range ndb.versionReaders {
+		if v < toVersion && v > predecessor && r != 0 {
+			return 0, nil, 0, fmt.Errorf("unable to delete version %v with %v active readers", v, r)
 		}
-
-		ndb.nodeCache.Remove(hash)
 	}
 
-	return nil
+	versions, err = ndb.getVersions(fromVersion, toVersion)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	successor, err = ndb.getNextVersion(toVersion)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return predecessor, versions, successor, nil
 }
 
-// Saves orphaned nodes to disk under a special prefix.
-// version: the new version being saved.
-// orphans: the orphan nodes created since version-1
-func (ndb *nodeDB) SaveOrphans(version int64, orphans map[string]int64) error {
+func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
-
-	toVersion, err := ndb.getPreviousVersion(version)
-	if err != nil {
+	if err := ndb.setFastNodeBlobRef(key, nil); err != nil {
+		return err
+	}
+	if err := ndb.batch.Delete(ndb.fastNodeKey(key)); err != nil {
 		return err
 	}
+	ndb.fastNodeCache.Remove(key)
+	return nil
+}
 
-	for hash, fromVersion := range orphans {
-		logger.Debug("SAVEORPHAN %v-%v %X\n", fromVersion, toVersion, hash)
-		err := ndb.saveOrphan([]byte(hash), fromVersion, toVersion)
+// deleteVersionNodes deletes the nodes which are only part of the given versions, which must be
+// all the versions between the retained predecessor and successor versions, in ascending order.
+// Either of the retained versions is 0 if there is none. The nodes loaded are recorded in the
+// given span, if any.
+//
+// No index of orphaned nodes is kept on disk. Instead, the tree of every deleted version is
+// compared with the tree of the version following it, see traverseOrphans: a node of the
+// deleted version which is missing from the following version was orphaned by it, and is dead
+// unless it is also part of the predecessor. Since the versions a node is part of form a
+// contiguous range starting at node.version, that is the case iff node.version <= predecessor.
+func (ndb *nodeDB) deleteVersionNodes(predecessor int64, versions []int64, successor int64, span Span) error {
+	deleted := 0
+	defer func() { ndb.opts.Metrics.AddOrphansDeleted(deleted) }()
+	for i, version := range versions {
+		next := successor
+		if i+1 < len(versions) {
+			next = versions[i+1]
+		}
+		before := deleted
+		err := ndb.traverseOrphans(version, next, span, func(node *Node) error {
+			if node.version <= predecessor {
+				return nil
+			}
+			if err := ndb.deleteNode(node); err != nil {
+				return err
+			}
+			deleted++
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+		ndb.opts.Logger.Debug("pruned version", "version", version, "nextVersion", next, "deletedNodes", deleted-before)
 	}
 	return nil
 }
 
-// Saves a single orphan to disk.
-func (ndb *nodeDB) saveOrphan(hash []byte, fromVersion, toVersion int64) error {
-	if fromVersion > toVersion {
-		return fmt.Errorf("orphan expires before it comes alive.  %d > %d", fromVersion, toVersion)
+// traverseOrphans calls fn for every node of the tree at the given version which is not part of
+// the tree at nextVersion, i.e. which is orphaned by nextVersion, in pre-order. The nodes loaded
+// are recorded in the given span, if any.
+//
+// The nodes of the next tree with a version up to the given version are the roots of the
+// subtrees shared by both trees. They are found by walking the next tree down to the first
+// such node on every path. The tree at the given version is then walked down to those subtrees.
+//
+// Contract: the caller should hold the ndb.mtx lock.
+func (ndb *nodeDB) traverseOrphans(version, nextVersion int64, span Span, fn func(*Node) error) error {
+	shared := make(map[string]struct{})
+	if nextVersion > 0 {
+		nextRoot, err := ndb.getRoot(nextVersion)
+		if err != nil {
+			return err
+		}
+		err = ndb.walkNodes(nextRoot, span, func(node *Node) (bool, error) {
+			if node.version <= version {
+				shared[ibytes.UnsafeBytesToStr(node.hash)] = struct{}{}
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
 	}
-	key := ndb.orphanKey(fromVersion, toVersion, hash)
-	if err := ndb.batch.Set(key, hash); err != nil {
+
+	root, err := ndb.getRoot(version)
+	if err != nil {
 		return err
 	}
-	return nil
+	return ndb.walkNodes(root, span, func(node *Node) (bool, error) {
+		if _, ok := shared[ibytes.UnsafeBytesToStr(node.hash)]; ok {
+			return false, nil
+		}
+		return true, fn(node)
+	})
 }
 
-// deleteOrphans deletes orphaned nodes from disk, and the associated orphan
-// entries.
-func (ndb *nodeDB) deleteOrphans(version int64) error {
-	// Will be zero if there is no previous version.
-	predecessor, err := ndb.getPreviousVersion(version)
+// walkNodes walks the tree with the given root node key in pre-order, descending into the
+// children of the nodes for which fn returns true. The nodes loaded are recorded in the given
+// span, if any.
+//
+// Contract: the caller should hold the ndb.mtx lock.
+func (ndb *nodeDB) walkNodes(nodeKey []byte, span Span, fn func(*Node) (bool, error)) error {
+	if len(nodeKey) == 0 {
+		return nil
+	}
+	node, err := ndb.unsafeGetNode(nodeKey, span)
 	if err != nil {
 		return err
 	}
+	descend, err := fn(node)
+	if err != nil || !descend || node.isLeaf() {
+		return err
+	}
+	if err := ndb.walkNodes(node.leftNodeKey, span, fn); err != nil {
+		return err
+	}
+	return ndb.walkNodes(node.rightNodeKey, span, fn)
+}
 
-	// Traverse orphans with a lifetime ending at the version specified.
-	// TODO optimize.
-	return ndb.traverseOrphansVersion(version, func(key, hash []byte) error {
-		var fromVersion, toVersion int64
+// deleteNode deletes a node from disk and from the cache.
+//
+// Contract: the caller should hold the ndb.mtx lock.
+func (ndb *nodeDB) deleteNode(node *Node) error {
+	ndb.opts.Logger.Debug("deleted node", "nodeKey", fmt.Sprintf("%X", node.nodeKey), "version", node.version)
+	if err := ndb.batch.Delete(ndb.nodeKey(node.nodeKey)); err != nil {
+		return err
+	}
+	if err := ndb.deleteBlobRef(node); err != nil {
+		return err
+	}
+	ndb.nodeCache.Remove(node.nodeKey)
+	return nil
+}
 
-		// See comment on `orphanKeyFmt`. Note that here, `version` and
-		// `toVersion` are always equal.
-		orphanKeyFormat.Scan(key, &toVersion, &fromVersion)
+// deleteOrphanIndex deletes the orphan entries written by earlier releases, which are no longer
+// needed for pruning.
+func (ndb *nodeDB) deleteOrphanIndex(ctx context.Context) error {
+	if err := ndb.deletePrefix(ctx, orphanKeyFormat.Key()); err != nil {
+		return err
+	}
+	return ndb.setMigration(orphanIndexMigrationID)
+}
 
-		// Delete orphan key and reverse-lookup key.
-		if err := ndb.batch.Delete(key); err != nil {
+// deletePrefix deletes all keys with the given prefix, committing every commitGap keys, until the
+// context is done.
+func (ndb *nodeDB) deletePrefix(ctx context.Context, prefix []byte) error {
+	for {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		keys, err := ndb.collectKeys(prefix)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
 
-		// If there is no predecessor, or the predecessor is earlier than the
-		// beginning of the lifetime (ie: negative lifetime), or the lifetime
-		// spans a single version and that version is the one being deleted, we
-		// can delete the orphan.  Otherwise, we shorten its lifetime, by
-		// moving its endpoint to the previous version.
-		if predecessor < fromVersion || fromVersion == toVersion {
-			logger.Debug("DELETE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
-			if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
-				return err
-			}
-			ndb.nodeCache.Remove(hash)
-		} else {
-			logger.Debug("MOVE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
-			err := ndb.saveOrphan(hash, fromVersion, predecessor)
-			if err != nil {
+		batch := ndb.newBatch()
+		for _, key := range keys {
+			if err := batch.Delete(key); err != nil {
+				batch.Close()
 				return err
 			}
 		}
-		return nil
-	})
+		if err := ndb.writeBatch(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// collectKeys returns copies of up to commitGap keys with the given prefix.
+func (ndb *nodeDB) collectKeys(prefix []byte) ([][]byte, error) {
+	itr, err := dbm.IteratePrefix(ndb.db, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var keys [][]byte
+	for ; itr.Valid() && uint64(len(keys)) < commitGap; itr.Next() {
+		keys = append(keys, append([]byte{}, itr.Key()...))
+	}
+	return keys, itr.Error()
 }
 
-func (ndb *nodeDB) nodeKey(hash []byte) []byte {
-	return nodeKeyFormat.KeyBytes(hash)
+// nodeKey returns the database key of the node with the given node key.
+func (ndb *nodeDB) nodeKey(nodeKey []byte) []byte {
+	if isVersionedNodeKey(nodeKey) {
+		return versionedNodeKeyFormat.KeyBytes(nodeKey[:int64Size], nodeKey[int64Size:])
+	}
+	return nodeKeyFormat.KeyBytes(nodeKey)
 }
 
 func (ndb *nodeDB) fastNodeKey(key []byte) []byte {
 	return fastKeyFormat.KeyBytes(key)
 }
 
-func (ndb *nodeDB) orphanKey(fromVersion, toVersion int64, hash []byte) []byte {
-	return orphanKeyFormat.Key(toVersion, fromVersion, hash)
-}
-
 func (ndb *nodeDB) rootKey(version int64) []byte {
 	return rootKeyFormat.Key(version)
 }
@@ -761,6 +1328,39 @@ func (ndb *nodeDB) getPreviousVersion(version int64) (int64, error) {
 	return 0, nil
 }
 
+// getNextVersion returns the first existing version at or after the given version, or 0 if
+// there is none.
+func (ndb *nodeDB) getNextVersion(version int64) (int64, error) {
+	itr, err := ndb.db.Iterator(
+		rootKeyFormat.Key(version),
+		rootKeyFormat.Key(maxVersion),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+
+	if itr.Valid() {
+		var nversion int64
+		rootKeyFormat.Scan(itr.Key(), &nversion)
+		return nversion, nil
+	}
+	return 0, itr.Error()
+}
+
+// getVersions returns the existing versions in the interval [fromVersion, toVersion), in
+// ascending order.
+func (ndb *nodeDB) getVersions(fromVersion, toVersion int64) ([]int64, error) {
+	var versions []int64
+	err := ndb.traverseRange(rootKeyFormat.Key(fromVersion), rootKeyFormat.Key(toVersion), func(k, v []byte) error {
+		var version int64
+		rootKeyFormat.Scan(k, &version)
+		versions = append(versions, version)
+		return nil
+	})
+	return versions, err
+}
+
 // deleteRoot deletes the root entry from disk, but not the node it points to.
 func (ndb *nodeDB) deleteRoot(version int64, checkLatestVersion bool) error {
 	latestVersion, err := ndb.getLatestVersion()
@@ -777,22 +1377,12 @@ func (ndb *nodeDB) deleteRoot(version int64, checkLatestVersion bool) error {
 	return nil
 }
 
-// Traverse orphans and return error if any, nil otherwise
-func (ndb *nodeDB) traverseOrphans(fn func(keyWithPrefix, v []byte) error) error {
-	return ndb.traversePrefix(orphanKeyFormat.Key(), fn)
-}
-
 // Traverse fast nodes and return error if any, nil otherwise
 // nolint: unused
 func (ndb *nodeDB) traverseFastNodes(fn func(k, v []byte) error) error {
 	return ndb.traversePrefix(fastKeyFormat.Key(), fn)
 }
 
-// Traverse orphans ending at a certain version. return error if any, nil otherwise
-func (ndb *nodeDB) traverseOrphansVersion(version int64, fn func(k, v []byte) error) error {
-	return ndb.traversePrefix(orphanKeyFormat.Key(version), fn)
-}
-
 // Traverse all keys and return error if any, nil otherwise
 // nolint: unused
 func (ndb *nodeDB) traverse(fn func(key, value []byte) error) error {
@@ -866,30 +1456,95 @@ func (ndb *nodeDB) Commit() error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
+	if ndb.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := ndb.writeBatch(ndb.batch); err != nil {
+		return err
+	}
+	ndb.batch = ndb.newBatch()
+
+	return ndb.collectBlobs()
+}
+
+// newBatch returns a new batch, which rejects all writes with ErrReadOnly if the nodeDB is
+// read-only, so that no write path can reach the database.
+func (ndb *nodeDB) newBatch() dbm.Batch {
+	if ndb.opts.ReadOnly {
+		return readOnlyBatch{}
+	}
+	return ndb.db.NewBatch()
+}
+
+// readOnlyBatch is a dbm.Batch of a read-only nodeDB.
+type readOnlyBatch struct{}
+
+var _ dbm.Batch = readOnlyBatch{}
+
+func (readOnlyBatch) Set(_, _ []byte) error { return ErrReadOnly }
+func (readOnlyBatch) Delete(_ []byte) error { return ErrReadOnly }
+func (readOnlyBatch) Write() error          { return ErrReadOnly }
+func (readOnlyBatch) WriteSync() error      { return ErrReadOnly }
+func (readOnlyBatch) Close() error          { return nil }
+
+// detachBatch returns the current batch and replaces it with a new, empty one. The caller takes
+// ownership of the returned batch, and is responsible for writing it with writeBatch.
+func (ndb *nodeDB) detachBatch() dbm.Batch {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	batch := ndb.batch
+	ndb.batch = ndb.newBatch()
+	return batch
+}
+
+// writeBatch writes the given batch to disk and closes it. It does not access any other nodeDB
+// state, and can therefore be called concurrently with the nodeDB being used.
+func (ndb *nodeDB) writeBatch(batch dbm.Batch) error {
 	var err error
 	if ndb.opts.Sync {
-		err = ndb.batch.WriteSync()
+		err = batch.WriteSync()
 	} else {
-		err = ndb.batch.Write()
+		err = batch.Write()
 	}
 	if err != nil {
 		return fmt.Errorf("failed to write batch, %w", err)
 	}
 
-	ndb.batch.Close()
-	ndb.batch = ndb.db.NewBatch()
-
-	return nil
+	return batch.Close()
 }
 
 func (ndb *nodeDB) HasRoot(version int64) (bool, error) {
 	return ndb.db.Has(ndb.rootKey(version))
 }
 
+// getRoot returns the node key of the root at the given version, an empty slice if the tree
+// is empty, or nil if the version does not exist.
 func (ndb *nodeDB) getRoot(version int64) ([]byte, error) {
 	return ndb.db.Get(ndb.rootKey(version))
 }
 
+// getRootHash returns the hash of the root at the given version, or an empty slice if the tree
+// is empty.
+func (ndb *nodeDB) getRootHash(version int64) ([]byte, error) {
+	rootKey, err := ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	if rootKey == nil {
+		return nil, ErrVersionDoesNotExist
+	}
+	if len(rootKey) == 0 {
+		return rootKey, nil
+	}
+	root, err := ndb.GetNode(rootKey)
+	if err != nil {
+		return nil, err
+	}
+	return root.hash, nil
+}
+
 func (ndb *nodeDB) getRoots() (roots map[int64][]byte, err error) {
 	roots = make(map[int64][]byte)
 	err = ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
@@ -907,7 +1562,7 @@ func (ndb *nodeDB) SaveRoot(root *Node, version int64) error {
 	if len(root.hash) == 0 {
 		return ErrRootMissingHash
 	}
-	return ndb.saveRoot(root.hash, version)
+	return ndb.saveRoot(root.nodeKey, version)
 }
 
 // SaveEmptyRoot creates an entry on disk for an empty root.
@@ -915,7 +1570,7 @@ func (ndb *nodeDB) SaveEmptyRoot(version int64) error {
 	return ndb.saveRoot([]byte{}, version)
 }
 
-func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
+func (ndb *nodeDB) saveRoot(nodeKey []byte, version int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
@@ -928,7 +1583,16 @@ func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
 		return fmt.Errorf("must save consecutive versions; expected %d, got %d", latest+1, version)
 	}
 
-	if err := ndb.batch.Set(ndb.rootKey(version), hash); err != nil {
+	if err := ndb.batch.Set(ndb.rootKey(version), nodeKey); err != nil {
+		return err
+	}
+	if err := ndb.setNodeKeyLayoutToBatch(ndb.batch); err != nil {
+		return err
+	}
+	if err := ndb.setStorageFormatToBatch(ndb.batch); err != nil {
+		return err
+	}
+	if err := ndb.setMigrationsToBatch(ndb.batch, version); err != nil {
 		return err
 	}
 
@@ -985,21 +1649,6 @@ func (ndb *nodeDB) nodes() ([]*Node, error) {
 	return nodes, nil
 }
 
-// nolint: unused
-func (ndb *nodeDB) orphans() ([][]byte, error) {
-	orphans := [][]byte{}
-
-	err := ndb.traverseOrphans(func(k, v []byte) error {
-		orphans = append(orphans, v)
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return orphans, nil
-}
-
 // Not efficient.
 // NOTE: DB cannot implement Size() because
 // mutations are not always synchronous.
@@ -1021,11 +1670,21 @@ func (ndb *nodeDB) traverseNodes(fn func(hash []byte, node *Node) error) error {
 	nodes := []*Node{}
 
 	err := ndb.traversePrefix(nodeKeyFormat.Key(), func(key, value []byte) error {
-		node, err := MakeNode(value)
+		node, err := ndb.decodeNode(key[1:], value)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = ndb.traversePrefix(versionedNodeKeyFormat.Key(), func(key, value []byte) error {
+		node, err := ndb.decodeNode(key[1:], value)
 		if err != nil {
 			return err
 		}
-		nodeKeyFormat.Scan(key, &node.hash)
 		nodes = append(nodes, node)
 		return nil
 	})
@@ -1062,17 +1721,6 @@ func (ndb *nodeDB) String() (string, error) {
 
 	buf.WriteByte('\n')
 
-	err = ndb.traverseOrphans(func(key, value []byte) error {
-		fmt.Fprintf(buf, "%s: %x\n", key, value)
-		return nil
-	})
-
-	if err != nil {
-		return "", err
-	}
-
-	buf.WriteByte('\n')
-
 	err = ndb.traverseNodes(func(hash []byte, node *Node) error {
 		switch {
 		case len(hash) == 0:
@@ -3,6 +3,7 @@ package iavl
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/rand"
 	"strconv"
 	"testing"
@@ -22,14 +23,6 @@ func BenchmarkNodeKey(b *testing.B) {
 	}
 }
 
-func BenchmarkOrphanKey(b *testing.B) {
-	ndb := &nodeDB{}
-	hashes := makeHashes(b, 2432325)
-	for i := 0; i < b.N; i++ {
-		ndb.orphanKey(1234, 1239, hashes[i])
-	}
-}
-
 func BenchmarkTreeString(b *testing.B) {
 	tree := makeAndPopulateMutableTree(b)
 	b.ReportAllocs()
@@ -45,60 +38,69 @@ func BenchmarkTreeString(b *testing.B) {
 	sink = (interface{})(nil)
 }
 
-func TestNewNoDbStorage_StorageVersionInDb_Success(t *testing.T) {
-	const expectedVersion = defaultStorageVersionValue
+func TestNewNoDbStorage_FastStorageInDb_Success(t *testing.T) {
+	const expectedVersion = 5
 
 	ctrl := gomock.NewController(t)
 	dbMock := mock.NewMockDB(ctrl)
 
-	dbMock.EXPECT().Get(gomock.Any()).Return([]byte(expectedVersion), nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(migrationKey(fastStorageMigrationID)).Return([]byte(strconv.Itoa(expectedVersion)), nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(nil).Times(1)
 
 	ndb := newNodeDB(dbMock, 0, nil)
-	require.Equal(t, expectedVersion, ndb.storageVersion)
+	require.Equal(t, int64(expectedVersion), ndb.fastStorageVersion)
+	require.True(t, ndb.hasUpgradedToFastStorage())
 }
 
 func TestNewNoDbStorage_ErrorInConstructor_DefaultSet(t *testing.T) {
-	const expectedVersion = defaultStorageVersionValue
-
 	ctrl := gomock.NewController(t)
 	dbMock := mock.NewMockDB(ctrl)
 
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, errors.New("some db error")).Times(1)
 	dbMock.EXPECT().NewBatch().Return(nil).Times(1)
 
 	ndb := newNodeDB(dbMock, 0, nil)
-	require.Equal(t, expectedVersion, ndb.getStorageVersion())
+	require.False(t, ndb.hasUpgradedToFastStorage())
 }
 
 func TestNewNoDbStorage_DoesNotExist_DefaultSet(t *testing.T) {
-	const expectedVersion = defaultStorageVersionValue
-
 	ctrl := gomock.NewController(t)
 	dbMock := mock.NewMockDB(ctrl)
 
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(nil).Times(1)
 
 	ndb := newNodeDB(dbMock, 0, nil)
-	require.Equal(t, expectedVersion, ndb.getStorageVersion())
+	require.False(t, ndb.hasUpgradedToFastStorage())
 }
 
 func TestSetStorageVersion_Success(t *testing.T) {
-	const expectedVersion = fastStorageVersionValue
-
 	db := db.NewMemDB()
 
 	ndb := newNodeDB(db, 0, nil)
-	require.Equal(t, defaultStorageVersionValue, ndb.getStorageVersion())
+	require.False(t, ndb.hasUpgradedToFastStorage())
 
 	err := ndb.setFastStorageVersionToBatch()
 	require.NoError(t, err)
 
 	latestVersion, err := ndb.getLatestVersion()
 	require.NoError(t, err)
-	require.Equal(t, expectedVersion+fastStorageVersionDelimiter+strconv.Itoa(int(latestVersion)), ndb.getStorageVersion())
+	require.Equal(t, latestVersion, ndb.fastStorageVersion)
 	require.NoError(t, ndb.batch.Write())
+
+	version, done, err := ndb.getMigration(fastStorageMigrationID)
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Equal(t, latestVersion, version)
 }
 
 func TestSetStorageVersion_DBFailure_OldKept(t *testing.T) {
@@ -111,7 +113,10 @@ func TestSetStorageVersion_DBFailure_OldKept(t *testing.T) {
 
 	expectedFastCacheVersion := 2
 
-	dbMock.EXPECT().Get(gomock.Any()).Return([]byte(defaultStorageVersionValue), nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hasherKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(compressionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(blobThresholdKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
 
 	// rIterMock is used to get the latest version from disk. We are mocking that rIterMock returns latestTreeVersion from disk
@@ -120,87 +125,94 @@ func TestSetStorageVersion_DBFailure_OldKept(t *testing.T) {
 	rIterMock.EXPECT().Close().Return(nil).Times(1)
 
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
-	batchMock.EXPECT().Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(fastStorageVersionValue+fastStorageVersionDelimiter+strconv.Itoa(expectedFastCacheVersion))).Return(errors.New(expectedErrorMsg)).Times(1)
-
-	ndb := newNodeDB(dbMock, 0, nil)
-	require.Equal(t, defaultStorageVersionValue, ndb.getStorageVersion())
-
-	err := ndb.setFastStorageVersionToBatch()
-	require.Error(t, err)
-	require.Equal(t, expectedErrorMsg, err.Error())
-	require.Equal(t, defaultStorageVersionValue, ndb.getStorageVersion())
-}
-
-func TestSetStorageVersion_InvalidVersionFailure_OldKept(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	dbMock := mock.NewMockDB(ctrl)
-	batchMock := mock.NewMockBatch(ctrl)
-
-	expectedErrorMsg := errInvalidFastStorageVersion
-
-	invalidStorageVersion := fastStorageVersionValue + fastStorageVersionDelimiter + "1" + fastStorageVersionDelimiter + "2"
-
-	dbMock.EXPECT().Get(gomock.Any()).Return([]byte(invalidStorageVersion), nil).Times(1)
-	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
+	batchMock.EXPECT().Set(migrationKey(fastStorageMigrationID), []byte(strconv.Itoa(expectedFastCacheVersion))).Return(errors.New(expectedErrorMsg)).Times(1)
 
 	ndb := newNodeDB(dbMock, 0, nil)
-	require.Equal(t, invalidStorageVersion, ndb.getStorageVersion())
+	require.False(t, ndb.hasUpgradedToFastStorage())
 
 	err := ndb.setFastStorageVersionToBatch()
 	require.Error(t, err)
 	require.Equal(t, expectedErrorMsg, err.Error())
-	require.Equal(t, invalidStorageVersion, ndb.getStorageVersion())
+	require.False(t, ndb.hasUpgradedToFastStorage())
 }
 
-func TestSetStorageVersion_FastVersionFirst_VersionAppended(t *testing.T) {
+func TestSetStorageVersion_SameVersionTwice(t *testing.T) {
 	db := db.NewMemDB()
 	ndb := newNodeDB(db, 0, nil)
-	ndb.storageVersion = fastStorageVersionValue
 	ndb.latestVersion = 100
 
 	err := ndb.setFastStorageVersionToBatch()
 	require.NoError(t, err)
-	require.Equal(t, fastStorageVersionValue+fastStorageVersionDelimiter+strconv.Itoa(int(ndb.latestVersion)), ndb.storageVersion)
-}
+	require.Equal(t, ndb.latestVersion, ndb.fastStorageVersion)
 
-func TestSetStorageVersion_FastVersionSecond_VersionAppended(t *testing.T) {
-	db := db.NewMemDB()
-	ndb := newNodeDB(db, 0, nil)
-	ndb.latestVersion = 100
-
-	storageVersionBytes := []byte(fastStorageVersionValue)
-	storageVersionBytes[len(fastStorageVersionValue)-1]++ // increment last byte
-	ndb.storageVersion = string(storageVersionBytes)
-
-	err := ndb.setFastStorageVersionToBatch()
+	err = ndb.setFastStorageVersionToBatch()
 	require.NoError(t, err)
-	require.Equal(t, string(storageVersionBytes)+fastStorageVersionDelimiter+strconv.Itoa(int(ndb.latestVersion)), ndb.storageVersion)
+	require.Equal(t, ndb.latestVersion, ndb.fastStorageVersion)
 }
 
-func TestSetStorageVersion_SameVersionTwice(t *testing.T) {
+func TestMigrateStorageVersion(t *testing.T) {
+	const latestVersion = 100
+
+	storageVersionSecond := []byte(fastStorageVersionValue)
+	storageVersionSecond[len(fastStorageVersionValue)-1]++ // increment last byte
+
+	testCases := []struct {
+		name               string
+		storageVersion     string
+		fastStorageVersion int64
+	}{
+		{"no storage version", "", -1},
+		{"default version", defaultStorageVersionValue, -1},
+		{"fast version without latest version", fastStorageVersionValue, latestVersion},
+		{"fast version", fastStorageVersionValue + fastStorageVersionDelimiter + "99", 99},
+		{"second fast version", string(storageVersionSecond) + fastStorageVersionDelimiter + "99", 99},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := db.NewMemDB()
+			if tc.storageVersion != "" {
+				require.NoError(t, db.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(tc.storageVersion)))
+			}
+			ndb := newNodeDB(db, 0, nil)
+			ndb.latestVersion = latestVersion
+
+			require.NoError(t, ndb.migrateStorageVersion())
+			require.Equal(t, tc.fastStorageVersion, ndb.fastStorageVersion)
+
+			has, err := db.Has(metadataKeyFormat.Key([]byte(storageVersionKey)))
+			require.NoError(t, err)
+			require.False(t, has)
+			_, done, err := ndb.getMigration(storageVersionMigrationID)
+			require.NoError(t, err)
+			require.True(t, done)
+
+			// The fast storage version is read back from disk.
+			ndb = newNodeDB(db, 0, nil)
+			require.Equal(t, tc.fastStorageVersion, ndb.fastStorageVersion)
+		})
+	}
+}
+
+func TestMigrateStorageVersion_InvalidVersionFailure_OldKept(t *testing.T) {
+	invalidStorageVersion := fastStorageVersionValue + fastStorageVersionDelimiter + "1" + fastStorageVersionDelimiter + "2"
+
 	db := db.NewMemDB()
+	require.NoError(t, db.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(invalidStorageVersion)))
 	ndb := newNodeDB(db, 0, nil)
-	ndb.latestVersion = 100
 
-	storageVersionBytes := []byte(fastStorageVersionValue)
-	storageVersionBytes[len(fastStorageVersionValue)-1]++ // increment last byte
-	ndb.storageVersion = string(storageVersionBytes)
-
-	err := ndb.setFastStorageVersionToBatch()
-	require.NoError(t, err)
-	newStorageVersion := string(storageVersionBytes) + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion))
-	require.Equal(t, newStorageVersion, ndb.storageVersion)
+	err := ndb.migrateStorageVersion()
+	require.Error(t, err)
+	require.Equal(t, errInvalidFastStorageVersion, err.Error())
+	require.False(t, ndb.hasUpgradedToFastStorage())
 
-	err = ndb.setFastStorageVersionToBatch()
+	storageVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
 	require.NoError(t, err)
-	require.Equal(t, newStorageVersion, ndb.storageVersion)
+	require.Equal(t, invalidStorageVersion, string(storageVersion))
 }
 
-// Test case where version is incorrect and has some extra garbage at the end
-func TestShouldForceFastStorageUpdate_DefaultVersion_True(t *testing.T) {
+func TestShouldForceFastStorageUpdate_NotUpgraded_False(t *testing.T) {
 	db := db.NewMemDB()
 	ndb := newNodeDB(db, 0, nil)
-	ndb.storageVersion = defaultStorageVersionValue
 	ndb.latestVersion = 100
 
 	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
@@ -212,7 +224,7 @@ func TestShouldForceFastStorageUpdate_FastVersion_Greater_True(t *testing.T) {
 	db := db.NewMemDB()
 	ndb := newNodeDB(db, 0, nil)
 	ndb.latestVersion = 100
-	ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion+1))
+	ndb.fastStorageVersion = ndb.latestVersion + 1
 
 	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
 	require.True(t, shouldForce)
@@ -223,7 +235,7 @@ func TestShouldForceFastStorageUpdate_FastVersion_Smaller_True(t *testing.T) {
 	db := db.NewMemDB()
 	ndb := newNodeDB(db, 0, nil)
 	ndb.latestVersion = 100
-	ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion-1))
+	ndb.fastStorageVersion = ndb.latestVersion - 1
 
 	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
 	require.True(t, shouldForce)
@@ -234,7 +246,7 @@ func TestShouldForceFastStorageUpdate_FastVersion_Match_False(t *testing.T) {
 	db := db.NewMemDB()
 	ndb := newNodeDB(db, 0, nil)
 	ndb.latestVersion = 100
-	ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion))
+	ndb.fastStorageVersion = ndb.latestVersion
 
 	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
 	require.False(t, shouldForce)
@@ -245,7 +257,7 @@ func TestIsFastStorageEnabled_True(t *testing.T) {
 	db := db.NewMemDB()
 	ndb := newNodeDB(db, 0, nil)
 	ndb.latestVersion = 100
-	ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion))
+	ndb.fastStorageVersion = ndb.latestVersion
 
 	require.True(t, ndb.hasUpgradedToFastStorage())
 }
@@ -254,11 +266,8 @@ func TestIsFastStorageEnabled_False(t *testing.T) {
 	db := db.NewMemDB()
 	ndb := newNodeDB(db, 0, nil)
 	ndb.latestVersion = 100
-	ndb.storageVersion = defaultStorageVersionValue
 
-	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
-	require.False(t, shouldForce)
-	require.NoError(t, err)
+	require.False(t, ndb.hasUpgradedToFastStorage())
 }
 
 func makeHashes(b *testing.B, seed int64) [][]byte {
@@ -293,3 +302,258 @@ func makeAndPopulateMutableTree(tb testing.TB) *MutableTree {
 	require.Nil(tb, err, "Expected .SaveVersion to succeed")
 	return tree
 }
+
+func TestSaveBranch_ParallelHashingIsDeterministic(t *testing.T) {
+	build := func(parallel bool) (db.DB, [][]byte) {
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTree(memDB, 0, false)
+		require.NoError(t, err)
+
+		r := rand.New(rand.NewSource(42))
+		hashes := [][]byte{}
+		for v := 0; v < 5; v++ {
+			for i := 0; i < 2000; i++ {
+				key := []byte(strconv.Itoa(r.Intn(5000)))
+				if r.Intn(4) == 0 {
+					_, _, err = tree.Remove(key)
+				} else {
+					_, err = tree.Set(key, []byte(strconv.Itoa(r.Int())))
+				}
+				require.NoError(t, err)
+			}
+			// Nodes hashed up front keep their hashes when the version is saved.
+			if parallel && v > 0 {
+				require.NoError(t, hashBranch(tree.root, SHA256Hasher, 2))
+			}
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			hashes = append(hashes, hash)
+		}
+		return memDB, hashes
+	}
+
+	sequentialDB, sequentialHashes := build(false)
+	parallelDB, parallelHashes := build(true)
+	require.Equal(t, sequentialHashes, parallelHashes)
+
+	sequentialItr, err := sequentialDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer sequentialItr.Close()
+	parallelItr, err := parallelDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer parallelItr.Close()
+
+	for ; sequentialItr.Valid(); sequentialItr.Next() {
+		require.True(t, parallelItr.Valid())
+		require.Equal(t, sequentialItr.Key(), parallelItr.Key())
+		require.Equal(t, sequentialItr.Value(), parallelItr.Value())
+		parallelItr.Next()
+	}
+	require.False(t, parallelItr.Valid())
+}
+
+func TestSaveBranch_GenesisFlushesEachNode(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+
+	root := tree.root
+	saved, written, err := tree.ndb.saveBranch(root, genesisVersion)
+	require.NoError(t, err)
+	require.Nil(t, saved)
+	require.Equal(t, nodeCount(root), written)
+	require.Nil(t, root.leftNode)
+	require.Nil(t, root.rightNode)
+
+	// The nodes are on disk before the batch is committed.
+	value, err := memDB.Get(tree.ndb.nodeKey(root.nodeKey))
+	require.NoError(t, err)
+	require.NotNil(t, value)
+}
+
+// applyRandomVersion applies the same random changes to each tree and saves a version of them.
+func applyRandomVersion(t *testing.T, r *rand.Rand, trees ...*MutableTree) [][]byte {
+	ops := make([][2]int, 300)
+	for i := range ops {
+		ops[i] = [2]int{r.Intn(1000), r.Intn(4)}
+	}
+	hashes := make([][]byte, 0, len(trees))
+	for _, tree := range trees {
+		for _, op := range ops {
+			key := []byte(strconv.Itoa(op[0]))
+			var err error
+			if op[1] == 0 {
+				_, _, err = tree.Remove(key)
+			} else {
+				_, err = tree.Set(key, []byte(strconv.Itoa(op[0]*op[1])))
+			}
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// requireSameVersions checks that both trees have the same versions with the same contents.
+func requireSameVersions(t *testing.T, expected, actual *MutableTree) {
+	require.Equal(t, expected.AvailableVersions(), actual.AvailableVersions())
+	for _, version := range expected.AvailableVersions() {
+		expectedTree, err := expected.GetImmutable(int64(version))
+		require.NoError(t, err)
+		actualTree, err := actual.GetImmutable(int64(version))
+		require.NoError(t, err)
+
+		expectedHash, err := expectedTree.Hash()
+		require.NoError(t, err)
+		actualHash, err := actualTree.Hash()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, actualHash, "version %d", version)
+
+		var expectedPairs, actualPairs [][]byte
+		_, err = expectedTree.Iterate(func(key, value []byte) bool {
+			expectedPairs = append(expectedPairs, key, value)
+			return false
+		})
+		require.NoError(t, err)
+		_, err = actualTree.Iterate(func(key, value []byte) bool {
+			actualPairs = append(actualPairs, key, value)
+			return false
+		})
+		require.NoError(t, err)
+		require.Equal(t, expectedPairs, actualPairs, "version %d", version)
+	}
+}
+
+func countPrefix(t *testing.T, memDB db.DB, prefix []byte) int {
+	itr, err := db.IteratePrefix(memDB, prefix)
+	require.NoError(t, err)
+	defer itr.Close()
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	return count
+}
+
+func TestVersionKeyedNodes(t *testing.T) {
+	legacyDB := db.NewMemDB()
+	legacyTree, err := NewMutableTree(legacyDB, 0, false)
+	require.NoError(t, err)
+	versionedDB := db.NewMemDB()
+	versionedTree, err := NewMutableTreeWithOpts(versionedDB, 0, &Options{VersionKeyedNodes: true}, false)
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(7))
+	for v := int64(1); v <= 20; v++ {
+		hashes := applyRandomVersion(t, r, legacyTree, versionedTree)
+		require.Equal(t, hashes[0], hashes[1])
+		if v%4 == 0 {
+			require.NoError(t, legacyTree.DeleteVersionsRange(v-3, v-1))
+			require.NoError(t, versionedTree.DeleteVersionsRange(v-3, v-1))
+		}
+	}
+
+	require.Zero(t, countPrefix(t, versionedDB, nodeKeyFormat.Key()))
+	require.NotZero(t, countPrefix(t, versionedDB, versionedNodeKeyFormat.Key()))
+	layout, err := versionedDB.Get(metadataKeyFormat.Key([]byte(nodeKeyLayoutKey)))
+	require.NoError(t, err)
+	require.Equal(t, versionedNodeKeyLayout, string(layout))
+
+	// The layout is kept when reopening the database without the option.
+	versionedTree, err = NewMutableTree(versionedDB, 0, false)
+	require.NoError(t, err)
+	_, err = versionedTree.Load()
+	require.NoError(t, err)
+	requireSameVersions(t, legacyTree, versionedTree)
+
+	// Overwriting versions deletes the nodes of the newer versions.
+	_, err = legacyTree.LoadVersionForOverwriting(19)
+	require.NoError(t, err)
+	_, err = versionedTree.LoadVersionForOverwriting(19)
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		hashes := applyRandomVersion(t, r, legacyTree, versionedTree)
+		require.Equal(t, hashes[0], hashes[1])
+	}
+	requireSameVersions(t, legacyTree, versionedTree)
+	require.NoError(t, versionedTree.DeleteVersionsRange(1, 23))
+	require.NoError(t, legacyTree.DeleteVersionsRange(1, 23))
+	requireSameVersions(t, legacyTree, versionedTree)
+	require.Equal(t, countPrefix(t, legacyDB, nodeKeyFormat.Key()), countPrefix(t, versionedDB, versionedNodeKeyFormat.Key()))
+
+	// Imports into an empty database use the version-keyed layout too.
+	exported, err := versionedTree.GetImmutable(versionedTree.Version())
+	require.NoError(t, err)
+	exporter, err := exported.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	importedDB := db.NewMemDB()
+	importedTree, err := NewMutableTreeWithOpts(importedDB, 0, &Options{VersionKeyedNodes: true}, false)
+	require.NoError(t, err)
+	importer, err := importedTree.Import(versionedTree.Version())
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	require.Zero(t, countPrefix(t, importedDB, nodeKeyFormat.Key()))
+
+	expectedHash, err := versionedTree.Hash()
+	require.NoError(t, err)
+	importedHash, err := importedTree.Hash()
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, importedHash)
+	for i := int64(0); i < exported.Size(); i++ {
+		expectedKey, expectedValue, err := exported.GetByIndex(i)
+		require.NoError(t, err)
+		key, value, err := importedTree.GetByIndex(i)
+		require.NoError(t, err)
+		require.Equal(t, expectedKey, key)
+		require.Equal(t, expectedValue, value)
+	}
+}
+
+func TestDeleteOrphanIndex(t *testing.T) {
+	tmpCommitGap := commitGap
+	t.Cleanup(func() {
+		commitGap = tmpCommitGap
+	})
+	commitGap = 10
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(5))
+	for v := 0; v < 3; v++ {
+		applyRandomVersion(t, r, tree)
+	}
+
+	// Orphan entries as written by earlier releases.
+	for i := 0; i < 25; i++ {
+		hash := make([]byte, hashSize)
+		r.Read(hash)
+		require.NoError(t, memDB.Set(orphanKeyFormat.Key(int64(i+1), int64(i), hash), hash))
+	}
+
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Zero(t, countPrefix(t, memDB, orphanKeyFormat.Key()))
+
+	require.NoError(t, tree.DeleteVersionsRange(1, 3))
+	assertNoStrayNodes(t, tree)
+}
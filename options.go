@@ -81,6 +81,47 @@ type Options struct {
 
 	// When Stat is not nil, statistical logic needs to be executed
 	Stat *Statistics
+
+	// Metrics receives measurements of commits, pruning, database reads and writes, iterators
+	// and the fast node index, e.g. a PrometheusMetrics. Nothing is measured when it is nil.
+	Metrics Metrics
+
+	// Logger logs the loading of versions, migrations, fast storage upgrades and pruning, and at
+	// debug level the nodes saved and deleted. Nothing is logged when it is nil.
+	Logger Logger
+
+	// Tracer starts spans around tree operations, which record the nodes they load. Nothing is
+	// traced when it is nil.
+	Tracer Tracer
+
+	// VersionKeyedNodes stores nodes by the version they were saved at and a sequence number,
+	// instead of by their hash, which keeps the nodes of a version close together on disk. It
+	// applies to new databases, while existing databases are migrated when loaded. Once enabled,
+	// the layout is recorded in the database and can't be reverted.
+	VersionKeyedNodes bool
+
+	// Compression compresses the values of leaf nodes and fast nodes on disk. It applies to new
+	// databases and is recorded in the database, which keeps using it when the option is unset.
+	// Giving a different compression for an existing database returns an error. Hashes and
+	// proofs are always computed from the uncompressed values.
+	Compression Compression
+
+	// BlobThreshold stores values of at least this many bytes once under their hash, with leaf
+	// nodes and fast nodes only referencing them, instead of copying them into every node. Blobs
+	// are deleted when the last node referencing them is pruned. Like Compression, it applies to
+	// new databases and is recorded in the database. 0 stores all values inline.
+	BlobThreshold int
+
+	// Hasher is the hash function of the nodes, SHA256Hasher if unset. Like Compression, it
+	// applies to new databases and is recorded in the database, and a different hasher for an
+	// existing database returns an error when loading it.
+	Hasher Hasher
+
+	// ReadOnly opens the database without ever writing to it, e.g. for inspection tools or for
+	// a second process reading a database another process writes to. Loading the tree runs no
+	// migrations, and ignores a fast node index which does not match the latest version instead
+	// of rebuilding it. Saving, deleting or importing versions returns ErrReadOnly.
+	ReadOnly bool
 }
 
 // DefaultOptions returns the default options for IAVL.
@@ -0,0 +1,133 @@
+package iavl
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelSubtreesPerWorker is the number of subtrees the range is split into per worker, so
+// that workers finishing small subtrees early pick up more work.
+const parallelSubtreesPerWorker = 4
+
+// rangeSubtree is the subtree of a node, whose keys are within [lo, hi), where a nil bound leaves
+// the subtree open on that side.
+type rangeSubtree struct {
+	node   *Node
+	lo, hi []byte
+}
+
+// overlaps returns true if the keys of the subtree may be within [start, end).
+func (s rangeSubtree) overlaps(start, end []byte) bool {
+	return (end == nil || s.lo == nil || bytes.Compare(s.lo, end) < 0) &&
+		(start == nil || s.hi == nil || bytes.Compare(s.hi, start) > 0)
+}
+
+// ParallelIterate calls fn for each key in the range [start, end) of the tree, where a nil start
+// or end leaves the range open on that side, using the given number of workers, or GOMAXPROCS
+// workers if it is not positive.
+//
+// The range is split at the keys of the inner nodes into disjoint subtrees, which the workers
+// walk concurrently. So fn is called concurrently, and in no particular order. The iteration
+// stops once fn returns true, in which case stopped is true, although calls already in progress
+// on other workers complete.
+func (t *ImmutableTree) ParallelIterate(start, end []byte, workers int, fn func(key, value []byte) bool) (stopped bool, err error) {
+	if t.root == nil {
+		return false, nil
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	subtrees, err := t.splitRange(start, end, workers*parallelSubtreesPerWorker)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		firstErr error
+		stop     int32
+	)
+	queue := make(chan *Node, len(subtrees))
+	for _, subtree := range subtrees {
+		queue <- subtree.node
+	}
+	close(queue)
+
+	for i := 0; i < workers && i < len(subtrees); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for root := range queue {
+				traversal := root.newTraversal(t, start, end, true, false, false)
+				for atomic.LoadInt32(&stop) == 0 {
+					node, err := traversal.next()
+					if err != nil {
+						mtx.Lock()
+						if firstErr == nil {
+							firstErr = err
+						}
+						mtx.Unlock()
+						atomic.StoreInt32(&stop, 1)
+						return
+					}
+					if node == nil {
+						break
+					}
+					if node.isLeaf() && fn(node.key, node.value) {
+						atomic.StoreInt32(&stop, 1)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return atomic.LoadInt32(&stop) == 1, nil
+}
+
+// splitRange splits the subtrees of the tree which overlap the range [start, end) level by level,
+// until there are at least the given number of them or only leaves remain, and returns them in
+// ascending order.
+func (t *ImmutableTree) splitRange(start, end []byte, count int) ([]rangeSubtree, error) {
+	subtrees := []rangeSubtree{{node: t.root}}
+	for len(subtrees) < count {
+		split := false
+		next := make([]rangeSubtree, 0, 2*len(subtrees))
+		for _, subtree := range subtrees {
+			if subtree.node.isLeaf() {
+				next = append(next, subtree)
+				continue
+			}
+			leftNode, err := subtree.node.getLeftNode(t)
+			if err != nil {
+				return nil, err
+			}
+			rightNode, err := subtree.node.getRightNode(t)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range []rangeSubtree{
+				{node: leftNode, lo: subtree.lo, hi: subtree.node.key},
+				{node: rightNode, lo: subtree.node.key, hi: subtree.hi},
+			} {
+				if child.overlaps(start, end) {
+					next = append(next, child)
+				}
+			}
+			split = true
+		}
+		subtrees = next
+		if !split {
+			break
+		}
+	}
+	return subtrees, nil
+}
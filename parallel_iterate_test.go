@@ -0,0 +1,90 @@
+package iavl
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutableTree_ParallelIterate(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%04d", i))
+	}
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set(key(i), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Load the tree from the database, so that the workers load the nodes concurrently.
+	loaded, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	immutable, err := loaded.GetImmutable(version)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		start, end []byte
+		workers    int
+		from, to   int
+	}{
+		{nil, nil, 4, 0, 1000},
+		{nil, nil, 0, 0, 1000},
+		{nil, nil, 1, 0, 1000},
+		{key(100), key(900), 8, 100, 900},
+		{key(500), nil, 3, 500, 1000},
+		{nil, key(1), 16, 0, 1},
+		{key(2000), nil, 4, 0, 0},
+		{nil, nil, 5000, 0, 1000},
+	}
+	for _, tc := range testCases {
+		var mtx sync.Mutex
+		var keys []string
+		stopped, err := immutable.ParallelIterate(tc.start, tc.end, tc.workers, func(k, v []byte) bool {
+			mtx.Lock()
+			defer mtx.Unlock()
+			keys = append(keys, string(k))
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+
+		var expected []string
+		for i := tc.from; i < tc.to; i++ {
+			expected = append(expected, string(key(i)))
+		}
+		sort.Strings(keys)
+		require.Equal(t, expected, keys, "range [%X, %X) with %d workers", tc.start, tc.end, tc.workers)
+	}
+
+	// The iteration stops once fn returns true.
+	var mtx sync.Mutex
+	count := 0
+	stopped, err := immutable.ParallelIterate(nil, nil, 4, func(k, v []byte) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		count++
+		return count >= 10
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Less(t, count, 1000)
+
+	// Errors loading nodes are returned.
+	require.NoError(t, memDB.Delete(loaded.ndb.nodeKey(immutable.root.leftNodeKey)))
+	reloaded, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	_, err = reloaded.ParallelIterate(nil, nil, 4, func(k, v []byte) bool { return false })
+	require.Error(t, err)
+}
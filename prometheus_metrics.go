@@ -0,0 +1,144 @@
+package iavl
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics is a Metrics exporting the measurements as Prometheus metrics, under the
+// "iavl" subsystem of the given namespace.
+type PrometheusMetrics struct {
+	saveVersionDuration   prometheus.Histogram
+	nodesWritten          prometheus.Histogram
+	orphansWritten        prometheus.Counter
+	orphansDeleted        prometheus.Counter
+	bytesRead             prometheus.Counter
+	bytesWritten          prometheus.Counter
+	deleteVersionDuration prometheus.Histogram
+	iterators             *prometheus.CounterVec
+	fastStorageGets       *prometheus.CounterVec
+}
+
+var _ Metrics = (*PrometheusMetrics)(nil)
+
+// NewPrometheusMetrics returns a PrometheusMetrics with metrics registered with the given
+// registerer, e.g. prometheus.DefaultRegisterer. Trees sharing a registerer must either share
+// the PrometheusMetrics or use different namespaces.
+func NewPrometheusMetrics(namespace string, registerer prometheus.Registerer) (*PrometheusMetrics, error) {
+	const subsystem = "iavl"
+	m := &PrometheusMetrics{
+		saveVersionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "save_version_duration_seconds",
+			Help:      "Time taken to save a version.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		}),
+		nodesWritten: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "nodes_written",
+			Help:      "Number of nodes written per saved version.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 12),
+		}),
+		orphansWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "orphans_written_total",
+			Help:      "Number of nodes orphaned by saved versions.",
+		}),
+		orphansDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "orphans_deleted_total",
+			Help:      "Number of orphaned nodes deleted by pruning.",
+		}),
+		bytesRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "read_bytes_total",
+			Help:      "Number of bytes of nodes, fast nodes and blobs read from the database.",
+		}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "written_bytes_total",
+			Help:      "Number of bytes of nodes, fast nodes and blobs written to the database.",
+		}),
+		deleteVersionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "delete_version_duration_seconds",
+			Help:      "Time taken to delete versions.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		}),
+		iterators: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "iterators_total",
+			Help:      "Number of iterators created, by kind.",
+		}, []string{"kind"}),
+		fastStorageGets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "fast_storage_gets_total",
+			Help:      "Number of gets which tried the fast node index, by whether it answered them.",
+		}, []string{"result"}),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		m.saveVersionDuration, m.nodesWritten, m.orphansWritten, m.orphansDeleted, m.bytesRead,
+		m.bytesWritten, m.deleteVersionDuration, m.iterators, m.fastStorageGets,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ObserveSaveVersion implements Metrics.
+func (m *PrometheusMetrics) ObserveSaveVersion(duration time.Duration, nodesWritten int) {
+	m.saveVersionDuration.Observe(duration.Seconds())
+	m.nodesWritten.Observe(float64(nodesWritten))
+}
+
+// AddOrphansWritten implements Metrics.
+func (m *PrometheusMetrics) AddOrphansWritten(n int) {
+	m.orphansWritten.Add(float64(n))
+}
+
+// AddOrphansDeleted implements Metrics.
+func (m *PrometheusMetrics) AddOrphansDeleted(n int) {
+	m.orphansDeleted.Add(float64(n))
+}
+
+// AddBytesRead implements Metrics.
+func (m *PrometheusMetrics) AddBytesRead(n int) {
+	m.bytesRead.Add(float64(n))
+}
+
+// AddBytesWritten implements Metrics.
+func (m *PrometheusMetrics) AddBytesWritten(n int) {
+	m.bytesWritten.Add(float64(n))
+}
+
+// ObserveDeleteVersion implements Metrics.
+func (m *PrometheusMetrics) ObserveDeleteVersion(duration time.Duration) {
+	m.deleteVersionDuration.Observe(duration.Seconds())
+}
+
+// IncIterators implements Metrics.
+func (m *PrometheusMetrics) IncIterators(kind string) {
+	m.iterators.WithLabelValues(kind).Inc()
+}
+
+// IncFastStorageGets implements Metrics.
+func (m *PrometheusMetrics) IncFastStorageGets(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.fastStorageGets.WithLabelValues(result).Inc()
+}
@@ -2,7 +2,6 @@ package iavl
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"sync"
@@ -60,9 +59,14 @@ func (pin ProofInnerNode) stringIndented(indent string) string {
 		indent)
 }
 
+// Hash returns the SHA-256 hash of the inner node, given the hash of the child on the path.
 func (pin ProofInnerNode) Hash(childHash []byte) ([]byte, error) {
-	hasher := sha256.New()
+	return pin.HashWith(SHA256Hasher, childHash)
+}
 
+// HashWith returns the hash of the inner node computed by the given hasher, given the hash of
+// the child on the path.
+func (pin ProofInnerNode) HashWith(hasher Hasher, childHash []byte) ([]byte, error) {
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufPool.Put(buf)
@@ -99,11 +103,7 @@ func (pin ProofInnerNode) Hash(childHash []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to hash ProofInnerNode: %v", err)
 	}
 
-	_, err = hasher.Write(buf.Bytes())
-	if err != nil {
-		return nil, err
-	}
-	return hasher.Sum(nil), nil
+	return hasher.sum(buf.Bytes())
 }
 
 //----------------------------------------
@@ -130,9 +130,13 @@ func (pln ProofLeafNode) stringIndented(indent string) string {
 		indent)
 }
 
+// Hash returns the SHA-256 hash of the leaf node.
 func (pln ProofLeafNode) Hash() ([]byte, error) {
-	hasher := sha256.New()
+	return pln.HashWith(SHA256Hasher)
+}
 
+// HashWith returns the hash of the leaf node computed by the given hasher.
+func (pln ProofLeafNode) HashWith(hasher Hasher) ([]byte, error) {
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufPool.Put(buf)
@@ -153,12 +157,8 @@ func (pln ProofLeafNode) Hash() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash ProofLeafNode: %v", err)
 	}
-	_, err = hasher.Write(buf.Bytes())
-	if err != nil {
-		return nil, err
-	}
 
-	return hasher.Sum(nil), nil
+	return hasher.sum(buf.Bytes())
 }
 
 //----------------------------------------
@@ -0,0 +1,143 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// RangeAbsenceProof proves that a tree has no key in the range [Start, End), where a nil
+// Start or End leaves the range open on that side. With both nil, it proves that the tree is
+// empty.
+//
+// The proof consists of index proofs of the neighbours of the range: the greatest key below
+// Start, and the smallest key from End on. They prove the absence of keys in between by being
+// adjacent, or by being the first or last key of the tree if one of them is missing. If both
+// are missing, the tree is empty.
+type RangeAbsenceProof struct {
+	Start []byte      `json:"start,omitempty"`
+	End   []byte      `json:"end,omitempty"`
+	Left  *IndexProof `json:"left,omitempty"`
+	Right *IndexProof `json:"right,omitempty"`
+}
+
+// GetRangeAbsenceProof returns a proof that the tree has no key in the range [start, end),
+// where a nil start or end leaves the range open on that side. It returns an error if the
+// range contains a key.
+func (t *ImmutableTree) GetRangeAbsenceProof(start, end []byte) (*RangeAbsenceProof, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, fmt.Errorf("invalid range [%X, %X)", start, end)
+	}
+
+	// The index of the first key from start on, or from end on, is the number of keys below.
+	startIndex, endIndex := int64(0), t.Size()
+	var err error
+	if start != nil {
+		if startIndex, _, err = t.GetWithIndex(start); err != nil {
+			return nil, err
+		}
+	}
+	if end != nil {
+		if endIndex, _, err = t.GetWithIndex(end); err != nil {
+			return nil, err
+		}
+	}
+	if startIndex != endIndex {
+		return nil, fmt.Errorf("range [%X, %X) contains %d keys", start, end, endIndex-startIndex)
+	}
+
+	proof := &RangeAbsenceProof{Start: start, End: end}
+	if startIndex > 0 {
+		if proof.Left, err = t.GetIndexProof(startIndex - 1); err != nil {
+			return nil, err
+		}
+	}
+	if endIndex < t.Size() {
+		if proof.Right, err = t.GetIndexProof(endIndex); err != nil {
+			return nil, err
+		}
+	}
+	return proof, nil
+}
+
+// GetPrefixAbsenceProof returns a proof that the tree has no key with the given prefix. It
+// returns an error if there is such a key.
+func (t *ImmutableTree) GetPrefixAbsenceProof(prefix []byte) (*RangeAbsenceProof, error) {
+	if len(prefix) == 0 {
+		return t.GetRangeAbsenceProof(nil, nil)
+	}
+	return t.GetRangeAbsenceProof(prefix, prefixEnd(prefix))
+}
+
+// Verify checks the proof against the root hash of a tree hashed with SHA256Hasher.
+func (p *RangeAbsenceProof) Verify(root []byte) error {
+	return p.VerifyWith(SHA256Hasher, root)
+}
+
+// VerifyWith checks the proof against the root hash of a tree hashed with the given hasher.
+func (p *RangeAbsenceProof) VerifyWith(hasher Hasher, root []byte) error {
+	if p.Start != nil && p.End != nil && bytes.Compare(p.Start, p.End) >= 0 {
+		return fmt.Errorf("%w: invalid range [%X, %X)", ErrInvalidProof, p.Start, p.End)
+	}
+
+	if p.Left != nil {
+		if p.Start == nil || bytes.Compare(p.Left.Key, p.Start) >= 0 {
+			return fmt.Errorf("%w: left key %X is not below the range", ErrInvalidProof, p.Left.Key)
+		}
+		if err := p.Left.VerifyWith(hasher, root); err != nil {
+			return err
+		}
+	}
+	if p.Right != nil {
+		if p.End == nil || bytes.Compare(p.Right.Key, p.End) < 0 {
+			return fmt.Errorf("%w: right key %X is not above the range", ErrInvalidProof, p.Right.Key)
+		}
+		if err := p.Right.VerifyWith(hasher, root); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case p.Left != nil && p.Right != nil:
+		if p.Right.Index != p.Left.Index+1 {
+			return fmt.Errorf("%w: keys at index %d and %d are not adjacent", ErrInvalidProof, p.Left.Index, p.Right.Index)
+		}
+	case p.Right != nil:
+		if p.Right.Index != 0 {
+			return fmt.Errorf("%w: right key at index %d is not the first key", ErrInvalidProof, p.Right.Index)
+		}
+	case p.Left != nil:
+		if size := p.Left.treeSize(); p.Left.Index != size-1 {
+			return fmt.Errorf("%w: left key at index %d is not the last of %d keys", ErrInvalidProof, p.Left.Index, size)
+		}
+	default:
+		empty, err := hasher.sum(nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(empty, root) {
+			return fmt.Errorf("%w: root %X is not the root of an empty tree", ErrInvalidRoot, root)
+		}
+	}
+	return nil
+}
+
+// treeSize returns the size of the tree the proof is part of, which is the size of the root.
+func (p *IndexProof) treeSize() int64 {
+	if len(p.Path) == 0 {
+		return 1
+	}
+	return p.Path[0].Size
+}
+
+// prefixEnd returns the smallest key above all keys with the given prefix, or nil if there is
+// none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package iavl
+
+import (
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeAbsenceProof(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	// An empty tree has no key in any range.
+	root, err := tree.WorkingHash()
+	require.NoError(t, err)
+	proof, err := tree.GetRangeAbsenceProof(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(root))
+
+	for _, key := range []string{"b", "d", "f", "f\xff", "h"} {
+		_, err = tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	root, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Error(t, proof.Verify(root))
+
+	for _, tc := range []struct {
+		start, end string
+		absent     bool
+	}{
+		{"", "b", true},
+		{"", "c", false},
+		{"c", "d", true},
+		{"c", "e", false},
+		{"d\x00", "f", true},
+		{"i", "", true},
+		{"h", "", false},
+		{"", "", false},
+	} {
+		var start, end []byte
+		if tc.start != "" {
+			start = []byte(tc.start)
+		}
+		if tc.end != "" {
+			end = []byte(tc.end)
+		}
+		proof, err := tree.GetRangeAbsenceProof(start, end)
+		if !tc.absent {
+			require.Error(t, err, "[%q, %q)", tc.start, tc.end)
+			continue
+		}
+		require.NoError(t, err, "[%q, %q)", tc.start, tc.end)
+		require.NoError(t, proof.Verify(root), "[%q, %q)", tc.start, tc.end)
+
+		// Widening the range invalidates the proof.
+		if proof.Left != nil {
+			forged := *proof
+			forged.Start = proof.Left.Key
+			require.Error(t, forged.Verify(root))
+		}
+		if proof.Right != nil {
+			forged := *proof
+			forged.End = append(append([]byte{}, proof.Right.Key...), 0)
+			require.Error(t, forged.Verify(root))
+			forged = *proof
+			forged.Right = nil
+			require.Error(t, forged.Verify(root))
+		}
+	}
+
+	// A neighbour which is not adjacent proves nothing.
+	left, err := tree.GetIndexProof(0)
+	require.NoError(t, err)
+	right, err := tree.GetIndexProof(2)
+	require.NoError(t, err)
+	forged := &RangeAbsenceProof{Start: []byte("c"), End: []byte("f"), Left: left, Right: right}
+	require.Error(t, forged.Verify(root))
+}
+
+func TestPrefixAbsenceProof(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for _, key := range []string{"a/1", "a/2", "c/1", "\xff\xff"} {
+		_, err = tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	for _, prefix := range []string{"b/", "a/3", "c/2", "\xff\xff\xff", "0"} {
+		proof, err := tree.GetPrefixAbsenceProof([]byte(prefix))
+		require.NoError(t, err, prefix)
+		require.NoError(t, proof.Verify(root), prefix)
+	}
+	for _, prefix := range []string{"a/", "c", "\xff", ""} {
+		_, err := tree.GetPrefixAbsenceProof([]byte(prefix))
+		require.Error(t, err, prefix)
+	}
+
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a")))
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a\xff")))
+	require.Nil(t, prefixEnd([]byte("\xff\xff")))
+}
@@ -3,6 +3,7 @@ package iavl
 import (
 	"encoding/binary"
 	"fmt"
+	"math/rand"
 
 	ics23 "github.com/confio/ics23/go"
 )
@@ -34,8 +35,12 @@ func (t *ImmutableTree) VerifyMembership(proof *ics23.CommitmentProof, key []byt
 	if err != nil {
 		return false, err
 	}
+	spec, err := t.ProofSpec()
+	if err != nil {
+		return false, err
+	}
 
-	return ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, val), nil
+	return ics23.VerifyMembership(spec, root, proof, key, val), nil
 }
 
 /*
@@ -97,8 +102,86 @@ func (t *ImmutableTree) VerifyNonMembership(proof *ics23.CommitmentProof, key []
 	if err != nil {
 		return false, err
 	}
+	spec, err := t.ProofSpec()
+	if err != nil {
+		return false, err
+	}
 
-	return ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key), nil
+	return ics23.VerifyNonMembership(spec, root, proof, key), nil
+}
+
+// ProofSpec returns the ICS23 proof spec of the proofs produced by the tree, which is the spec
+// of its hasher with the depth of the proofs bounded by the height of the tree. The depth of a
+// leaf is at most the height, and at least half of it since the tree is balanced. As the height
+// changes when the tree is modified, the depth limits only apply to this version of the tree.
+func (t *ImmutableTree) ProofSpec() (*ics23.ProofSpec, error) {
+	hasher, err := t.hasher()
+	if err != nil {
+		return nil, err
+	}
+	spec, err := hasher.ProofSpec()
+	if err != nil {
+		return nil, err
+	}
+	if height := int32(t.Height()); height > 0 {
+		spec.MaxDepth = height
+		spec.MinDepth = (height + 1) / 2
+	}
+	return spec, nil
+}
+
+// CheckProofSpec checks that the proofs produced by the tree are valid against its ProofSpec.
+// It generates membership proofs of the given number of random keys of the tree, and
+// non-membership proofs of as many random keys missing from it, and returns an error
+// describing the first proof which does not verify against the root hash. The keys are chosen
+// deterministically from the given seed, so that failures can be reproduced.
+func (t *ImmutableTree) CheckProofSpec(seed int64, samples int) error {
+	if t.root == nil {
+		return nil
+	}
+	r := rand.New(rand.NewSource(seed))
+	spec, err := t.ProofSpec()
+	if err != nil {
+		return err
+	}
+	root, err := t.Hash()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < samples; i++ {
+		key, value, err := t.GetByIndex(r.Int63n(t.Size()))
+		if err != nil {
+			return err
+		}
+		proof, err := t.GetMembershipProof(key)
+		if err != nil {
+			return err
+		}
+		if !ics23.VerifyMembership(spec, root, proof, key, value) {
+			return fmt.Errorf("membership proof of key %X does not match the proof spec", key)
+		}
+	}
+
+	for i := 0; i < samples; i++ {
+		key := make([]byte, 1+r.Intn(32))
+		r.Read(key)
+		exists, err := t.Has(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		proof, err := t.GetNonMembershipProof(key)
+		if err != nil {
+			return err
+		}
+		if !ics23.VerifyNonMembership(spec, root, proof, key) {
+			return fmt.Errorf("non-membership proof of key %X does not match the proof spec", key)
+		}
+	}
+	return nil
 }
 
 // createExistenceProof will get the proof from the tree and convert the proof into a valid
@@ -108,16 +191,24 @@ func (t *ImmutableTree) createExistenceProof(key []byte) (*ics23.ExistenceProof,
 	if err != nil {
 		return nil, err
 	}
+	hasher, err := t.hasher()
+	if err != nil {
+		return nil, err
+	}
+	hashOp, err := hasher.hashOp()
+	if err != nil {
+		return nil, err
+	}
 	path, node, err := t.root.PathToLeaf(t, key)
 	return &ics23.ExistenceProof{
 		Key:   node.key,
 		Value: node.value,
-		Leaf:  convertLeafOp(node.version),
-		Path:  convertInnerOps(path),
+		Leaf:  convertLeafOp(node.version, hashOp),
+		Path:  convertInnerOps(path, hashOp),
 	}, err
 }
 
-func convertLeafOp(version int64) *ics23.LeafOp {
+func convertLeafOp(version int64, hashOp ics23.HashOp) *ics23.LeafOp {
 	var varintBuf [binary.MaxVarintLen64]byte
 	// this is adapted from iavl/proof.go:proofLeafNode.Hash()
 	prefix := convertVarIntToBytes(0, varintBuf)
@@ -125,19 +216,19 @@ func convertLeafOp(version int64) *ics23.LeafOp {
 	prefix = append(prefix, convertVarIntToBytes(version, varintBuf)...)
 
 	return &ics23.LeafOp{
-		Hash:         ics23.HashOp_SHA256,
-		PrehashValue: ics23.HashOp_SHA256,
+		Hash:         hashOp,
+		PrehashValue: hashOp,
 		Length:       ics23.LengthOp_VAR_PROTO,
 		Prefix:       prefix,
 	}
 }
 
 // we cannot get the proofInnerNode type, so we need to do the whole path in one function
-func convertInnerOps(path PathToLeaf) []*ics23.InnerOp {
+func convertInnerOps(path PathToLeaf, hashOp ics23.HashOp) []*ics23.InnerOp {
 	steps := make([]*ics23.InnerOp, 0, len(path))
 
-	// lengthByte is the length prefix prepended to each of the sha256 sub-hashes
-	var lengthByte byte = 0x20
+	// lengthByte is the length prefix prepended to each of the sub-hashes
+	var lengthByte byte = hashSize
 
 	var varintBuf [binary.MaxVarintLen64]byte
 
@@ -165,7 +256,7 @@ func convertInnerOps(path PathToLeaf) []*ics23.InnerOp {
 		}
 
 		op := &ics23.InnerOp{
-			Hash:   ics23.HashOp_SHA256,
+			Hash:   hashOp,
 			Prefix: prefix,
 			Suffix: suffix,
 		}
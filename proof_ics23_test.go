@@ -249,7 +249,7 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 		for _, version := range versions {
-			sink = convertLeafOp(version)
+			sink = convertLeafOp(version, ics23.HashOp_SHA256)
 		}
 	}
 	if sink == nil {
@@ -257,3 +257,64 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 	}
 	sink = nil
 }
+
+func TestProofSpec(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 100, 5431} {
+		tree, keys, err := BuildTree(size, 0)
+		require.NoError(t, err)
+		for _, key := range keys[:size/3] {
+			_, _, err = tree.Remove(key)
+			require.NoError(t, err)
+		}
+
+		spec, err := tree.ProofSpec()
+		require.NoError(t, err)
+		require.Equal(t, ics23.IavlSpec.LeafSpec, spec.LeafSpec)
+		require.Equal(t, ics23.IavlSpec.InnerSpec, spec.InnerSpec)
+		require.Equal(t, int32(tree.Height()), spec.MaxDepth)
+
+		// The depth limits hold for every leaf.
+		minDepth, maxDepth := leafDepths(t, tree.ImmutableTree, tree.root, 0)
+		if tree.Height() > 0 {
+			require.GreaterOrEqual(t, minDepth, int(spec.MinDepth))
+			require.LessOrEqual(t, maxDepth, int(spec.MaxDepth))
+		}
+		require.NoError(t, tree.CheckProofSpec(int64(size), 50))
+	}
+
+	// Proofs deeper than the tree are rejected by its spec.
+	small, _, err := BuildTree(10, 0)
+	require.NoError(t, err)
+	spec, err := small.ProofSpec()
+	require.NoError(t, err)
+	big, keys, err := BuildTree(1000, 0)
+	require.NoError(t, err)
+	proof, err := big.GetMembershipProof(keys[0])
+	require.NoError(t, err)
+	require.Error(t, proof.GetExist().CheckAgainstSpec(spec))
+
+	// An empty tree has nothing to check.
+	empty, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	require.NoError(t, empty.CheckProofSpec(0, 10))
+}
+
+// leafDepths returns the minimum and maximum depth of the leaves below the given node.
+func leafDepths(t *testing.T, tree *ImmutableTree, node *Node, depth int) (int, int) {
+	if node.isLeaf() {
+		return depth, depth
+	}
+	left, err := node.getLeftNode(tree)
+	require.NoError(t, err)
+	right, err := node.getRightNode(tree)
+	require.NoError(t, err)
+	leftMin, leftMax := leafDepths(t, tree, left, depth+1)
+	rightMin, rightMax := leafDepths(t, tree, right, depth+1)
+	if rightMin < leftMin {
+		leftMin = rightMin
+	}
+	if rightMax > leftMax {
+		leftMax = rightMax
+	}
+	return leftMin, leftMax
+}
@@ -0,0 +1,146 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// IndexProof proves that a key is the key at a given index of a tree, in ascending order,
+// and has the given value. The index is derived from the sizes of the inner nodes on the path
+// from the root to the leaf, which are part of their hashes.
+type IndexProof struct {
+	Index   int64      `json:"index"`
+	Key     []byte     `json:"key"`
+	Value   []byte     `json:"value"`
+	Version int64      `json:"version"` // Version of the leaf node.
+	Path    PathToLeaf `json:"path"`
+}
+
+// GetIndexProof returns a proof of the key and value at the given index of the tree.
+func (t *ImmutableTree) GetIndexProof(index int64) (*IndexProof, error) {
+	if index < 0 || index >= t.Size() {
+		return nil, fmt.Errorf("index %d out of range for a tree of size %d", index, t.Size())
+	}
+	if _, err := t.Hash(); err != nil {
+		return nil, err
+	}
+	key, _, err := t.GetByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	path, node, err := t.root.PathToLeaf(t, key)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexProof{
+		Index:   index,
+		Key:     node.key,
+		Value:   node.value,
+		Version: node.version,
+		Path:    path,
+	}, nil
+}
+
+// Verify checks the proof against the root hash of a tree hashed with SHA256Hasher.
+func (p *IndexProof) Verify(root []byte) error {
+	return p.VerifyWith(SHA256Hasher, root)
+}
+
+// VerifyWith checks the proof against the root hash of a tree hashed with the given hasher.
+func (p *IndexProof) VerifyWith(hasher Hasher, root []byte) error {
+	if p.Index < 0 || p.Path.Index() != p.Index {
+		return fmt.Errorf("%w: path leads to index %d, not %d", ErrInvalidProof, p.Path.Index(), p.Index)
+	}
+	valueHash, err := hasher.sum(p.Value)
+	if err != nil {
+		return err
+	}
+	hash, err := ProofLeafNode{Key: p.Key, ValueHash: valueHash, Version: p.Version}.HashWith(hasher)
+	if err != nil {
+		return err
+	}
+	for i := len(p.Path) - 1; i >= 0; i-- {
+		if hash, err = p.Path[i].HashWith(hasher, hash); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+		}
+	}
+	if !bytes.Equal(hash, root) {
+		return fmt.Errorf("%w: proof leads to root %X, not %X", ErrInvalidRoot, hash, root)
+	}
+	return nil
+}
+
+// SizeProof proves the number of keys of a tree. It holds the fields of the root node, which
+// records the size of the tree, along with the hashes of its children, or its key and value
+// hash if it is a leaf. All fields are empty for an empty tree.
+type SizeProof struct {
+	Size      int64  `json:"size"`
+	Height    int8   `json:"height"`
+	Version   int64  `json:"version"`
+	LeftHash  []byte `json:"left_hash,omitempty"`
+	RightHash []byte `json:"right_hash,omitempty"`
+	Key       []byte `json:"key,omitempty"`
+	ValueHash []byte `json:"value_hash,omitempty"`
+}
+
+// GetSizeProof returns a proof of the number of keys of the tree.
+func (t *ImmutableTree) GetSizeProof() (*SizeProof, error) {
+	if _, err := t.Hash(); err != nil {
+		return nil, err
+	}
+	root := t.root
+	if root == nil {
+		return &SizeProof{}, nil
+	}
+	proof := &SizeProof{
+		Size:    root.size,
+		Height:  root.subtreeHeight,
+		Version: root.version,
+	}
+	if !root.isLeaf() {
+		proof.LeftHash, proof.RightHash = root.leftHash, root.rightHash
+		return proof, nil
+	}
+	hasher, err := t.hasher()
+	if err != nil {
+		return nil, err
+	}
+	proof.Key = root.key
+	if proof.ValueHash, err = hasher.sum(root.value); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// Verify checks the proof against the root hash of a tree hashed with SHA256Hasher.
+func (p *SizeProof) Verify(root []byte) error {
+	return p.VerifyWith(SHA256Hasher, root)
+}
+
+// VerifyWith checks the proof against the root hash of a tree hashed with the given hasher.
+func (p *SizeProof) VerifyWith(hasher Hasher, root []byte) error {
+	var hash []byte
+	var err error
+	switch {
+	case p.Size == 0:
+		hash, err = hasher.sum(nil)
+	case p.Height == 0:
+		if p.Size != 1 {
+			return fmt.Errorf("%w: leaf with size %d", ErrInvalidProof, p.Size)
+		}
+		hash, err = ProofLeafNode{Key: p.Key, ValueHash: p.ValueHash, Version: p.Version}.HashWith(hasher)
+	default:
+		if len(p.LeftHash) == 0 || len(p.RightHash) == 0 {
+			return fmt.Errorf("%w: missing child hash", ErrInvalidProof)
+		}
+		inner := ProofInnerNode{Height: p.Height, Size: p.Size, Version: p.Version, Left: p.LeftHash}
+		hash, err = inner.HashWith(hasher, p.RightHash)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, root) {
+		return fmt.Errorf("%w: proof leads to root %X, not %X", ErrInvalidRoot, hash, root)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package iavl
+
+import (
+	"errors"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexProof(t *testing.T) {
+	for _, size := range []int{1, 2, 100, 1000} {
+		tree, keys, err := BuildTree(size, 0)
+		require.NoError(t, err)
+		root, err := tree.WorkingHash()
+		require.NoError(t, err)
+
+		for _, index := range []int64{0, int64(size) / 2, int64(size) - 1} {
+			proof, err := tree.GetIndexProof(index)
+			require.NoError(t, err)
+			require.Equal(t, index, proof.Index)
+			require.Equal(t, keys[index], proof.Key)
+			value, err := tree.Get(proof.Key)
+			require.NoError(t, err)
+			require.Equal(t, value, proof.Value)
+			require.NoError(t, proof.Verify(root))
+
+			// Claiming another index, key or value fails.
+			forged := *proof
+			forged.Index++
+			require.True(t, errors.Is(forged.Verify(root), ErrInvalidProof))
+			forged = *proof
+			forged.Value = []byte("forged")
+			require.True(t, errors.Is(forged.Verify(root), ErrInvalidRoot))
+			if size > 1 {
+				other, err := tree.GetIndexProof((index + 1) % int64(size))
+				require.NoError(t, err)
+				forged = *proof
+				forged.Key, forged.Value = other.Key, other.Value
+				require.Error(t, forged.Verify(root))
+			}
+		}
+
+		_, err = tree.GetIndexProof(int64(size))
+		require.Error(t, err)
+		_, err = tree.GetIndexProof(-1)
+		require.Error(t, err)
+	}
+}
+
+func TestSizeProof(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 100} {
+		tree, _, err := BuildTree(size, 0)
+		require.NoError(t, err)
+		root, err := tree.WorkingHash()
+		require.NoError(t, err)
+
+		proof, err := tree.GetSizeProof()
+		require.NoError(t, err)
+		require.Equal(t, int64(size), proof.Size)
+		require.NoError(t, proof.Verify(root))
+
+		forged := *proof
+		forged.Size++
+		require.Error(t, forged.Verify(root))
+	}
+
+	// Proofs verify with the hasher of the tree.
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Hasher: Blake2bHasher}, false)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	sizeProof, err := tree.GetSizeProof()
+	require.NoError(t, err)
+	require.NoError(t, sizeProof.VerifyWith(Blake2bHasher, root))
+	require.Error(t, sizeProof.Verify(root))
+	indexProof, err := tree.GetIndexProof(1)
+	require.NoError(t, err)
+	require.NoError(t, indexProof.VerifyWith(Blake2bHasher, root))
+	require.Error(t, indexProof.Verify(root))
+}
@@ -0,0 +1,137 @@
+package iavl
+
+import (
+	"math"
+	"sync"
+
+	ics23 "github.com/confio/ics23/go"
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl/cache"
+)
+
+// VersionReader serves snapshots and proofs of the saved versions of a tree. It is implemented
+// by MutableTree and ReadOnlyTree.
+type VersionReader interface {
+	// GetImmutable returns the tree at the given version, or ErrVersionDoesNotExist.
+	GetImmutable(version int64) (*ImmutableTree, error)
+	// GetVersionedProof returns the proof of the given key at the given version.
+	GetVersionedProof(key []byte, version int64) (*ics23.CommitmentProof, error)
+}
+
+var (
+	_ VersionReader = (*MutableTree)(nil)
+	_ VersionReader = (*ReadOnlyTree)(nil)
+)
+
+// ReadOnlyTree reads the saved versions of a tree without loading it as a MutableTree. It
+// never writes to the database, runs no migrations and leaves the fast storage alone, so it
+// can read a database which another process is writing to.
+//
+// The versions are listed from the roots in the database on each call, so versions saved by
+// a writer show up as soon as they are committed. Snapshots are read through the tree rather
+// than the fast index, since the writer may be updating the index to a later version.
+//
+// When the writer overwrites versions, e.g. with LoadVersionForOverwriting, the new nodes may
+// have the same keys as the deleted ones in the version-keyed layout. The node cache is therefore
+// cleared whenever GetImmutable sees the latest version go backwards. A reader which may miss
+// that, because the writer overwrites versions and saves past the latest version seen by the
+// reader between two calls, must be reopened instead.
+type ReadOnlyTree struct {
+	ndb       *nodeDB
+	cacheSize int
+
+	mtx           sync.Mutex
+	latestVersion int64 // Latest version seen by GetImmutable.
+}
+
+// NewReadOnlyTree returns a ReadOnlyTree reading the given database. The storage options, such
+// as the hasher and the compression, are read from the database; the ones given in opts must
+// match them if set. Options.ReadOnly is implied.
+func NewReadOnlyTree(db dbm.DB, cacheSize int, opts *Options) (*ReadOnlyTree, error) {
+	o := DefaultOptions()
+	if opts != nil {
+		o = *opts
+	}
+	o.ReadOnly = true
+	ndb := newNodeDB(db, cacheSize, &o)
+	if err := ndb.storageFormat(); err != nil {
+		return nil, err
+	}
+	return &ReadOnlyTree{ndb: ndb, cacheSize: cacheSize}, nil
+}
+
+// AvailableVersions returns the saved versions in ascending order.
+func (t *ReadOnlyTree) AvailableVersions() ([]int64, error) {
+	return t.ndb.getVersions(1, math.MaxInt64)
+}
+
+// LatestVersion returns the latest saved version, or 0 if no version was saved.
+func (t *ReadOnlyTree) LatestVersion() (int64, error) {
+	return t.ndb.getPreviousVersion(math.MaxInt64)
+}
+
+// VersionExists returns whether the given version is saved.
+func (t *ReadOnlyTree) VersionExists(version int64) (bool, error) {
+	rootHash, err := t.ndb.getRoot(version)
+	if err != nil {
+		return false, err
+	}
+	return rootHash != nil, nil
+}
+
+// GetImmutable returns the tree at the given version, or ErrVersionDoesNotExist. The returned
+// tree is safe for concurrent access, provided the version is not deleted by the writer.
+func (t *ReadOnlyTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	if err := t.checkOverwrites(); err != nil {
+		return nil, err
+	}
+	rootHash, err := t.ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	if rootHash == nil {
+		return nil, ErrVersionDoesNotExist
+	}
+	tree := &ImmutableTree{
+		ndb:                    t.ndb,
+		version:                version,
+		skipFastStorageUpgrade: true,
+	}
+	if len(rootHash) == 0 {
+		return tree, nil
+	}
+	if tree.root, err = t.ndb.GetNode(rootHash); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// checkOverwrites clears the node cache if the latest version went backwards since the last
+// call, which means that the writer deleted versions to overwrite them.
+func (t *ReadOnlyTree) checkOverwrites() error {
+	latestVersion, err := t.LatestVersion()
+	if err != nil {
+		return err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if latestVersion < t.latestVersion {
+		t.ndb.mtx.Lock()
+		t.ndb.nodeCache = cache.New(t.cacheSize)
+		t.ndb.mtx.Unlock()
+	}
+	t.latestVersion = latestVersion
+	return nil
+}
+
+// GetVersionedProof returns the proof of the given key at the given version.
+func (t *ReadOnlyTree) GetVersionedProof(key []byte, version int64) (*ics23.CommitmentProof, error) {
+	tree, err := t.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return tree.GetProof(key)
+}
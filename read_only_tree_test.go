@@ -0,0 +1,156 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	ics23 "github.com/confio/ics23/go"
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFailingDB fails every write, directly or through a batch.
+type writeFailingDB struct {
+	db.DB
+}
+
+var errReadOnlyDB = errors.New("write to a read-only database")
+
+func (wdb writeFailingDB) Set([]byte, []byte) error     { return errReadOnlyDB }
+func (wdb writeFailingDB) SetSync([]byte, []byte) error { return errReadOnlyDB }
+func (wdb writeFailingDB) Delete([]byte) error          { return errReadOnlyDB }
+func (wdb writeFailingDB) DeleteSync([]byte) error      { return errReadOnlyDB }
+
+func (wdb writeFailingDB) NewBatch() db.Batch {
+	return writeFailingBatch{Batch: wdb.DB.NewBatch()}
+}
+
+type writeFailingBatch struct {
+	db.Batch
+}
+
+func (b writeFailingBatch) Write() error     { return errReadOnlyDB }
+func (b writeFailingBatch) WriteSync() error { return errReadOnlyDB }
+
+func TestReadOnlyTree(t *testing.T) {
+	memDB := db.NewMemDB()
+	writer, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	reader, err := NewReadOnlyTree(writeFailingDB{memDB}, 0, nil)
+	require.NoError(t, err)
+
+	latest, err := reader.LatestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, latest)
+	_, err = reader.GetImmutable(1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	for v := 1; v <= 5; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := writer.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := writer.SaveVersion()
+		require.NoError(t, err)
+
+		// The reader sees the versions saved after it was opened.
+		latest, err := reader.LatestVersion()
+		require.NoError(t, err)
+		require.EqualValues(t, v, latest)
+	}
+	require.NoError(t, writer.DeleteVersionsRange(1, 3))
+
+	versions, err := reader.AvailableVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 4, 5}, versions)
+	exists, err := reader.VersionExists(2)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	for _, version := range versions {
+		expected, err := writer.GetImmutable(version)
+		require.NoError(t, err)
+		tree, err := reader.GetImmutable(version)
+		require.NoError(t, err)
+		root, err := tree.Hash()
+		require.NoError(t, err)
+		expectedRoot, err := expected.Hash()
+		require.NoError(t, err)
+		require.Equal(t, expectedRoot, root)
+
+		value, err := tree.Get([]byte("key-07"))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value-%d-7", version)), value)
+
+		for _, key := range [][]byte{[]byte("key-07"), []byte("key-07a")} {
+			proof, err := reader.GetVersionedProof(key, version)
+			require.NoError(t, err)
+			expectedProof, err := writer.GetVersionedProof(key, version)
+			require.NoError(t, err)
+			require.Equal(t, expectedProof, proof)
+			if proof.GetExist() != nil {
+				require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value))
+			} else {
+				require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key))
+			}
+		}
+	}
+}
+
+func TestReadOnlyTree_StorageFormat(t *testing.T) {
+	memDB := db.NewMemDB()
+	writer, err := NewMutableTreeWithOpts(memDB, 0, &Options{Compression: ZstdCompression, BlobThreshold: 16}, false)
+	require.NoError(t, err)
+	value := []byte("a value long enough to be stored as a blob")
+	_, err = writer.Set([]byte("key"), value)
+	require.NoError(t, err)
+	_, _, err = writer.SaveVersion()
+	require.NoError(t, err)
+
+	reader, err := NewReadOnlyTree(writeFailingDB{memDB}, 0, nil)
+	require.NoError(t, err)
+	tree, err := reader.GetImmutable(1)
+	require.NoError(t, err)
+	got, err := tree.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+
+	// Options conflicting with the recorded format are rejected.
+	_, err = NewReadOnlyTree(writeFailingDB{memDB}, 0, &Options{Compression: SnappyCompression})
+	require.Error(t, err)
+}
+
+func TestReadOnlyTree_Overwrite(t *testing.T) {
+	memDB := db.NewMemDB()
+	writer, err := NewMutableTreeWithOpts(memDB, 0, &Options{VersionKeyedNodes: true}, false)
+	require.NoError(t, err)
+	reader, err := NewReadOnlyTree(writeFailingDB{memDB}, 100, nil)
+	require.NoError(t, err)
+
+	saveVersions := func(from, to int, prefix string) {
+		for v := from; v <= to; v++ {
+			_, err := writer.Set([]byte("key"), []byte(fmt.Sprintf("%s-%d", prefix, v)))
+			require.NoError(t, err)
+			_, _, err = writer.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	requireValue := func(version int64, expected string) {
+		tree, err := reader.GetImmutable(version)
+		require.NoError(t, err)
+		value, err := tree.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(value))
+	}
+
+	saveVersions(1, 3, "old")
+	requireValue(3, "old-3")
+
+	// The overwritten versions reuse the node keys of the deleted ones, whose nodes are cached.
+	_, err = writer.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	requireValue(1, "old-1")
+	saveVersions(2, 3, "new")
+	requireValue(3, "new-3")
+}
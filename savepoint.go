@@ -0,0 +1,95 @@
+package iavl
+
+import (
+	"errors"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// ErrInvalidSavepoint is returned when rolling back to a savepoint which is no longer valid.
+var ErrInvalidSavepoint = errors.New("invalid savepoint")
+
+// Savepoint marks a state of the working tree, which RollbackTo returns to. It is created by
+// MutableTree.Savepoint.
+//
+// Savepoints nest: rolling back to a savepoint discards the ones created after it, while the
+// savepoint itself stays valid and can be rolled back to again. Saving, rolling back or loading
+// the tree discards all savepoints.
+type Savepoint struct {
+	root       *Node // Root of the working tree.
+	journalLen int   // Number of unsaved fast node changes made before the savepoint.
+}
+
+// fastNodeChange records the state of an unsaved fast node before it was changed, so that the
+// change can be undone by RollbackTo.
+type fastNodeChange struct {
+	key      string
+	addition *fastnode.Node // The unsaved addition, if any.
+	removal  bool           // Whether the key was an unsaved removal.
+}
+
+// Savepoint returns a savepoint of the working tree, which RollbackTo returns to.
+//
+// Taking a savepoint is cheap. The working tree never modifies its nodes in place, so the
+// savepoint only keeps the root, while the changes of the unsaved fast nodes are journaled as
+// long as there are savepoints.
+func (tree *MutableTree) Savepoint() *Savepoint {
+	sp := &Savepoint{
+		root:       tree.root,
+		journalLen: len(tree.fastNodeJournal),
+	}
+	tree.savepoints = append(tree.savepoints, sp)
+	return sp
+}
+
+// RollbackTo discards the changes made to the working tree since the given savepoint, along with
+// the savepoints created after it. It returns ErrInvalidSavepoint if the savepoint was
+// discarded, or belongs to another tree.
+func (tree *MutableTree) RollbackTo(sp *Savepoint) error {
+	i := len(tree.savepoints) - 1
+	for i >= 0 && tree.savepoints[i] != sp {
+		i--
+	}
+	if i < 0 {
+		return ErrInvalidSavepoint
+	}
+	tree.savepoints = tree.savepoints[:i+1]
+
+	for j := len(tree.fastNodeJournal) - 1; j >= sp.journalLen; j-- {
+		change := tree.fastNodeJournal[j]
+		delete(tree.unsavedFastNodeAdditions, change.key)
+		delete(tree.unsavedFastNodeRemovals, change.key)
+		if change.addition != nil {
+			tree.unsavedFastNodeAdditions[change.key] = change.addition
+		}
+		if change.removal {
+			tree.unsavedFastNodeRemovals[change.key] = true
+		}
+	}
+	tree.fastNodeJournal = tree.fastNodeJournal[:sp.journalLen]
+
+	working := tree.ImmutableTree.clone()
+	working.root = sp.root
+	tree.ImmutableTree = working
+	return nil
+}
+
+// journalFastNode records the state of the unsaved fast node of the given key before changing
+// it, if there are savepoints to roll back to.
+func (tree *MutableTree) journalFastNode(key string) {
+	if len(tree.savepoints) == 0 {
+		return
+	}
+	_, removal := tree.unsavedFastNodeRemovals[key]
+	tree.fastNodeJournal = append(tree.fastNodeJournal, fastNodeChange{
+		key:      key,
+		addition: tree.unsavedFastNodeAdditions[key],
+		removal:  removal,
+	})
+}
+
+// resetSavepoints discards all savepoints, when the working tree is replaced.
+func (tree *MutableTree) resetSavepoints() {
+	tree.savepoints = nil
+	tree.fastNodeJournal = nil
+}
@@ -0,0 +1,126 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// requireTreeContents checks that the tree, including its fast nodes, holds exactly the given
+// key/value pairs.
+func requireTreeContents(t *testing.T, tree *MutableTree, expected map[string]string) {
+	t.Helper()
+	actual := map[string]string{}
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		actual[string(itr.Key())] = string(itr.Value())
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, expected, actual)
+
+	for key, value := range expected {
+		got, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, string(got))
+	}
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func TestMutableTree_Savepoint(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+
+	mirror := map[string]string{}
+	for version := 1; version <= 5; version++ {
+		var savepoints []*Savepoint
+		var mirrors []map[string]string
+		for i := 0; i < 200; i++ {
+			switch n := r.Intn(10); {
+			case n == 0:
+				savepoints = append(savepoints, tree.Savepoint())
+				mirrors = append(mirrors, copyMap(mirror))
+			case n == 1 && len(savepoints) > 0:
+				j := r.Intn(len(savepoints))
+				require.NoError(t, tree.RollbackTo(savepoints[j]))
+				mirror = copyMap(mirrors[j])
+				savepoints, mirrors = savepoints[:j+1], mirrors[:j+1]
+			case n < 4:
+				key := fmt.Sprintf("key-%02d", r.Intn(50))
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+				delete(mirror, key)
+			default:
+				key, value := fmt.Sprintf("key-%02d", r.Intn(50)), fmt.Sprintf("value-%d", r.Int())
+				_, err := tree.Set([]byte(key), []byte(value))
+				require.NoError(t, err)
+				mirror[key] = value
+			}
+		}
+		requireTreeContents(t, tree, mirror)
+
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		for _, sp := range savepoints {
+			require.ErrorIs(t, tree.RollbackTo(sp), ErrInvalidSavepoint)
+		}
+	}
+
+	// The fast nodes written to disk match the tree after the rollbacks.
+	loaded, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	requireTreeContents(t, loaded, mirror)
+}
+
+func TestMutableTree_RollbackTo(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	outer := tree.Savepoint()
+	hash, err := tree.WorkingHash()
+	require.NoError(t, err)
+
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	inner := tree.Savepoint()
+	_, err = tree.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+
+	// Rolling back to the outer savepoint discards the inner one, but keeps the outer one.
+	require.NoError(t, tree.RollbackTo(outer))
+	require.ErrorIs(t, tree.RollbackTo(inner), ErrInvalidSavepoint)
+	rolledBack, err := tree.WorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, rolledBack)
+	requireTreeContents(t, tree, map[string]string{"a": "1", "b": "2"})
+
+	_, err = tree.Set([]byte("d"), []byte("4"))
+	require.NoError(t, err)
+	require.NoError(t, tree.RollbackTo(outer))
+	requireTreeContents(t, tree, map[string]string{"a": "1", "b": "2"})
+
+	// Rollback discards all savepoints.
+	tree.Rollback()
+	require.ErrorIs(t, tree.RollbackTo(outer), ErrInvalidSavepoint)
+	requireTreeContents(t, tree, map[string]string{"a": "1"})
+}
@@ -73,7 +73,7 @@ func N(l, r interface{}) *Node {
 func T(n *Node) (*MutableTree, error) {
 	t, _ := getTestTree(0)
 
-	_, _, err := n.hashWithCount()
+	_, _, err := n.hashWithCount(SHA256Hasher)
 	if err != nil {
 		return nil, err
 	}
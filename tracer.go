@@ -0,0 +1,82 @@
+package iavl
+
+// Names of the spans started by the traced operations, see Tracer.
+const (
+	SpanGet                 = "Get"
+	SpanSet                 = "Set"
+	SpanRemove              = "Remove"
+	SpanSaveVersion         = "SaveVersion"
+	SpanLoadVersion         = "LoadVersion"
+	SpanExport              = "Export"
+	SpanImportCommit        = "Importer.Commit"
+	SpanDeleteVersionsRange = "DeleteVersionsRange"
+)
+
+// Names of the events recorded within spans.
+const (
+	EventNodeCacheMiss     = "node cache miss"      // A node was not in the node cache.
+	EventNodeLoaded        = "node loaded"          // A node was read from the database.
+	EventFastNodeCacheMiss = "fast node cache miss" // A fast node was not in the fast node cache.
+)
+
+// Tracer starts spans around tree operations, given as Options.Tracer. It can be backed by e.g.
+// OpenTelemetry or a local recorder. Spans are started for Get, Set, Remove, SaveVersion,
+// LoadVersion, Export, Importer.Commit and DeleteVersionsRange, named after the Span constants,
+// and record the nodes they load as events. The methods may be called concurrently.
+type Tracer interface {
+	// StartSpan starts a span of the operation with the given name, and key/value attributes.
+	StartSpan(name string, keyVals ...interface{}) Span
+}
+
+// Span is an operation traced by a Tracer. A span is used by one goroutine at a time, although
+// not necessarily the one which started it, e.g. the span of an export.
+type Span interface {
+	// AddEvent records an event within the span, with key/value attributes, e.g. a node load.
+	AddEvent(name string, keyVals ...interface{})
+
+	// End ends the span, with the error the operation failed with, if any.
+	End(err error)
+}
+
+// nopSpan is the span of operations which are not traced.
+type nopSpan struct{}
+
+func (nopSpan) AddEvent(string, ...interface{}) {}
+func (nopSpan) End(error)                       {}
+
+// startSpan starts a span with the tracer of the options, or returns a nopSpan without a tracer.
+func (ndb *nodeDB) startSpan(name string, keyVals ...interface{}) Span {
+	if ndb.opts.Tracer == nil {
+		return nopSpan{}
+	}
+	return ndb.opts.Tracer.StartSpan(name, keyVals...)
+}
+
+// traced returns a shallow copy of the tree which records its node loads in a new span of the
+// operation with the given name, and the span. Without a tracer, it returns the tree itself and
+// a nopSpan, so that untraced operations do not allocate.
+func (t *ImmutableTree) traced(name string, keyVals ...interface{}) (*ImmutableTree, Span) {
+	if t.ndb == nil || t.ndb.opts.Tracer == nil {
+		return t, nopSpan{}
+	}
+	span := t.ndb.opts.Tracer.StartSpan(name, keyVals...)
+	traced := *t
+	traced.span = span
+	return &traced, span
+}
+
+// trace starts a span of the operation with the given name on the working tree, which records
+// the node loads of the working tree until the returned function ends it with the error of the
+// operation, if any.
+func (tree *MutableTree) trace(name string, keyVals ...interface{}) func(error) {
+	if tree.ndb.opts.Tracer == nil {
+		return func(error) {}
+	}
+	span := tree.ndb.opts.Tracer.StartSpan(name, keyVals...)
+	working := tree.ImmutableTree
+	working.span = span
+	return func(err error) {
+		working.span = nil
+		span.End(err)
+	}
+}
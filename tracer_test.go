@@ -0,0 +1,161 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedSpan is a span recorded by recordingTracer.
+type recordedSpan struct {
+	name    string
+	keyVals []interface{}
+	events  []string
+	ended   int
+	err     error
+}
+
+func (s *recordedSpan) AddEvent(name string, _ ...interface{}) {
+	s.events = append(s.events, name)
+}
+
+func (s *recordedSpan) End(err error) {
+	s.ended++
+	s.err = err
+}
+
+// count returns the number of events with the given name.
+func (s *recordedSpan) count(event string) int {
+	n := 0
+	for _, name := range s.events {
+		if name == event {
+			n++
+		}
+	}
+	return n
+}
+
+// recordingTracer is a Tracer recording the spans.
+type recordingTracer struct {
+	mtx   sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) StartSpan(name string, keyVals ...interface{}) Span {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	span := &recordedSpan{name: name, keyVals: keyVals}
+	r.spans = append(r.spans, span)
+	return span
+}
+
+// last returns the last span with the given name, which must have ended once.
+func (r *recordingTracer) last(t *testing.T, name string) *recordedSpan {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for i := len(r.spans) - 1; i >= 0; i-- {
+		if span := r.spans[i]; span.name == name {
+			require.Equal(t, 1, span.ended, "span %s ended %d times", name, span.ended)
+			return span
+		}
+	}
+	require.Fail(t, "no span", name)
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tracer := &recordingTracer{}
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Tracer: tracer}, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	span := tracer.last(t, SpanLoadVersion)
+	require.NoError(t, span.err)
+	require.Equal(t, []string{EventNodeCacheMiss, EventNodeLoaded}, span.events)
+
+	// Gets from the fast node index load no nodes.
+	value, err := tree.Get([]byte("key-010"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	span = tracer.last(t, SpanGet)
+	require.Equal(t, []string{EventFastNodeCacheMiss}, span.events)
+	require.Equal(t, []interface{}{"key", []byte("key-010")}, span.keyVals)
+
+	// Setting a key loads the nodes on its path.
+	_, err = tree.Set([]byte("key-020"), []byte("updated"))
+	require.NoError(t, err)
+	span = tracer.last(t, SpanSet)
+	require.Equal(t, int(tree.root.subtreeHeight), span.count(EventNodeLoaded))
+	require.Equal(t, span.count(EventNodeCacheMiss), span.count(EventNodeLoaded))
+
+	_, removed, err := tree.Remove([]byte("key-030"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	span = tracer.last(t, SpanRemove)
+	require.Positive(t, span.count(EventNodeLoaded))
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tracer.last(t, SpanSaveVersion)
+
+	// Gets from earlier versions walk the tree, and loads are not traced outside of spans.
+	immutable, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	value, err = immutable.Get([]byte("key-030"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	span = tracer.last(t, SpanGet)
+	require.Positive(t, span.count(EventNodeLoaded))
+	require.Nil(t, immutable.span)
+	require.Nil(t, tree.ImmutableTree.span)
+
+	exporter, err := immutable.Export()
+	require.NoError(t, err)
+	var nodes []*ExportNode
+	for {
+		node, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+	exporter.Close()
+	exporter.Close()
+	span = tracer.last(t, SpanExport)
+	require.Equal(t, []interface{}{"version", int64(1)}, span.keyVals)
+
+	imported, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Tracer: tracer}, false)
+	require.NoError(t, err)
+	importer, err := imported.Import(1)
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	span = tracer.last(t, SpanImportCommit)
+	require.NoError(t, span.err)
+
+	require.NoError(t, tree.DeleteVersionsRange(1, 2))
+	span = tracer.last(t, SpanDeleteVersionsRange)
+	require.NoError(t, span.err)
+	require.Positive(t, span.count(EventNodeLoaded))
+
+	// Spans end with the error of the operation.
+	require.Error(t, tree.DeleteVersionsRange(2, 1))
+	span = tracer.last(t, SpanDeleteVersionsRange)
+	require.Error(t, span.err)
+}
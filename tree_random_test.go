@@ -7,7 +7,6 @@ import (
 	"math/rand"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"testing"
 
@@ -308,8 +307,8 @@ func testRandomOperations(t *testing.T, randSeed int64) {
 	require.EqualValues(t, []int{int(version)}, tree.AvailableVersions())
 	assertMirror(t, tree, mirror, version)
 	assertMirror(t, tree, mirror, 0)
-	assertOrphans(t, tree, 0)
-	t.Logf("Final version %v is correct, with no stray orphans", version)
+	assertNoStrayNodes(t, tree)
+	t.Logf("Final version %v is correct, with no stray nodes", version)
 
 	// Now, let's delete all remaining key/value pairs, and make sure no stray
 	// data is left behind in the database.
@@ -332,7 +331,7 @@ func testRandomOperations(t *testing.T, randSeed int64) {
 	t.Logf("Final version %v deleted, no stray database entries", prevVersion)
 }
 
-// Checks that the database is empty, only containing a single root entry
+// Checks that the database is empty, only containing migration records and a single root entry
 // at the given version.
 func assertEmptyDatabase(t *testing.T, tree *MutableTree) {
 	version := tree.Version()
@@ -344,36 +343,49 @@ func assertEmptyDatabase(t *testing.T, tree *MutableTree) {
 		foundKeys = append(foundKeys, string(iter.Key()))
 	}
 	require.NoError(t, iter.Error())
-	require.EqualValues(t, 2, len(foundKeys), "Found %v database entries, expected 1", len(foundKeys)) // 1 for storage version and 1 for root
+	require.NotEmpty(t, foundKeys)
 
-	firstKey := foundKeys[0]
-	secondKey := foundKeys[1]
-
-	require.True(t, strings.HasPrefix(firstKey, metadataKeyFormat.Prefix()))
-	require.True(t, strings.HasPrefix(secondKey, rootKeyFormat.Prefix()))
+	rootKey := foundKeys[len(foundKeys)-1]
+	require.True(t, strings.HasPrefix(rootKey, rootKeyFormat.Prefix()))
+	var foundVersion int64
+	rootKeyFormat.Scan([]byte(rootKey), &foundVersion)
+	require.Equal(t, version, foundVersion, "Unexpected root version")
 
-	require.Equal(t, string(metadataKeyFormat.KeyBytes([]byte(storageVersionKey))), firstKey, "Unexpected storage version key")
+	migrationKeyPrefix := string(metadataKeyFormat.KeyBytes([]byte(migrationKeyPrefix)))
+	for _, key := range foundKeys[:len(foundKeys)-1] {
+		require.True(t, strings.HasPrefix(key, migrationKeyPrefix), "Unexpected database entry %q", key)
+	}
 
-	storageVersionValue, err := tree.ndb.db.Get([]byte(firstKey))
+	fastStorageVersion, done, err := tree.ndb.getMigration(fastStorageMigrationID)
 	require.NoError(t, err)
+	require.True(t, done)
 	latestVersion, err := tree.ndb.getLatestVersion()
 	require.NoError(t, err)
-	require.Equal(t, fastStorageVersionValue+fastStorageVersionDelimiter+strconv.Itoa(int(latestVersion)), string(storageVersionValue))
-
-	var foundVersion int64
-	rootKeyFormat.Scan([]byte(secondKey), &foundVersion)
-	require.Equal(t, version, foundVersion, "Unexpected root version")
+	require.Equal(t, latestVersion, fastStorageVersion)
 }
 
-// Checks that the tree has the given number of orphan nodes.
-func assertOrphans(t *testing.T, tree *MutableTree, expected int) {
-	count := 0
-	err := tree.ndb.traverseOrphans(func(k, v []byte) error {
-		count++
-		return nil
-	})
-	require.Nil(t, err)
-	require.EqualValues(t, expected, count, "Expected %v orphans, got %v", expected, count)
+// Checks that every node in the database is reachable from the root of a saved version.
+func assertNoStrayNodes(t *testing.T, tree *MutableTree) {
+	roots, err := tree.ndb.getRoots()
+	require.NoError(t, err)
+	reachable := make(map[string]bool)
+	for _, root := range roots {
+		err = tree.ndb.walkNodes(root, nil, func(node *Node) (bool, error) {
+			if reachable[string(node.nodeKey)] {
+				return false, nil
+			}
+			reachable[string(node.nodeKey)] = true
+			return true, nil
+		})
+		require.NoError(t, err)
+	}
+
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.True(t, reachable[string(node.GetKey())], "Stray node %X at version %v", node.GetKey(), node.version)
+	}
+	require.Len(t, nodes, len(reachable))
 }
 
 // Checks that a version is the maximum mirrored version.
@@ -460,11 +460,11 @@ func TestVersionedTree(t *testing.T) {
 	nodes2, err := tree.ndb.leafNodes()
 	require.NoError(err)
 	require.Len(nodes2, 5, "db should have grown in size")
-	orphans, err := tree.ndb.orphans()
+	allNodes, err := tree.ndb.nodes()
 	require.NoError(err)
-	require.Len(orphans, 3, "db should have three orphans")
+	require.Len(allNodes, 8, "db should hold the nodes of both versions")
 
-	// Create three more orphans.
+	// Orphan three more nodes.
 	tree.Remove([]byte("key1")) // orphans both leaf node and inner node containing "key1" and "key2"
 	tree.Set([]byte("key2"), []byte("val2"))
 
@@ -486,9 +486,9 @@ func TestVersionedTree(t *testing.T) {
 	require.NoError(err)
 	require.Len(nodes3, 6, "wrong number of nodes")
 
-	orphans, err = tree.ndb.orphans()
+	allNodes, err = tree.ndb.nodes()
 	require.NoError(err)
-	require.Len(orphans, 7, "wrong number of orphans")
+	require.Len(allNodes, 10, "wrong number of nodes")
 
 	hash4, _, _ := tree.SaveVersion()
 	require.EqualValues(hash3, hash4)
@@ -1260,7 +1260,7 @@ func TestVersionedTreeProofs(t *testing.T) {
 func TestOrphans(t *testing.T) {
 	// If you create a sequence of saved versions
 	// Then randomly delete versions other than the first and last until only those two remain
-	// Any remaining orphan nodes should either have fromVersion == firstVersion || toVersion == lastVersion
+	// Only the nodes of the first and last versions should be left in the db
 	require := require.New(t)
 	tree, err := NewMutableTree(db.NewMemDB(), 100, false)
 	require.NoError(err)
@@ -1278,18 +1278,12 @@ func TestOrphans(t *testing.T) {
 
 	idx := iavlrand.RandPerm(NUMVERSIONS - 2)
 	for _, v := range idx {
-		err = tree.DeleteVersion(int64(v + 1))
+		err = tree.DeleteVersion(int64(v + 2))
 		require.NoError(err, "DeleteVersion should not error")
 	}
 
-	err = tree.ndb.traverseOrphans(func(k, v []byte) error {
-		var fromVersion, toVersion int64
-		orphanKeyFormat.Scan(k, &toVersion, &fromVersion)
-		require.True(fromVersion == int64(1) || toVersion == int64(99), fmt.Sprintf(`Unexpected orphan key exists: %v with fromVersion = %d and toVersion = %d.\n 
-			Any orphan remaining in db should have either fromVersion == 1 or toVersion == 99. Since Version 1 and 99 are only versions in db`, k, fromVersion, toVersion))
-		return nil
-	})
-	require.Nil(err)
+	require.Equal([]int{1, NUMVERSIONS}, tree.AvailableVersions())
+	assertNoStrayNodes(t, tree)
 }
 
 func TestVersionedTreeHash(t *testing.T) {
@@ -2053,3 +2047,174 @@ func TestNodeCacheStatisic(t *testing.T) {
 		})
 	}
 }
+
+func TestRankAndCount(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	var keys []string
+	for i := 0; i < 200; i += 2 {
+		key := fmt.Sprintf("key-%03d", i)
+		keys = append(keys, key)
+		_, err := tree.Set([]byte(key), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for i := -1; i <= 200; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		rank, err := tree.Rank(key)
+		require.NoError(t, err)
+		require.EqualValues(t, (i+1)/2, rank, "rank of %s", key)
+	}
+
+	bound := func(i int) []byte {
+		if i < 0 {
+			return nil
+		}
+		return []byte(fmt.Sprintf("key-%03d", i))
+	}
+	for _, r := range [][2]int{{-1, -1}, {-1, 50}, {50, -1}, {10, 11}, {11, 12}, {11, 90}, {90, 11}, {0, 300}} {
+		start, end := bound(r[0]), bound(r[1])
+		count, err := tree.Count(start, end)
+		require.NoError(t, err)
+		var expected int64
+		for _, key := range keys {
+			if (start == nil || key >= string(start)) && (end == nil || key < string(end)) {
+				expected++
+			}
+		}
+		require.Equal(t, expected, count, "count of [%s, %s)", start, end)
+	}
+}
+
+func TestIteratorAt(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		keys = append(keys, key)
+		_, err := tree.Set([]byte(key), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// An unsaved key is seen by the iterators of the working tree only.
+	_, err = tree.Set([]byte("key-25a"), []byte("value"))
+	require.NoError(t, err)
+	unsaved := append(append(append([]string{}, keys[:26]...), "key-25a"), keys[26:]...)
+
+	saved, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	collect := func(itr db.Iterator, err error) []string {
+		require.NoError(t, err)
+		defer itr.Close()
+		keys := []string{}
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Key()))
+		}
+		return keys
+	}
+	reversed := func(keys []string) []string {
+		r := make([]string, 0, len(keys))
+		for i := len(keys) - 1; i >= 0; i-- {
+			r = append(r, keys[i])
+		}
+		return r
+	}
+
+	for _, index := range []int64{0, 1, 26, 49, 50, 51, 100} {
+		end := int(index)
+		if end > len(keys) {
+			end = len(keys)
+		}
+		require.Equal(t, keys[end:], collect(saved.IteratorAt(index, true)), "ascending from %d", index)
+		if end == len(keys) {
+			end = len(keys) - 1
+		}
+		require.Equal(t, reversed(keys[:end+1]), collect(saved.IteratorAt(index, false)), "descending from %d", index)
+
+		end = int(index)
+		if end > len(unsaved) {
+			end = len(unsaved)
+		}
+		require.Equal(t, unsaved[end:], collect(tree.IteratorAt(index, true)), "ascending from %d", index)
+	}
+
+	_, err = tree.IteratorAt(-1, true)
+	require.Error(t, err)
+}
+
+func TestIterateModifiedSince(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+
+	// The version each key was last set at.
+	versions := map[string]int64{}
+	for version := int64(1); version <= 20; version++ {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key-%03d", r.Intn(500))
+			_, err := tree.Set([]byte(key), []byte(key))
+			require.NoError(t, err)
+			versions[key] = version
+		}
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("key-%03d", r.Intn(500))
+			_, _, err := tree.Remove([]byte(key))
+			require.NoError(t, err)
+			delete(versions, key)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	modifiedSince := func(tree *ImmutableTree, since int64) map[string]int64 {
+		modified := map[string]int64{}
+		var last string
+		stopped, err := tree.IterateModifiedSince(since, func(key, value []byte, version int64) bool {
+			require.Greater(t, string(key), last)
+			require.Equal(t, key, value)
+			last = string(key)
+			modified[string(key)] = version
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+		return modified
+	}
+	for since := int64(0); since <= 20; since++ {
+		expected := map[string]int64{}
+		for key, version := range versions {
+			if version > since {
+				expected[key] = version
+			}
+		}
+		require.Equal(t, expected, modifiedSince(tree.ImmutableTree, since), "since version %d", since)
+	}
+
+	// Only the nodes of the subtrees modified after the version are loaded.
+	stat := &Statistics{}
+	loaded, err := NewMutableTreeWithOpts(memDB, 0, &Options{Stat: stat}, false)
+	require.NoError(t, err)
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	stat.Reset()
+	require.Len(t, modifiedSince(loaded.ImmutableTree, 19), len(modifiedSince(tree.ImmutableTree, 19)))
+	require.Less(t, stat.GetCacheMissCnt(), uint64(loaded.root.size))
+
+	// The working tree is iterated too, and the iteration stops once fn returns true.
+	_, err = loaded.Set([]byte("key-new"), []byte("key-new"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"key-new": 21}, modifiedSince(loaded.ImmutableTree, 20))
+	count := 0
+	stopped, err := loaded.IterateModifiedSince(0, func(key, value []byte, version int64) bool {
+		count++
+		return count == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
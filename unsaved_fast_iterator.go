@@ -27,7 +27,9 @@ type UnsavedFastIterator struct {
 	ndb          *nodeDB
 	nextKey      []byte
 	nextVal      []byte
-	fastIterator dbm.Iterator
+	nextVersion  int64
+	fastIterator *FastIterator
+	version      int64
 
 	nextUnsavedNodeIdx       int
 	unsavedFastNodeAdditions map[string]*fastnode.Node
@@ -50,6 +52,8 @@ func NewUnsavedFastIterator(start, end []byte, ascending bool, ndb *nodeDB, unsa
 		nextUnsavedNodeIdx:       0,
 		fastIterator:             NewFastIterator(start, end, ascending, ndb),
 	}
+	// The unsaved fast nodes are those of the version after the one of the saved fast nodes.
+	iter.version = iter.fastIterator.version + 1
 
 	// We need to ensure that we iterate over saved and unsaved state in order.
 	// The strategy is to sort unsaved nodes, the fast node on disk are already sorted.
@@ -124,6 +128,16 @@ func (iter *UnsavedFastIterator) Value() []byte {
 	return iter.nextVal
 }
 
+// KeyVersion implements MetadataIterator.
+func (iter *UnsavedFastIterator) KeyVersion() int64 {
+	return iter.nextVersion
+}
+
+// KeyIndex implements MetadataIterator. Fast nodes do not tell the index of their keys.
+func (iter *UnsavedFastIterator) KeyIndex() (int64, bool) {
+	return 0, false
+}
+
 // Next implements dbm.Iterator
 // Its effectively running the constant space overhead algorithm for streaming through sorted lists:
 // the sorted lists being underlying fast nodes & unsavedFastNodeChanges
@@ -164,6 +178,7 @@ func (iter *UnsavedFastIterator) Next() {
 
 			iter.nextKey = nextUnsavedNode.GetKey()
 			iter.nextVal = nextUnsavedNode.GetValue()
+			iter.nextVersion = nextUnsavedNode.GetVersionLastUpdatedAt()
 
 			iter.nextUnsavedNodeIdx++
 			return
@@ -171,6 +186,7 @@ func (iter *UnsavedFastIterator) Next() {
 		// Disk node is next
 		iter.nextKey = iter.fastIterator.Key()
 		iter.nextVal = iter.fastIterator.Value()
+		iter.nextVersion = iter.fastIterator.KeyVersion()
 
 		iter.fastIterator.Next()
 		return
@@ -187,6 +203,7 @@ func (iter *UnsavedFastIterator) Next() {
 
 		iter.nextKey = iter.fastIterator.Key()
 		iter.nextVal = iter.fastIterator.Value()
+		iter.nextVersion = iter.fastIterator.KeyVersion()
 
 		iter.fastIterator.Next()
 		return
@@ -199,6 +216,7 @@ func (iter *UnsavedFastIterator) Next() {
 
 		iter.nextKey = nextUnsavedNode.GetKey()
 		iter.nextVal = nextUnsavedNode.GetValue()
+		iter.nextVersion = nextUnsavedNode.GetVersionLastUpdatedAt()
 
 		iter.nextUnsavedNodeIdx++
 		return
@@ -206,11 +224,37 @@ func (iter *UnsavedFastIterator) Next() {
 
 	iter.nextKey = nil
 	iter.nextVal = nil
+	iter.nextVersion = 0
+}
+
+// Seek implements SeekableIterator.
+func (iter *UnsavedFastIterator) Seek(key []byte) {
+	if iter.ndb == nil || iter.unsavedFastNodeAdditions == nil || iter.unsavedFastNodeRemovals == nil {
+		return
+	}
+	iter.fastIterator.Seek(key)
+
+	skey := ibytes.UnsafeBytesToStr(key)
+	iter.nextUnsavedNodeIdx = sort.Search(len(iter.unsavedFastNodesToSort), func(i int) bool {
+		if iter.ascending {
+			return iter.unsavedFastNodesToSort[i] >= skey
+		}
+		return iter.unsavedFastNodesToSort[i] <= skey
+	})
+	iter.nextKey, iter.nextVal = nil, nil
+	iter.Next()
+}
+
+// Cursor implements SeekableIterator.
+func (iter *UnsavedFastIterator) Cursor() *Cursor {
+	return newCursor(iter.version, iter.start, iter.end, iter.ascending, iter.Valid(), iter.Key())
 }
 
 // Close implements dbm.Iterator
 func (iter *UnsavedFastIterator) Close() error {
 	iter.valid = false
+	iter.nextUnsavedNodeIdx = len(iter.unsavedFastNodesToSort)
+	iter.nextKey, iter.nextVal, iter.nextVersion = nil, nil, 0
 	return iter.fastIterator.Close()
 }
 
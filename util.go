@@ -24,15 +24,19 @@ func printNode(ndb *nodeDB, node *Node, indent int) error {
 	}
 	if node.rightNode != nil {
 		printNode(ndb, node.rightNode, indent+1) //nolint:errcheck
-	} else if node.rightHash != nil {
-		rightNode, err := ndb.GetNode(node.rightHash)
+	} else if node.rightNodeKey != nil {
+		rightNode, err := ndb.GetNode(node.rightNodeKey)
 		if err != nil {
 			return err
 		}
 		printNode(ndb, rightNode, indent+1) //nolint:errcheck
 	}
 
-	hash, err := node._hash()
+	hasher, err := ndb.nodeHasher()
+	if err != nil {
+		return err
+	}
+	hash, err := node._hash(hasher)
 	if err != nil {
 		return err
 	}
@@ -47,8 +51,8 @@ func printNode(ndb *nodeDB, node *Node, indent int) error {
 		if err != nil {
 			return err
 		}
-	} else if node.leftHash != nil {
-		leftNode, err := ndb.GetNode(node.leftHash)
+	} else if node.leftNodeKey != nil {
+		leftNode, err := ndb.GetNode(node.leftNodeKey)
 		if err != nil {
 			return err
 		}